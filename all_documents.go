@@ -0,0 +1,171 @@
+package cblcgo
+
+import "math"
+import "strings"
+
+/** \defgroup alldocs   Listing documents
+    @{
+    \ref Database.AllDocuments lists documents by ID without reading their bodies, which are
+    loaded on demand:
+
+        it, err := db.AllDocuments(cblcgo.AllDocumentsOptions{Prefix: "user:", Limit: 50, Skip: page * 50})
+        if err != nil { ... }
+        defer it.Close()
+        for it.Next() {
+            fmt.Println(it.Handle().ID)
+        }
+        if err := it.Err(); err != nil { ... }
+ */
+
+/** Options for \ref Database.AllDocuments. IDs are compared byte by byte. */
+type AllDocumentsOptions struct {
+	StartKey string ///< First ID to return, if not empty; the highest one when Descending
+	EndKey string ///< Last ID to return, if not empty; the lowest one when Descending
+	Prefix string ///< Only return IDs starting with Prefix
+	Limit int ///< Maximum number of documents; 0 or less for no limit
+	Skip int ///< Number of matching documents to skip, for paging
+	Descending bool ///< Return IDs in descending order
+	IncludeDeleted bool ///< Also return deleted documents (purged ones are gone)
+}
+
+/** A document listed by \ref Database.AllDocuments. Its body isn't read until
+    \ref DocumentHandle.Get or \ref DocumentHandle.GetMutable is called. Couchbase Lite doesn't
+    expose revision IDs, so the sequence identifies the revision. */
+type DocumentHandle struct {
+	db *Database
+	ID string
+	Sequence uint64
+	Deleted bool
+}
+
+/** Reads the document. Fails for deleted documents, and for documents purged since they
+    were listed. */
+func (handle DocumentHandle) Get() (*Document, error) {
+	return handle.db.GetReadOnlyDocument(handle.ID)
+}
+
+/** Reads the document for editing. */
+func (handle DocumentHandle) GetMutable() (*Document, error) {
+	return handle.db.GetMutableDocument(handle.ID)
+}
+
+/** Iterates over the documents listed by \ref Database.AllDocuments. Close it when done. */
+type DocumentIterator struct {
+	db *Database
+	query *Query
+	results *ResultSet
+	current DocumentHandle
+	err error
+}
+
+// The highest code point, used to turn a prefix into an ID range.
+const maxIDRune = "\U0010FFFF"
+
+/** Lists documents by ID. Pages of a listing can be read with Limit and Skip, or, more
+    efficiently for large databases, by starting each page after the last ID of the previous
+    one. */
+func (db *Database) AllDocuments(opts AllDocumentsOptions) (*DocumentIterator, error) {
+	conditions := []string{}
+	parameters := map[string]interface{}{}
+	low, high := opts.StartKey, opts.EndKey
+	if opts.Descending {
+		low, high = high, low
+	}
+	if low != "" {
+		conditions = append(conditions, "meta().id >= $low")
+		parameters["low"] = low
+	}
+	if high != "" {
+		conditions = append(conditions, "meta().id <= $high")
+		parameters["high"] = high
+	}
+	if opts.Prefix != "" {
+		conditions = append(conditions, "meta().id >= $prefix", "meta().id < $prefix_end")
+		parameters["prefix"] = opts.Prefix
+		parameters["prefix_end"] = opts.Prefix + maxIDRune
+	}
+	if !opts.IncludeDeleted {
+		conditions = append(conditions, "meta().deleted = false")
+	}
+
+	query_string := "SELECT meta().id, meta().sequence, meta().deleted"
+	if len(conditions) > 0 {
+		query_string += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query_string += " ORDER BY meta().id"
+	if opts.Descending {
+		query_string += " DESC"
+	}
+	if opts.Limit > 0 || opts.Skip > 0 {
+		// OFFSET needs a LIMIT.
+		query_string += " LIMIT $limit"
+		parameters["limit"] = int64(math.MaxInt64)
+		if opts.Limit > 0 {
+			parameters["limit"] = opts.Limit
+		}
+	}
+	if opts.Skip > 0 {
+		query_string += " OFFSET $skip"
+		parameters["skip"] = opts.Skip
+	}
+
+	query, err := db.newQuery("", N1QLLanguage, query_string)
+	if err != nil {
+		return nil, err
+	}
+	if len(parameters) > 0 {
+		if err := query.SetParameters(parameters); err != nil {
+			query.Close()
+			return nil, err
+		}
+	}
+	results, err := query.Execute()
+	if err != nil {
+		query.Close()
+		return nil, err
+	}
+	return &DocumentIterator{db: db, query: query, results: results}, nil
+}
+
+/** Moves to the next document. Returns false at the end, after which the iterator is closed. */
+func (it *DocumentIterator) Next() bool {
+	if it.results == nil {
+		return false
+	}
+	if !it.results.Next() {
+		it.err = it.results.Err()
+		it.Close()
+		return false
+	}
+	handle := DocumentHandle{db: it.db}
+	handle.ID, _ = it.results.ValueAtIndex(0).(string)
+	handle.Sequence = uint64Value(it.results.ValueAtIndex(1))
+	handle.Deleted = boolValue(it.results.ValueAtIndex(2))
+	it.current = handle
+	return true
+}
+
+/** Returns the current document. */
+func (it *DocumentIterator) Handle() DocumentHandle {
+	return it.current
+}
+
+/** Returns the error that ended the iteration early, if any. */
+func (it *DocumentIterator) Err() error {
+	return it.err
+}
+
+/** Releases the query and its results. */
+func (it *DocumentIterator) Close() error {
+	if it.results != nil {
+		it.results.Release()
+		it.results = nil
+	}
+	if it.query != nil {
+		it.query.Close()
+		it.query = nil
+	}
+	return nil
+}
+
+/** @} */
@@ -0,0 +1,605 @@
+package cblcgo
+
+import "bufio"
+import "bytes"
+import "context"
+import "crypto/sha1"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io"
+import "os"
+import "sync"
+import "time"
+
+/** \defgroup audit   Audit log
+    @{
+    An opt-in change history. An \ref AuditLog listens for changes to a database, reads the new
+    revision of each changed document and appends an \ref AuditEntry holding the patch from its
+    previous body (see \ref DiffDocuments) to an \ref AuditSink: another database
+    (\ref NewAuditDatabaseSink) or a rolling file of JSON lines (\ref NewAuditFileSink).
+
+    Changes made through the audit log's own \ref AuditLog.Save, \ref AuditLog.DeleteDocument
+    and \ref AuditLog.PatchDocument are attributed to the actor carried by their context (see
+    \ref ContextWithActor). Other changes, such as those pulled by a replicator, have no actor.
+
+        sink, err := cblcgo.NewAuditFileSink("./audit.log", 10 << 20, 5)
+        audit, err := cblcgo.NewAuditLog(db, sink, cblcgo.AuditOptions{})
+        defer audit.Close()
+        _, err = audit.Save(cblcgo.ContextWithActor(ctx, user), doc, cblcgo.FailOnConflict)
+        history, err := audit.History(doc.Id())
+ */
+
+/** One recorded change to a document. */
+type AuditEntry struct {
+	DocumentID string `json:"docID"`
+	Sequence uint64 `json:"sequence"` ///< The document's sequence; 0 if it was deleted or purged
+	Generation uint64 `json:"generation"` ///< Counts the document's entries, starting at 1
+	/** "GENERATION-DIGEST", where DIGEST is the SHA-1 of the body as JSON. Couchbase Lite
+	    doesn't expose its own revision IDs, so the audit log keeps its own. */
+	Revision string `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor string `json:"actor,omitempty"`
+	Deleted bool `json:"deleted,omitempty"` ///< The document was deleted or purged
+	/** The patch starts from an empty body rather than the previous entry's, because the
+	    previous body wasn't known: the first entry of a document, or the first one after its
+	    earlier entries were lost (for instance rotated out of a file sink). */
+	Full bool `json:"full,omitempty"`
+	Patch Patch `json:"patch"`
+}
+
+/** Where an \ref AuditLog stores its entries. History returns a document's entries oldest
+    first. */
+type AuditSink interface {
+	Append(entry AuditEntry) error
+	History(docID string) ([]AuditEntry, error)
+}
+
+/** Options for \ref NewAuditLog. */
+type AuditOptions struct {
+	Filter func(docID string) bool ///< Documents to audit; nil audits all of them
+	/** Called when a change can't be recorded, on the thread delivering the database's change
+	    notifications. It may use the log. */
+	OnError func(docID string, err error)
+}
+
+/** Records the changes made to a database. */
+type AuditLog struct {
+	db *Database
+	sink AuditSink
+	options AuditOptions
+	token *ListenerToken
+	mutex sync.Mutex // guards token, actors and err
+	actors map[string][]*auditPending // saves made through the log, per document, oldest first
+	err error
+	recording sync.Mutex // serializes record, and guards states; held during sink I/O
+	states map[string]*auditState // last recorded body of each document
+}
+
+// A change made through an AuditLog wrapper, waiting for its notification.
+type auditPending struct {
+	actor string
+	sequence uint64 // set once the save returns; 0 while it runs
+	deleted bool
+}
+
+type auditState struct {
+	body map[string]interface{}
+	generation uint64
+	deleted bool
+	known bool // false if body couldn't be reconstructed from the sink
+}
+
+type auditActorKey struct{}
+
+/** Returns a copy of ctx carrying the actor that changes made with it are attributed to. */
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+/** Returns the actor carried by ctx, or "". */
+func ActorFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+/** Starts recording the changes made to db in sink, until \ref AuditLog.Close is called.
+    A database sink must not store its entries in db itself. */
+func NewAuditLog(db *Database, sink AuditSink, options AuditOptions) (*AuditLog, error) {
+	if db_sink, ok := sink.(*AuditDatabaseSink); ok && db_sink.db.db == db.db {
+		return nil, ErrInvalidArguments
+	}
+	audit := &AuditLog{
+		db: db,
+		sink: sink,
+		options: options,
+		states: make(map[string]*auditState),
+		actors: make(map[string][]*auditPending),
+	}
+	key := fmt.Sprintf("cblcgo.audit.%p", audit)
+	ctx := context.WithValue(context.Background(), uuid, key)
+	token, err := db.AddDatabaseChangeListener(func(ctx context.Context, _ *Database, docIDs []string) {
+		for _, docID := range docIDs {
+			if !audit.audits(docID) {
+				continue
+			}
+			// OnError is called without holding any lock, so that it may use the log.
+			if err := audit.record(docID); err != nil && audit.options.OnError != nil {
+				audit.options.OnError(docID, err)
+			}
+		}
+	}, ctx, []string{uuid})
+	if err != nil {
+		return nil, err
+	}
+	audit.token = token
+	return audit, nil
+}
+
+/** Stops recording changes. It doesn't close the sink. */
+func (audit *AuditLog) Close() error {
+	audit.mutex.Lock()
+	token := audit.token
+	audit.token = nil
+	audit.mutex.Unlock()
+	// Not under the lock, which a notification being delivered may be waiting for.
+	if token != nil {
+		audit.db.RemoveListener(token)
+	}
+	return nil
+}
+
+/** Returns the entries recorded for a document, oldest first. */
+func (audit *AuditLog) History(docID string) ([]AuditEntry, error) {
+	return audit.sink.History(docID)
+}
+
+/** Returns the last error met while recording a change, or nil. */
+func (audit *AuditLog) Err() error {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	return audit.err
+}
+
+/** Same as \ref Database.SaveContext, attributing the change to the actor carried by ctx. */
+func (audit *AuditLog) Save(ctx context.Context, doc *Document, concurrency ConcurrencyControl) (*Document, error) {
+	pending := audit.addPending(doc.Id(), ActorFromContext(ctx), false)
+	saved, err := audit.db.SaveContext(ctx, doc, concurrency)
+	audit.savedPending(doc.Id(), pending, saved, err)
+	return saved, err
+}
+
+/** Same as \ref Database.DeleteDocumentContext, attributing the deletion to the actor carried
+    by ctx. */
+func (audit *AuditLog) DeleteDocument(ctx context.Context, doc *Document, concurrency ConcurrencyControl) error {
+	pending := audit.addPending(doc.Id(), ActorFromContext(ctx), true)
+	err := audit.db.DeleteDocumentContext(ctx, doc, concurrency)
+	audit.savedPending(doc.Id(), pending, nil, err)
+	return err
+}
+
+/** Same as \ref Database.PatchDocument, attributing the change to the actor carried by ctx. */
+func (audit *AuditLog) PatchDocument(ctx context.Context, docId string, patch Patch, concurrency ConcurrencyControl) (*Document, error) {
+	pending := audit.addPending(docId, ActorFromContext(ctx), false)
+	saved, err := audit.db.PatchDocument(docId, patch, concurrency)
+	audit.savedPending(docId, pending, saved, err)
+	return saved, err
+}
+
+func (audit *AuditLog) audits(docID string) bool {
+	return audit.options.Filter == nil || audit.options.Filter(docID)
+}
+
+// Registers a change about to be made, so that its notification can be attributed to actor.
+// Returns nil if there is nothing to attribute.
+func (audit *AuditLog) addPending(docID, actor string, deleted bool) *auditPending {
+	if actor == "" || !audit.audits(docID) {
+		return nil
+	}
+	pending := &auditPending{actor: actor, deleted: deleted}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	audit.actors[docID] = append(audit.actors[docID], pending)
+	return pending
+}
+
+// Records the sequence a pending change was saved as, or forgets it if it failed.
+func (audit *AuditLog) savedPending(docID string, pending *auditPending, saved *Document, err error) {
+	if pending == nil {
+		return
+	}
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if err == nil && saved != nil {
+		pending.sequence = saved.DocumentSequence()
+		return
+	}
+	if err != nil {
+		audit.removePendingLocked(docID, pending)
+	}
+}
+
+func (audit *AuditLog) removePendingLocked(docID string, pending *auditPending) {
+	list := audit.actors[docID]
+	for i, p := range list {
+		if p == pending {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(audit.actors, docID)
+	} else {
+		audit.actors[docID] = list
+	}
+}
+
+// Returns the actor of the change of a document recorded by entry, and forgets it. A save is
+// matched by its sequence; one whose notification arrives before it returns is matched as the
+// oldest save still running. Saves older than entry, whose notifications were merged into a
+// later one, are forgotten.
+func (audit *AuditLog) takeActor(entry *AuditEntry) string {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	var match *auditPending
+	for _, pending := range audit.actors[entry.DocumentID] {
+		if pending.deleted != entry.Deleted {
+			continue
+		}
+		if entry.Deleted || (pending.sequence == entry.Sequence && entry.Sequence != 0) {
+			match = pending
+			break
+		}
+		if pending.sequence == 0 && match == nil {
+			match = pending
+		}
+	}
+	if !entry.Deleted {
+		for _, pending := range audit.actors[entry.DocumentID] {
+			if !pending.deleted && pending.sequence != 0 && pending.sequence < entry.Sequence {
+				audit.removePendingLocked(entry.DocumentID, pending)
+			}
+		}
+	}
+	if match == nil {
+		return ""
+	}
+	audit.removePendingLocked(entry.DocumentID, match)
+	return match.actor
+}
+
+// Appends an entry for the current revision of a document.
+func (audit *AuditLog) record(docID string) error {
+	entry := AuditEntry{DocumentID: docID, Timestamp: time.Now()}
+	body := map[string]interface{}{}
+	if doc, err := audit.db.GetReadOnlyDocument(docID); err == nil {
+		entry.Sequence = doc.DocumentSequence()
+		// Blobs belong to the document, so the body is detached from it before it is closed.
+		body, err = auditBody(doc.Props)
+		doc.Close()
+		if err != nil {
+			return audit.fail(err)
+		}
+	} else {
+		entry.Deleted = true
+	}
+
+	audit.recording.Lock()
+	defer audit.recording.Unlock()
+	state := audit.state(docID)
+	entry.Actor = audit.takeActor(&entry)
+	if entry.Deleted && state.deleted {
+		return nil // purging a deleted document, or a repeated notification
+	}
+	entry.Generation = state.generation + 1
+	entry.Full = !state.known
+	if entry.Full {
+		entry.Patch = diffProperties(map[string]interface{}{}, body)
+	} else {
+		entry.Patch = diffProperties(state.body, body)
+	}
+	if !entry.Deleted && !entry.Full && len(entry.Patch) == 0 {
+		return nil // nothing changed since the last entry
+	}
+	text, _ := json.Marshal(body)
+	digest := sha1.Sum(text)
+	entry.Revision = fmt.Sprintf("%d-%s", entry.Generation, hex.EncodeToString(digest[:]))
+
+	if err := audit.sink.Append(entry); err != nil {
+		return audit.fail(err)
+	}
+	audit.states[docID] = &auditState{body: body, generation: entry.Generation, deleted: entry.Deleted, known: true}
+	CurrentMetrics().add("cbl_audit_entries_total", 1)
+	return nil
+}
+
+// Returns the last recorded state of a document, replaying its history from the sink the
+// first time it is needed.
+func (audit *AuditLog) state(docID string) *auditState {
+	if state, ok := audit.states[docID]; ok {
+		return state
+	}
+	state := &auditState{body: map[string]interface{}{}, known: false}
+	history, err := audit.sink.History(docID)
+	if err != nil || len(history) == 0 {
+		return state
+	}
+	state.generation = history[len(history)-1].Generation
+	state.deleted = history[len(history)-1].Deleted
+
+	start := -1
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Full {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return state
+	}
+	body := map[string]interface{}{}
+	for _, entry := range history[start:] {
+		if body, err = applyPatch(body, entry.Patch); err != nil {
+			return state
+		}
+	}
+	state.body = body
+	state.known = true
+	return state
+}
+
+// Remembers an error for Err, and returns it for the caller to report to OnError.
+func (audit *AuditLog) fail(err error) error {
+	audit.mutex.Lock()
+	audit.err = err
+	audit.mutex.Unlock()
+	CurrentMetrics().add("cbl_audit_errors_total", 1)
+	return err
+}
+
+// Returns a copy of a document body holding only JSON values. Blobs become their metadata.
+func auditBody(props map[string]interface{}) (map[string]interface{}, error) {
+	text, err := json.Marshal(props)
+	if err != nil {
+		return nil, err
+	}
+	var body map[string]interface{}
+	err = decodeAuditJSON(text, &body)
+	return body, err
+}
+
+func decodeAuditJSON(text []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(text))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+/** \name  Database sink
+    @{ */
+
+/** Stores audit entries as documents of another database, with `"type": "audit"`. */
+type AuditDatabaseSink struct {
+	db *Database
+}
+
+/** Returns a sink storing entries in db, and creates the index its queries use. */
+func NewAuditDatabaseSink(db *Database) (*AuditDatabaseSink, error) {
+	if !db.CreateIndex("cblcgo_audit", IndexSpec{ValueIndex, `[[".docID"],[".generation"]]`, false, ""}) {
+		return nil, ErrProblemCreatingIndex
+	}
+	return &AuditDatabaseSink{db}, nil
+}
+
+func (sink *AuditDatabaseSink) Append(entry AuditEntry) error {
+	patch, err := json.Marshal(entry.Patch)
+	if err != nil {
+		return err
+	}
+	doc := NewDocument()
+	defer doc.Close()
+	doc.Props["type"] = "audit"
+	doc.Props["docID"] = entry.DocumentID
+	doc.Props["sequence"] = entry.Sequence
+	doc.Props["generation"] = entry.Generation
+	doc.Props["revision"] = entry.Revision
+	doc.Props["timestamp"] = entry.Timestamp.UTC().Format(time.RFC3339Nano)
+	doc.Props["actor"] = entry.Actor
+	doc.Props["deleted"] = entry.Deleted
+	doc.Props["full"] = entry.Full
+	doc.Props["patch"] = string(patch)
+	_, err = sink.db.Save(doc, LastWriteWins)
+	return err
+}
+
+func (sink *AuditDatabaseSink) History(docID string) ([]AuditEntry, error) {
+	query, err := sink.db.newQuery("", N1QLLanguage, "SELECT sequence, generation, revision, timestamp, actor, deleted, full, patch "+
+		"WHERE type = 'audit' AND docID = $docID ORDER BY generation")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+	if err := query.SetParameters(map[string]interface{}{"docID": docID}); err != nil {
+		return nil, err
+	}
+	results, err := query.Execute()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Release()
+
+	var history []AuditEntry
+	for results.Next() {
+		entry := AuditEntry{DocumentID: docID}
+		entry.Sequence = uint64Value(results.ValueAtIndex(0))
+		entry.Generation = uint64Value(results.ValueAtIndex(1))
+		entry.Revision, _ = results.ValueAtIndex(2).(string)
+		if timestamp, ok := results.ValueAtIndex(3).(string); ok {
+			entry.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		}
+		entry.Actor, _ = results.ValueAtIndex(4).(string)
+		entry.Deleted, _ = results.ValueAtIndex(5).(bool)
+		entry.Full, _ = results.ValueAtIndex(6).(bool)
+		if patch, ok := results.ValueAtIndex(7).(string); ok {
+			if err := decodeAuditJSON([]byte(patch), &entry.Patch); err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+/** @} */
+
+/** \name  File sink
+    @{ */
+
+/** Appends audit entries to a file as JSON lines, rotating it when it grows too large. */
+type AuditFileSink struct {
+	path string
+	maxSize int64
+	maxFiles int
+	mutex sync.Mutex
+	file *os.File
+	size int64
+}
+
+/** Returns a sink appending to the file at path. Once the file would grow past maxSize bytes
+    it is renamed to path.1 (path.1 to path.2, and so on) and a new one is started; at most
+    maxFiles rotated files are kept. A maxSize of 0 never rotates. */
+func NewAuditFileSink(path string, maxSize int64, maxFiles int) (*AuditFileSink, error) {
+	sink := &AuditFileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *AuditFileSink) open() error {
+	file, err := os.OpenFile(sink.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	return nil
+}
+
+func (sink *AuditFileSink) rotate() error {
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	sink.file = nil
+	if sink.maxFiles <= 0 {
+		if err := os.Remove(sink.path); err != nil {
+			return err
+		}
+		return sink.open()
+	}
+	os.Remove(sink.rotatedPath(sink.maxFiles))
+	for i := sink.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(sink.rotatedPath(i), sink.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(sink.path, sink.rotatedPath(1)); err != nil {
+		return err
+	}
+	return sink.open()
+}
+
+func (sink *AuditFileSink) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", sink.path, i)
+}
+
+func (sink *AuditFileSink) Append(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.file == nil {
+		return os.ErrClosed
+	}
+	if sink.maxSize > 0 && sink.size > 0 && sink.size + int64(len(line)) > sink.maxSize {
+		if err := sink.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := sink.file.Write(line)
+	sink.size += int64(n)
+	return err
+}
+
+/** Reads the entries of a document from the rotated files, oldest first, then from the
+    current one. */
+func (sink *AuditFileSink) History(docID string) ([]AuditEntry, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	var history []AuditEntry
+	for i := sink.maxFiles; i >= 0; i-- {
+		path := sink.path
+		if i > 0 {
+			path = sink.rotatedPath(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		history, err = readAuditEntries(file, docID, history)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+func readAuditEntries(r io.Reader, docID string, history []AuditEntry) ([]AuditEntry, error) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry AuditEntry
+			if decode_err := decodeAuditJSON(line, &entry); decode_err != nil {
+				return nil, decode_err
+			}
+			if entry.DocumentID == docID {
+				history = append(history, entry)
+			}
+		}
+		if err == io.EOF {
+			return history, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+/** Closes the file. */
+func (sink *AuditFileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+/** @} */
+/** @} */
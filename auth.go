@@ -0,0 +1,276 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "include/CouchbaseLite.h"
+
+*/
+import "C"
+import "unsafe"
+import "context"
+import "crypto/tls"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "strings"
+import "time"
+
+/** \name  Rotating credentials
+    @{
+    Besides the static Basic and session authenticators, an \ref Authenticator can be backed by
+    a credential source that hands out short-lived credentials: a bearer token sent in the
+    `Authorization` header, or a Sync Gateway session obtained from an OpenID Connect ID token.
+
+    Credentials are resolved when \ref NewReplicator is called. A \ref ReplicatorSupervisor
+    refreshes them shortly before they expire (or after the server rejects them) and recreates
+    the replicator with the new credentials, so rotation is transparent to the application.
+ */
+
+/** How long before expiry credentials are considered stale. */
+const CredentialRefreshMargin = time.Minute
+
+/** Supplies tokens, such as OAuth access tokens or OpenID Connect ID tokens.
+    A zero expiry means the token doesn't expire. */
+type TokenSource interface {
+	Token(ctx context.Context) (token string, expiry time.Time, err error)
+}
+
+/** Adapts an ordinary function to the \ref TokenSource interface. */
+type TokenSourceFunc func(ctx context.Context) (string, time.Time, error)
+
+func (f TokenSourceFunc) Token(ctx context.Context) (string, time.Time, error) {
+	return f(ctx)
+}
+
+type credentials struct {
+	headers map[string]interface{}
+	sessionId string
+	cookieName string
+	expires time.Time
+}
+
+type credentialSource interface {
+	credentials(ctx context.Context) (*credentials, error)
+}
+
+type retiredAuth struct {
+	auth *C.CBLAuthenticator
+	generation uint64 // the authenticator's generation while auth was current
+}
+
+type bearerTokenSource struct {
+	tokens TokenSource
+}
+
+func (s *bearerTokenSource) credentials(ctx context.Context) (*credentials, error) {
+	token, expiry, err := s.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]interface{}{"Authorization": "Bearer " + token}
+	return &credentials{headers: headers, expires: expiry}, nil
+}
+
+/** Creates an authenticator that sends `Authorization: Bearer <token>` with the replicator's
+    WebSocket request. The first token is fetched immediately; later ones are fetched whenever
+    the current token is about to expire. */
+func NewBearerTokenAuthenticator(tokens TokenSource) (*Authenticator, error) {
+	auth := Authenticator{source: &bearerTokenSource{tokens}}
+	if _, err := auth.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+type openIDConnectSource struct {
+	sessionURL string
+	cookieName string // the session cookie to look for, or AnySessionCookie
+	idTokens TokenSource
+	client *http.Client
+}
+
+// The body Sync Gateway answers a session request with.
+type sessionResponse struct {
+	SessionId string `json:"session_id"`
+	CookieName string `json:"cookie_name"`
+	Expires string `json:"expires"`
+}
+
+func (s *openIDConnectSource) credentials(ctx context.Context) (*credentials, error) {
+	idToken, idExpiry, err := s.idTokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.sessionURL, strings.NewReader("{}"))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer " + idToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("CBL: Session Request Failed. Status: %s", res.Status)
+	}
+
+	creds := credentials{cookieName: s.cookieName, expires: idExpiry}
+	var body sessionResponse
+	if json.NewDecoder(res.Body).Decode(&body) == nil && body.SessionId != "" {
+		creds.sessionId = body.SessionId
+		if body.CookieName != "" {
+			creds.cookieName = body.CookieName
+		}
+		if expires, e := time.Parse(time.RFC3339, body.Expires); e == nil {
+			creds.expires = expires
+		}
+	}
+	if creds.sessionId == "" {
+		// Sync Gateway may only hand the session out as a cookie.
+		for _, cookie := range res.Cookies() {
+			if creds.cookieName == AnySessionCookie || cookie.Name == creds.cookieName {
+				creds.sessionId = cookie.Value
+				creds.cookieName = cookie.Name
+				if !cookie.Expires.IsZero() {
+					creds.expires = cookie.Expires
+				}
+				break
+			}
+		}
+	}
+	if creds.sessionId == "" {
+		return nil, fmt.Errorf("CBL: Session Response From %s Has No Session", s.sessionURL)
+	}
+	if creds.cookieName == AnySessionCookie {
+		creds.cookieName = AuthDefaultCookieName
+	}
+	return &creds, nil
+}
+
+/** Creates an authenticator that exchanges OpenID Connect ID tokens for Sync Gateway session
+    cookies. Each ID token is POSTed as a bearer token to `sessionURL` (the database's
+    `_session` endpoint, e.g. `https://sg.example.org:4984/db/_session`), and the session it
+    returns is used to authenticate the replicator. A session handed out only as a cookie must
+    be in the \ref AuthDefaultCookieName cookie. If `client` is nil, http.DefaultClient is
+    used. */
+func NewOpenIDConnectAuthenticator(sessionURL string, idTokens TokenSource, client *http.Client) (*Authenticator, error) {
+	return NewOpenIDConnectAuthenticatorWithCookie(sessionURL, AuthDefaultCookieName, idTokens, client)
+}
+
+/** Passed as the cookie name to \ref NewOpenIDConnectAuthenticatorWithCookie to use whichever
+    cookie the session endpoint sets. */
+const AnySessionCookie = "*"
+
+/** Like \ref NewOpenIDConnectAuthenticator, for servers whose session cookie has another name.
+    If `cookieName` is \ref AnySessionCookie, the first cookie in the response is used. */
+func NewOpenIDConnectAuthenticatorWithCookie(sessionURL, cookieName string, idTokens TokenSource, client *http.Client) (*Authenticator, error) {
+	if cookieName == "" {
+		return nil, ErrInvalidArguments
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	auth := Authenticator{source: &openIDConnectSource{sessionURL, cookieName, idTokens, client}}
+	if _, err := auth.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return &auth, nil
+}
+
+/** Creates an authenticator that presents a TLS client certificate.
+    @warning  The supported couchbase-lite-C commit has no client-certificate authentication,
+              so this always returns \ref ErrNotSupported. */
+func NewClientCertificateAuthenticator(cert tls.Certificate) (*Authenticator, error) {
+	return nil, ErrNotSupported
+}
+
+/** Returns true if the authenticator's credentials rotate. */
+func (auth *Authenticator) Rotates() bool {
+	return auth.source != nil
+}
+
+/** Returns when the current credentials expire, or the zero time if they don't. */
+func (auth *Authenticator) Expiry() time.Time {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.expires
+}
+
+/** Returns true if the credentials rotate and expire within \ref CredentialRefreshMargin. */
+func (auth *Authenticator) NeedsRefresh(now time.Time) bool {
+	expiry := auth.Expiry()
+	return auth.source != nil && !expiry.IsZero() && now.Add(CredentialRefreshMargin).After(expiry)
+}
+
+/** Fetches fresh credentials from the authenticator's source. Returns true if the credentials
+    changed; replicators created earlier keep using the old ones until they are recreated.
+    Static authenticators are never refreshed. The replaced `CBLAuthenticator` isn't freed,
+    since other replicator configurations may share the authenticator: a \ref
+    ReplicatorSupervisor frees it once it has recreated every replicator that used it, and
+    \ref Authenticator.Free frees the rest. */
+func (auth *Authenticator) Refresh(ctx context.Context) (bool, error) {
+	if auth.source == nil {
+		return false, nil
+	}
+	creds, err := auth.source.credentials(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	changed := false
+	if creds.sessionId != "" {
+		c_sess := C.CString(creds.sessionId)
+		defer C.free(unsafe.Pointer(c_sess))
+		var c_cookie *C.char
+		if creds.cookieName != "" {
+			c_cookie = C.CString(creds.cookieName)
+			defer C.free(unsafe.Pointer(c_cookie))
+		}
+		if auth.auth != nil {
+			auth.retired = append(auth.retired, retiredAuth{auth.auth, auth.generation})
+		}
+		auth.auth = C.CBLAuth_NewSession(c_sess, c_cookie)
+		auth.generation++
+		changed = true
+	}
+	for k, v := range creds.headers {
+		if auth.headers[k] != v {
+			changed = true
+		}
+	}
+	if len(creds.headers) != len(auth.headers) {
+		changed = true
+	}
+	auth.headers = creds.headers
+	auth.expires = creds.expires
+	return changed, nil
+}
+
+// Returns the generation of the current credentials; replicators created now use it.
+func (auth *Authenticator) currentGeneration() uint64 {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	return auth.generation
+}
+
+// Frees the replaced authenticators older than generation, which no replicator uses anymore.
+func (auth *Authenticator) releaseRetired(generation uint64) {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	kept := auth.retired[:0]
+	for _, r := range auth.retired {
+		if r.generation < generation {
+			C.CBLAuth_Free(r.auth)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	auth.retired = kept
+}
+
+/** @} */
@@ -9,6 +9,12 @@ package cblcgo
 import "C"
 import "unsafe"
 import "fmt"
+import "context"
+import "encoding/json"
+import "io"
+import "runtime"
+
+import "github.com/svr4/couchbase-lite-cgo/fleece"
 
 /** \defgroup blobs Blobs
     @{
@@ -50,6 +56,9 @@ import "fmt"
 type Blob struct {
 	blob *C.CBLBlob
 	Props map[string]interface{}
+	owned bool // false for blobs that belong to a document's properties
+	doc *C.CBLDocument // document kept alive for an owned blob found in it
+	retained bool // a blob from a document's properties, retained until garbage collected
 }
 
  /** Returns true if a dictionary in a document is a blob reference.
@@ -71,7 +80,10 @@ func isBlob(fl_dict C.FLDict) bool {
 func getBlob(fl_dict C.FLDict) (*Blob, error) {
 	c_blob := C.CBLBlob_Get(fl_dict)
 	if props, err := getKeyValuePropMap(getBlobPoperties(c_blob)); err == nil {
-		blob := Blob{c_blob, props}
+		// The document may be released, or replaced by Save, while the Go value is still
+		// around, so the blob keeps its own reference until it is garbage collected.
+		blob := Blob{blob: C.CBLBlob_Retain(c_blob), Props: props, retained: true}
+		runtime.SetFinalizer(&blob, (*Blob).releaseRetained)
 		return &blob, nil
 	}
 	return nil, ErrProblemGettingBlobWithData
@@ -89,18 +101,16 @@ func (blob *Blob) Length() uint64 {
 //  const char* CBLBlob_Digest(const CBLBlob* _cbl_nonnull) CBLAPI;
 func (blob *Blob) Digest() string {
 	c_dig := C.CBLBlob_Digest(blob.blob)
-	dig := C.GoString(c_dig)
-	C.free(unsafe.Pointer(c_dig))
-	return dig
+	// Owned by the blob.
+	return C.GoString(c_dig)
 }
 
  /** Returns a blob's MIME type, if its metadata has a `content_type` property. */
 //  const char* CBLBlob_ContentType(const CBLBlob* _cbl_nonnull) CBLAPI;
 func (blob *Blob) ContentType() string {
 	c_type := C.CBLBlob_ContentType(blob.blob)
-	t := C.GoString(c_type)
-	C.free(unsafe.Pointer(c_type))
-	return t
+	// Owned by the blob.
+	return C.GoString(c_type)
 }
  /** Returns a blob's metadata. This includes the `digest`, `length` and `content_type`
 	 properties, as well as any custom ones that may have been added. */
@@ -120,6 +130,7 @@ func blobLoadContent(blob *C.CBLBlob) C.FLSliceResult {
 	defer C.free(unsafe.Pointer(err))
 	result := C.CBLBlob_LoadContent(blob, err)
 	if (*err).code == 0 {
+		CurrentMetrics().add("cbl_blob_read_bytes_total", float64(result.size))
 		return result
 	}
 	return C.FLSliceResult{}
@@ -155,20 +166,11 @@ func (blob *Blob) NewReadStream() *BlobReadStream {
 // 						size_t maxLength,
 // 						CBLError *outError) CBLAPI;
 func (blob *Blob) Read(res *BlobReadStream, dst []byte) (int, error) {
-	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
-	defer C.free(unsafe.Pointer(err))
-	maxLength := len(dst)
-	c_dst := C.CBytes(dst)
-	bytesRead := C.CBLBlobReader_Read(res.rs, c_dst, C.size_t(maxLength), err)
-	if (*err).code == 0 {
-		readData := C.GoBytes(c_dst, bytesRead)
-		copy(dst, readData)
-		C.free(c_dst)
-		return int(bytesRead), nil
+	bytesRead, err := readBlobStream(res.rs, dst)
+	if err != nil {
+		return -1, err
 	}
-	C.free(c_dst)
-	ErrCBLInternalError = fmt.Errorf("CBL: Problem Reading Blob. Domain: %d Code: %d", (*err).domain, (*err).code)
-	return -1, ErrCBLInternalError
+	return bytesRead, nil
 }
  /** Closes a CBLBlobReadStream. */
 //  void CBLBlobReader_Close(CBLBlobReadStream*) CBLAPI;
@@ -176,6 +178,49 @@ func (blob *Blob) CloseReader(rs *BlobReadStream) {
 	C.CBLBlobReader_Close(rs.rs)
 }
 
+/** Same as \ref Blob.Read, but fails with ctx.Err() once ctx is done. */
+func (blob *Blob) ReadContext(ctx context.Context, rs *BlobReadStream, dst []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	return blob.Read(rs, dst)
+}
+
+// Size of the chunks blob content is streamed in.
+const blobChunkSize = 32 * 1024
+
+/** Streams the blob's content to w, returning the number of bytes written. Stops with
+    ctx.Err() once ctx is done, so an HTTP handler can pass its request's context to respect
+    the client's deadline. */
+func (blob *Blob) WriteToContext(ctx context.Context, w io.Writer) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	rs := blob.NewReadStream()
+	if rs == nil {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Opening Blob %s", blob.Digest())
+		return 0, ErrCBLInternalError
+	}
+	defer blob.CloseReader(rs)
+
+	var written int64
+	buf := make([]byte, blobChunkSize)
+	for {
+		n, err := blob.ReadContext(ctx, rs, buf)
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, nil
+		}
+		m, err := w.Write(buf[:n])
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
 // #pragma mark - CREATING:
 
  /** Creates a new blob given its contents as a single block of data.
@@ -194,18 +239,62 @@ func NewBlobWithData(contentType string, contents []byte) (*Blob, error) {
 	c_blob := C.CBLBlob_CreateWithData(c_ct, fl_slice)
 	C.free(unsafe.Pointer(c_ct))
 	C.free(c_contents)
+	CurrentMetrics().add("cbl_blob_written_bytes_total", float64(len(contents)))
 	if props, err := getKeyValuePropMap(getBlobPoperties(c_blob)); err == nil {
-		blob := Blob{c_blob, props}
+		blob := Blob{blob: c_blob, Props: props, owned: true}
+		trackBlob(&blob)
 		return &blob, nil
 	}
 	return nil, ErrProblemCreatingBlobWithData
 }
 
+/** Releases a blob created with \ref NewBlobWithData, \ref CreateBlobWithStream or
+    \ref Database.NewBlobFromFile.
+    Blobs read from a document's properties stay usable after the document is saved or closed,
+    and are released once garbage collected, so closing them does nothing. Calling it more
+    than once is harmless. */
+func (blob *Blob) Close() error {
+	if blob.blob == nil || !blob.owned {
+		return nil
+	}
+	untrackObject(unsafe.Pointer(blob.blob))
+	if blob.doc != nil {
+		C.CBLDocument_Release(blob.doc)
+		blob.doc = nil
+	} else {
+		C.CBLBlob_Release(blob.blob)
+	}
+	blob.blob = nil
+	runtime.SetFinalizer(blob, nil)
+	return nil
+}
+
+/** Same as \ref Blob.Close. */
 func (blob *Blob) Release() bool {
-	C.CBLBlob_Release(blob.blob)
+	blob.Close()
 	return true
 }
 
+// Starts tracking a blob created for the caller.
+func trackBlob(blob *Blob) {
+	trackObject(unsafe.Pointer(blob.blob), "Blob", C.GoString(C.CBLBlob_Digest(blob.blob)))
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(blob, (*Blob).finalize)
+	}
+}
+
+func (blob *Blob) releaseRetained() {
+	if blob.retained && blob.blob != nil {
+		C.CBLBlob_Release(blob.blob)
+		blob.blob = nil
+	}
+}
+
+func (blob *Blob) finalize() {
+	reportLeak(unsafe.Pointer(blob.blob))
+	blob.Close()
+}
+
  /** A stream for writing a new blob to the database. */
 //  typedef struct CBLBlobWriteStream CBLBlobWriteStream;
 type BlobWriteStream struct {
@@ -249,17 +338,7 @@ func (db *Database) CloseBlobWriter(bwrs *BlobWriteStream) {
 // 						   size_t length,
 // 						   CBLError *outError) CBLAPI;
 func (blob *Blob) Write(bwrs *BlobWriteStream, data []byte) bool {
-	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
-	defer C.free(unsafe.Pointer(err))
-	length := C.size_t(len(data))
-	c_data := C.CBytes(data)
-	result := bool(C.CBLBlobWriter_Write(bwrs.wrs, c_data, length, err))
-	if result && (*err).code == 0 {
-		copy(data, C.GoBytes(c_data, C.int(length)))
-		return result
-	}
-	C.free(c_data)
-	return result
+	return writeBlobStream(bwrs.wrs, data) == nil
 }
 
 
@@ -278,7 +357,8 @@ func CreateBlobWithStream(contentType string, writer *BlobWriteStream) (*Blob, e
 	c_blob := C.CBLBlob_CreateWithStream(c_ct, writer.wrs)
 	C.free(unsafe.Pointer(c_ct))
 	if props, err := getKeyValuePropMap(getBlobPoperties(c_blob)); err == nil {
-		blob := Blob{c_blob, props}
+		blob := Blob{blob: c_blob, Props: props, owned: true}
+		trackBlob(&blob)
 		return &blob, nil
 	}
 	return nil, ErrProblemCreatingBlobWithData
@@ -310,4 +390,22 @@ func CreateBlobWithStream(contentType string, writer *BlobWriteStream) (*Blob, e
 // 							FLString key,
 // 							CBLBlob* blob _cbl_nonnull) CBLAPI;
 
+/** Encodes the blob as its metadata dictionary, as it appears in a document's JSON. */
+func (blob *Blob) MarshalJSON() ([]byte, error) {
+	return json.Marshal(blob.Props)
+}
+
+/** Stores the blob in a dictionary, so that its content is saved with the document.
+    Implements fleece.Storer, which lets blobs appear anywhere in a document's Props. */
+func (blob *Blob) StoreInDict(d fleece.MutableDict, key string) {
+	c_key := C.CString(key)
+	C.FLMutableDict_SetBlob(C.FLMutableDict(d.CPointer()), C.FLStr(c_key), blob.blob)
+	C.free(unsafe.Pointer(c_key))
+}
+
+/** Stores the blob at an existing index of an array. Implements fleece.Storer. */
+func (blob *Blob) StoreInArray(a fleece.MutableArray, index int) {
+	C.FLMutableArray_SetBlob(C.FLMutableArray(a.CPointer()), C.uint32_t(index), blob.blob)
+}
+
 /** @} */
\ No newline at end of file
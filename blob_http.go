@@ -0,0 +1,71 @@
+package cblcgo
+
+import "net/http"
+import "strings"
+import "time"
+
+/** \defgroup blob_http   Serving Blobs over HTTP
+    @{
+ */
+
+/** Writes the blob stored in property `property` of document `docID`, with its content type,
+    an ETag made from its digest, and support for Range and conditional requests (see
+    http.ServeContent). Responds 404 if the document or blob doesn't exist. */
+func ServeBlob(w http.ResponseWriter, r *http.Request, db *Database, docID, property string) {
+	doc, err := db.GetReadOnlyDocument(docID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// The blob belongs to the document, so keep it open until the response is written.
+	defer doc.Close()
+	blob, ok := doc.Props[property].(*Blob)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	content, err := blob.OpenReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	if contentType := blob.ContentType(); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	// Digests never change for the same content, so they make strong validators.
+	w.Header().Set("ETag", `"`+blob.Digest()+`"`)
+	http.ServeContent(w, r, property, time.Time{}, content)
+}
+
+type blobHandler struct {
+	db *Database
+}
+
+/** Returns a handler serving blobs at `/DOCID/PROPERTY` with \ref ServeBlob. The document ID
+    may contain slashes; the property name is the last path element. Mount it with
+    http.StripPrefix:
+
+        http.Handle("/attachments/", http.StripPrefix("/attachments", cblcgo.NewBlobHandler(db)))
+ */
+func NewBlobHandler(db *Database) http.Handler {
+	return blobHandler{db}
+}
+
+func (h blobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		http.NotFound(w, r)
+		return
+	}
+	ServeBlob(w, r, h.db, path[:slash], path[slash+1:])
+}
+
+/** @} */
@@ -0,0 +1,236 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "include/CouchbaseLite.h"
+*/
+import "C"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "unsafe"
+
+/** \defgroup blob_inventory   Blob Inventory
+    @{
+    Finding the blobs a database holds and the space they use.
+ */
+
+/** A blob reference found in a document. */
+type BlobRef struct {
+	DocumentID string
+	KeyPath string ///< Location of the reference in the document, as a JSON pointer (RFC 6901), e.g. `/photos/0`
+	Digest string
+	Length uint64
+	ContentType string
+}
+
+/** A blob file in the database's attachment directory. */
+type BlobFile struct {
+	Path string
+	Digest string
+	Size int64
+}
+
+// Returns the IDs of all documents, in ID order.
+func (db *Database) documentIDs() ([]string, error) {
+	it, err := db.AllDocuments(AllDocumentsOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	var ids []string
+	for it.Next() {
+		ids = append(ids, it.Handle().ID)
+	}
+	return ids, it.Err()
+}
+
+// Calls fn for each blob reference in a document's properties, in depth-first order, until
+// it returns false. The blob belongs to the document.
+func walkDocumentBlobs(docID string, fl_dict C.FLDict, fn func(ref BlobRef, blob *C.CBLBlob) bool) {
+	iter := C.FLDeepIterator_New(C.FLValue(unsafe.Pointer(fl_dict)))
+	defer C.FLDeepIterator_Free(iter)
+	for value := C.FLDeepIterator_GetValue(iter); value != nil; value = C.FLDeepIterator_GetValue(iter) {
+		if dict := C.FLValue_AsDict(value); dict != nil && isBlob(dict) {
+			blob := C.CBLBlob_Get(dict)
+			pointer := C.FLDeepIterator_GetJSONPointer(iter)
+			ref := BlobRef{
+				DocumentID: docID,
+				KeyPath: C.GoStringN((*C.char)(pointer.buf), C.int(pointer.size)),
+				Digest: C.GoString(C.CBLBlob_Digest(blob)),
+				Length: uint64(C.CBLBlob_Length(blob)),
+				ContentType: C.GoString(C.CBLBlob_ContentType(blob)),
+			}
+			C.FLSliceResult_Release(pointer)
+			if !fn(ref, blob) {
+				return
+			}
+			C.FLDeepIterator_SkipChildren(iter)
+		}
+		C.FLDeepIterator_Next(iter)
+	}
+}
+
+// Returns the blob references in a document's properties, in depth-first order.
+func documentBlobRefs(docID string, fl_dict C.FLDict) []BlobRef {
+	var refs []BlobRef
+	walkDocumentBlobs(docID, fl_dict, func(ref BlobRef, blob *C.CBLBlob) bool {
+		refs = append(refs, ref)
+		return true
+	})
+	return refs
+}
+
+/** Iterates over the blob references in a database. Like a \ref ResultSet, it starts before
+    the first reference. Documents are read one at a time, so nothing needs releasing. */
+type BlobIterator struct {
+	db *Database
+	ids []string
+	pending []BlobRef
+	current BlobRef
+}
+
+/** Returns an iterator over every blob reference in every document, in document ID order.
+    A blob stored in several places is returned once for each. */
+func (db *Database) Blobs() (*BlobIterator, error) {
+	ids, err := db.documentIDs()
+	if err != nil {
+		return nil, err
+	}
+	return &BlobIterator{db: db, ids: ids}, nil
+}
+
+/** Moves to the next blob reference. Returns false at the end. */
+func (it *BlobIterator) Next() bool {
+	for len(it.pending) == 0 {
+		if len(it.ids) == 0 {
+			return false
+		}
+		id := it.ids[0]
+		it.ids = it.ids[1:]
+		c_id := C.CString(id)
+		c_doc := C.CBLDatabase_GetDocument(it.db.db, c_id)
+		C.free(unsafe.Pointer(c_id))
+		if c_doc == nil {
+			// Purged or expired since the IDs were read.
+			continue
+		}
+		it.pending = documentBlobRefs(id, C.CBLDocument_Properties(c_doc))
+		C.CBLDocument_Release(c_doc)
+	}
+	it.current = it.pending[0]
+	it.pending = it.pending[1:]
+	return true
+}
+
+/** Returns the current blob reference. */
+func (it *BlobIterator) Ref() BlobRef {
+	return it.current
+}
+
+/** Blob usage of a database. */
+type BlobStats struct {
+	Count int ///< Distinct blobs referenced by documents
+	TotalSize uint64 ///< Total length of the distinct blobs, in bytes
+	References int ///< Blob references, counting a blob once per place it's stored
+	DiskSize int64 ///< Size of all blob files, including unreferenced ones
+	UnreferencedCount int ///< Blob files no document refers to
+	UnreferencedSize int64 ///< Space \ref Database.Compact would free by deleting them
+}
+
+/** Returns the database's blob usage. */
+func (db *Database) BlobStats() (BlobStats, error) {
+	var stats BlobStats
+	digests, err := db.referencedDigests(&stats)
+	if err != nil {
+		return stats, err
+	}
+	files, err := db.blobFiles()
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		stats.DiskSize += file.Size
+		if !digests[file.Digest] {
+			stats.UnreferencedCount++
+			stats.UnreferencedSize += file.Size
+		}
+	}
+	return stats, nil
+}
+
+/** Returns the blob files that no document refers to. These are deleted by the next
+    \ref Database.Compact. */
+func (db *Database) UnreferencedBlobs() ([]BlobFile, error) {
+	digests, err := db.referencedDigests(nil)
+	if err != nil {
+		return nil, err
+	}
+	files, err := db.blobFiles()
+	if err != nil {
+		return nil, err
+	}
+	var unreferenced []BlobFile
+	for _, file := range files {
+		if !digests[file.Digest] {
+			unreferenced = append(unreferenced, file)
+		}
+	}
+	return unreferenced, nil
+}
+
+// Returns the set of digests referenced by documents, adding their counts to stats if given.
+func (db *Database) referencedDigests(stats *BlobStats) (map[string]bool, error) {
+	it, err := db.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]bool)
+	for it.Next() {
+		ref := it.Ref()
+		if stats != nil {
+			stats.References++
+			if !digests[ref.Digest] {
+				stats.Count++
+				stats.TotalSize += ref.Length
+			}
+		}
+		digests[ref.Digest] = true
+	}
+	return digests, nil
+}
+
+// The attachment store names each file after the base64 of its SHA-1, with '/' replaced by
+// '_', and the digest property is the same base64 prefixed with "sha1-".
+func blobFileDigest(name string) string {
+	return "sha1-" + strings.Replace(strings.TrimSuffix(name, ".blob"), "_", "/", -1)
+}
+
+func (db *Database) blobFilePath(digest string) string {
+	name := strings.Replace(strings.TrimPrefix(digest, "sha1-"), "/", "_", -1) + ".blob"
+	return filepath.Join(db.Path(), "Attachments", name)
+}
+
+// Lists the files in the database's attachment directory, sorted by path.
+func (db *Database) blobFiles() ([]BlobFile, error) {
+	paths, err := filepath.Glob(filepath.Join(db.Path(), "Attachments", "*.blob"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	files := make([]BlobFile, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		files = append(files, BlobFile{path, blobFileDigest(filepath.Base(path)), info.Size()})
+	}
+	return files, nil
+}
+
+/** @} */
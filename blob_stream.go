@@ -0,0 +1,273 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "include/CouchbaseLite.h"
+*/
+import "C"
+import "fmt"
+import "io"
+import "runtime"
+import "unsafe"
+
+/** \defgroup blob_streams   Blob Streams
+    @{
+    io.Reader and io.Writer implementations of the blob streams, so that blob content can be
+    moved with io.Copy and friends:
+
+        w, err := db.CreateBlob("image/jpeg")
+        if _, err = io.Copy(w, file); err != nil {
+            w.Close() // abandons the blob
+            return err
+        }
+        blob, err := w.Blob()
+
+    Data is copied directly between the C stream and the caller's buffer.
+ */
+
+// Reads from a C stream into dst. Returns 0 at EOF.
+func readBlobStream(rs *C.CBLBlobReadStream, dst []byte) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
+	defer C.free(unsafe.Pointer(err))
+	bytesRead := C.CBLBlobReader_Read(rs, unsafe.Pointer(&dst[0]), C.size_t(len(dst)), err)
+	if bytesRead < 0 || (*err).code != 0 {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Reading Blob. Domain: %d Code: %d", (*err).domain, (*err).code)
+		return 0, ErrCBLInternalError
+	}
+	CurrentMetrics().add("cbl_blob_read_bytes_total", float64(bytesRead))
+	return int(bytesRead), nil
+}
+
+// Writes all of data to a C stream.
+func writeBlobStream(wrs *C.CBLBlobWriteStream, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
+	defer C.free(unsafe.Pointer(err))
+	if !bool(C.CBLBlobWriter_Write(wrs, unsafe.Pointer(&data[0]), C.size_t(len(data)), err)) || (*err).code != 0 {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Writing Blob. Domain: %d Code: %d", (*err).domain, (*err).code)
+		return ErrCBLInternalError
+	}
+	CurrentMetrics().add("cbl_blob_written_bytes_total", float64(len(data)))
+	return nil
+}
+
+/** Reads a blob's content. Implements io.ReadSeeker and io.Closer.
+
+    The core can only read streams from the start, so seeking backwards re-opens the stream
+    and seeking forwards skips data. Seeks take effect lazily on the next Read, so seeking to
+    the end to find the length (as http.ServeContent does) costs nothing. */
+type BlobReader struct {
+	blob *Blob
+	rs *C.CBLBlobReadStream
+	pos int64 // position of rs
+	offset int64 // position the next Read starts at
+}
+
+func openBlobStream(blob *Blob) (*C.CBLBlobReadStream, error) {
+	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
+	defer C.free(unsafe.Pointer(err))
+	c_rs := C.CBLBlob_OpenContentStream(blob.blob, err)
+	if c_rs == nil || (*err).code != 0 {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Opening Blob. Domain: %d Code: %d", (*err).domain, (*err).code)
+		return nil, ErrCBLInternalError
+	}
+	return c_rs, nil
+}
+
+/** Opens the blob's content for reading. Read returns io.EOF at the end of the content.
+    Close the reader when done; the blob must stay open until then. */
+func (blob *Blob) Open() (io.ReadCloser, error) {
+	return blob.OpenReader()
+}
+
+/** Same as \ref Blob.Open, but returns the seekable reader. */
+func (blob *Blob) OpenReader() (*BlobReader, error) {
+	c_rs, err := openBlobStream(blob)
+	if err != nil {
+		return nil, err
+	}
+	r := &BlobReader{blob: blob, rs: c_rs}
+	trackObject(unsafe.Pointer(c_rs), "BlobReader", blob.Digest())
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(r, (*BlobReader).finalize)
+	}
+	return r, nil
+}
+
+/** Reads up to len(p) bytes into p. Returns io.EOF at the end of the content. */
+func (r *BlobReader) Read(p []byte) (int, error) {
+	if r.rs == nil {
+		return 0, ErrBlobStreamClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := r.catchUp(); err != nil {
+		return 0, err
+	}
+	n, err := readBlobStream(r.rs, p)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	r.pos += int64(n)
+	r.offset = r.pos
+	return n, nil
+}
+
+// Moves the stream to the offset set by Seek.
+func (r *BlobReader) catchUp() error {
+	if r.offset < r.pos {
+		c_rs, err := openBlobStream(r.blob)
+		if err != nil {
+			return err
+		}
+		retrackObject(unsafe.Pointer(r.rs), unsafe.Pointer(c_rs))
+		C.CBLBlobReader_Close(r.rs)
+		r.rs = c_rs
+		r.pos = 0
+	}
+	if r.offset > r.pos {
+		var buf []byte
+		if skip := r.offset - r.pos; skip < blobChunkSize {
+			buf = make([]byte, skip)
+		} else {
+			buf = make([]byte, blobChunkSize)
+		}
+		for r.pos < r.offset {
+			chunk := buf
+			if remaining := r.offset - r.pos; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			n, err := readBlobStream(r.rs, chunk)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				// Past the end; Read will report EOF.
+				r.offset = r.pos
+				break
+			}
+			r.pos += int64(n)
+		}
+	}
+	return nil
+}
+
+/** Sets the offset of the next Read, relative to the start (io.SeekStart), the current
+    offset (io.SeekCurrent) or the end of the content (io.SeekEnd). */
+func (r *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	if r.rs == nil {
+		return 0, ErrBlobStreamClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(r.blob.Length())
+	default:
+		return 0, ErrInvalidArguments
+	}
+	if offset < 0 {
+		return 0, ErrInvalidArguments
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+/** Closes the stream. Calling it more than once is harmless. */
+func (r *BlobReader) Close() error {
+	if r.rs == nil {
+		return nil
+	}
+	untrackObject(unsafe.Pointer(r.rs))
+	C.CBLBlobReader_Close(r.rs)
+	r.rs = nil
+	runtime.SetFinalizer(r, nil)
+	return nil
+}
+
+func (r *BlobReader) finalize() {
+	reportLeak(unsafe.Pointer(r.rs))
+	r.Close()
+}
+
+/** Writes a new blob to a database. Write the content, then call Blob to create the blob.
+    Closing the writer before calling Blob abandons the content; after Blob, Close does
+    nothing, so it's safe to defer. */
+type BlobWriter interface {
+	io.WriteCloser
+	/** Finishes writing and returns the new blob, which you must close once the document
+	    it's stored in has been saved. The writer can't be used afterwards. */
+	Blob() (*Blob, error)
+}
+
+type blobWriter struct {
+	wrs *C.CBLBlobWriteStream
+	contentType string
+}
+
+/** Starts writing a new blob with the given MIME type (optional) to the database. */
+func (db *Database) CreateBlob(contentType string) (BlobWriter, error) {
+	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
+	defer C.free(unsafe.Pointer(err))
+	c_wrs := C.CBLBlobWriter_New(db.db, err)
+	if c_wrs == nil || (*err).code != 0 {
+		ErrCBLInternalError = fmt.Errorf("CBL: Error Creating New Blob Writer. Domain: %d Code: %d", (*err).domain, (*err).code)
+		return nil, ErrCBLInternalError
+	}
+	w := &blobWriter{c_wrs, contentType}
+	trackObject(unsafe.Pointer(c_wrs), "BlobWriter", contentType)
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(w, (*blobWriter).finalize)
+	}
+	return w, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.wrs == nil {
+		return 0, ErrBlobStreamClosed
+	}
+	if err := writeBlobStream(w.wrs, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *blobWriter) Close() error {
+	if w.wrs == nil {
+		return nil
+	}
+	untrackObject(unsafe.Pointer(w.wrs))
+	C.CBLBlobWriter_Close(w.wrs)
+	w.wrs = nil
+	runtime.SetFinalizer(w, nil)
+	return nil
+}
+
+func (w *blobWriter) Blob() (*Blob, error) {
+	if w.wrs == nil {
+		return nil, ErrBlobStreamClosed
+	}
+	// The blob takes over the stream.
+	untrackObject(unsafe.Pointer(w.wrs))
+	runtime.SetFinalizer(w, nil)
+	wrs := w.wrs
+	w.wrs = nil
+	return CreateBlobWithStream(w.contentType, &BlobWriteStream{wrs})
+}
+
+func (w *blobWriter) finalize() {
+	reportLeak(unsafe.Pointer(w.wrs))
+	w.Close()
+}
+
+/** @} */
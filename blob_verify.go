@@ -0,0 +1,179 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "include/CouchbaseLite.h"
+*/
+import "C"
+import "context"
+import "crypto/sha1"
+import "encoding/base64"
+import "hash"
+import "io"
+import "os"
+import "unsafe"
+
+/** \defgroup blob_verify   Blob Verification and Deduplication
+    @{
+ */
+
+/** A blob reference whose content is missing or damaged. */
+type BlobProblem struct {
+	Ref BlobRef
+	Err error ///< \ref ErrBlobMissing, \ref ErrBlobCorrupt, or the error reading the content
+}
+
+// Returns the digest property value for a SHA-1 hash.
+func blobDigest(h hash.Hash) string {
+	return "sha1-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+/** Re-reads the content of every blob referenced by a document and checks it against the
+    blob's digest and length. Returns a problem for each reference to a missing or damaged
+    blob; each distinct blob is only read once. Stops with ctx.Err(), and the problems found
+    so far, once ctx is done. */
+func (db *Database) VerifyBlobs(ctx context.Context) ([]BlobProblem, error) {
+	ids, err := db.documentIDs()
+	if err != nil {
+		return nil, err
+	}
+	var problems []BlobProblem
+	checked := make(map[string]error)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return problems, err
+		}
+		c_id := C.CString(id)
+		c_doc := C.CBLDatabase_GetDocument(db.db, c_id)
+		C.free(unsafe.Pointer(c_id))
+		if c_doc == nil {
+			continue
+		}
+		walkDocumentBlobs(id, C.CBLDocument_Properties(c_doc), func(ref BlobRef, blob *C.CBLBlob) bool {
+			verr, ok := checked[ref.Digest]
+			if !ok {
+				verr = db.verifyBlob(ctx, ref, blob)
+				if verr == ctx.Err() && verr != nil {
+					err = verr
+					return false
+				}
+				checked[ref.Digest] = verr
+			}
+			if verr != nil {
+				problems = append(problems, BlobProblem{ref, verr})
+			}
+			return true
+		})
+		C.CBLDocument_Release(c_doc)
+		if err != nil {
+			return problems, err
+		}
+	}
+	return problems, nil
+}
+
+func (db *Database) verifyBlob(ctx context.Context, ref BlobRef, blob *C.CBLBlob) error {
+	if _, err := os.Stat(db.blobFilePath(ref.Digest)); os.IsNotExist(err) {
+		return ErrBlobMissing
+	}
+	c_rs, err := openBlobStream(&Blob{blob: blob})
+	if err != nil {
+		return err
+	}
+	defer C.CBLBlobReader_Close(c_rs)
+
+	h := sha1.New()
+	var length uint64
+	buf := make([]byte, blobChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := readBlobStream(c_rs, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		h.Write(buf[:n])
+		length += uint64(n)
+	}
+	if blobDigest(h) != ref.Digest || length != ref.Length {
+		return ErrBlobCorrupt
+	}
+	return nil
+}
+
+// Returns an owned blob with the given digest, found in a document, or nil.
+func (db *Database) findBlob(digest string) *Blob {
+	ids, err := db.documentIDs()
+	if err != nil {
+		return nil
+	}
+	for _, id := range ids {
+		c_id := C.CString(id)
+		c_doc := C.CBLDatabase_GetDocument(db.db, c_id)
+		C.free(unsafe.Pointer(c_id))
+		if c_doc == nil {
+			continue
+		}
+		var found *C.CBLBlob
+		walkDocumentBlobs(id, C.CBLDocument_Properties(c_doc), func(ref BlobRef, blob *C.CBLBlob) bool {
+			if ref.Digest == digest {
+				found = blob
+			}
+			return found == nil
+		})
+		if found != nil {
+			if props, err := getKeyValuePropMap(getBlobPoperties(found)); err == nil {
+				// The blob belongs to the document, so the blob keeps the document open.
+				blob := Blob{blob: found, Props: props, owned: true, doc: c_doc}
+				trackBlob(&blob)
+				return &blob
+			}
+		}
+		C.CBLDocument_Release(c_doc)
+	}
+	return nil
+}
+
+/** Creates a blob from a file, streaming its content into the database. If a document already
+    references a stored blob with the same content, that blob is returned instead and nothing
+    is written; it keeps its own content type. Finding it reads every document, so prefer
+    \ref Database.CreateBlob when duplicates are unlikely.
+    @note  You are responsible for closing the blob, but not until after its document has been
+           saved. */
+func (db *Database) NewBlobFromFile(path, contentType string) (*Blob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	digest := blobDigest(h)
+	if _, err := os.Stat(db.blobFilePath(digest)); err == nil {
+		if blob := db.findBlob(digest); blob != nil {
+			return blob, nil
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	w, err := db.CreateBlob(contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	return w.Blob()
+}
+
+/** @} */
@@ -21,13 +21,13 @@ FLValue FLArray_AsValue(FLArray);
 FLValue FLDict_AsValue(FLDict);
 bool is_Null(void *);
 void SetProxyType(CBLProxySettings * proxy, CBLProxyType);
-void Set_Null(void *);
 
 */
 import "C"
 import "unsafe"
 import "context"
-import "reflect"
+
+import "github.com/svr4/couchbase-lite-cgo/fleece"
 
 //export databaseListenerBridge
 func databaseListenerBridge(c unsafe.Pointer, db *C.CBLDatabase, numDocs C.unsigned, docIDs **C.char) {
@@ -100,7 +100,7 @@ func notificationBridge(c unsafe.Pointer, db *C.CBLDatabase) {
 //export queryListenerBride
 func queryListenerBride(c unsafe.Pointer, query *C.CBLQuery) {
 	props, _ := getKeyValuePropMap((C.FLDict)(c))
-	q := Query{query}
+	q := Query{q: query}
 	ctx := context.Background()
 	for k, v := range props {
 		ctx = context.WithValue(ctx, k, v)
@@ -146,12 +146,16 @@ func pullFilterBridge(c unsafe.Pointer, doc *C.CBLDocument, isDeleted C.bool) C.
 //export replicatorChangeBridge
 func replicatorChangeBridge(c unsafe.Pointer, replicator *C.CBLReplicator, status *C.CBLReplicatorStatus) {
 	props, _ := getKeyValuePropMap((C.FLDict)(c))
-	rep := Replicator{replicator}
+	name, _ := props[replicatorNameKey].(string)
+	rep := Replicator{rep: replicator, name: name}
 
 	e := Error{uint32(status.error.internal_info), uint32(status.error.code), uint32(status.error.domain)}
 	activity := ReplicatorActivityLevel(status.activity)
 	progress := ReplicatorProgress{float32(status.progress.fractionComplete), uint64(status.progress.documentCount)}
 	repStatus := ReplicatorStatus{activity, progress, e}
+	if m := CurrentMetrics(); m != nil {
+		m.ObserveReplicatorStatus(name, repStatus)
+	}
 
 	ctx := context.Background()
 	for k, v := range props {
@@ -168,7 +172,7 @@ func replicatorChangeBridge(c unsafe.Pointer, replicator *C.CBLReplicator, statu
 func replicatedDocumentBridge(c unsafe.Pointer, replicator *C.CBLReplicator, isPush C.bool,
 								numDocument C.unsigned, documents *C.CBLReplicatedDocument) {
 	props, _ := getKeyValuePropMap((C.FLDict)(c))
-	rep := Replicator{replicator}
+	rep := Replicator{rep: replicator}
 
 	e := Error{uint32(documents.error.internal_info), uint32(documents.error.code), uint32(documents.error.domain)}
 	id := C.GoString(documents.ID)
@@ -213,206 +217,62 @@ func conflictResolverBridge(c unsafe.Pointer, documentID *C.char, localDocument
 }
 
 func getFLValueToGoValue(fl_val C.FLValue) (interface{}, error) {
-	var val interface{}
-	switch C.FLValue_GetType(fl_val) {
-		///< Type of a NULL pointer, i.e. no such value, like JSON `undefined`. Also the type of a value created by FLEncoder_WriteUndefined().
-		case C.kFLUndefined:
-		///< Equivalent to a JSON 'null'
-		case C.kFLNull:
-			val = nil
-			return val, nil
-		case C.kFLBoolean:
-			val = bool(C.FLValue_AsBool(fl_val))
-			return val, nil
-		///< A numeric value, either integer or floating-point
-		case C.kFLNumber:
-			if C.FLValue_IsInteger(fl_val) {
-				val = int64(C.FLValue_AsInt(fl_val))
-			} else if C.FLValue_IsUnsigned(fl_val) {
-				val = uint64(C.FLValue_AsUnsigned(fl_val))
-			} else if C.FLValue_IsDouble(fl_val) {
-				val = float64(C.FLValue_AsDouble(fl_val))
-			} else {
-				val = float32(C.FLValue_AsFloat(fl_val))
-			}
-			return val, nil
-		case C.kFLString:
-			fl_str := C.FLValue_AsString(fl_val)
-			val = C.GoStringN((*C.char)(fl_str.buf), C.int(fl_str.size))
-			return val, nil
-		case C.kFLData:
-			fl_data_slice := C.FLValue_AsData(fl_val)
-			val = C.GoBytes(fl_data_slice.buf, C.int(fl_data_slice.size))
-			//val = FunctionPointer{unsafe.Pointer(fl_data_slice.buf)}
-			return val, nil
-		case C.kFLArray:
-			// This could be a homogenous array or a hetero one.
-			// Return the bytes and let the developer decide.
-			// Hetero arrays can be processed by converting []byte to []interface{}
-			fl_array, err := C.FLValue_AsArray(fl_val)
-			if err == nil {
-				is_empty := bool(C.FLArray_IsEmpty(fl_array))
-				if !is_empty {
-					val = C.GoBytes(unsafe.Pointer(fl_array), C.int(C.FLArray_Count(fl_array)))
-				} else {
-					val = nil
-				}
-			}
-			return val, nil
-		case C.kFLDict:
-			// Determine if dictionary is a Blob
-			if isBlob(C.FLValue_AsDict(fl_val)) {
-				if blob, err := getBlob(C.FLValue_AsDict(fl_val)); err == nil {
-					return blob, nil
-				}
-				return nil, ErrProblemGettingBlobWithData
-			}
-			// Deep iterate over the value which is a map
-			iter := C.FLDeepIterator_New(fl_val)
-			var value C.FLValue
-
-			props := make(map[string]interface{})
-
-			for value = C.FLDeepIterator_GetValue(iter); value != nil; value = C.FLDeepIterator_GetValue(iter) {
-				// FLString
-				key := C.FLDeepIterator_GetKey(iter)
-				str_key := C.GoStringN((*C.char)(key.buf), C.int(key.size))
-				
-				i, e := getFLValueToGoValue(value)
-
-				if e == nil {
-					props[str_key] = i
-				}
-
-				C.FLDeepIterator_Next(iter)
-			}
-			C.FLDeepIterator_Free(iter)
-			return props, nil
-		default:
-			return nil, ErrInvalidCBLType
-
-		}
-		return nil, ErrInvalidCBLType
+	return propsDecoder().Decode(fleece.ValueFromC(unsafe.Pointer(fl_val))), nil
 }
 
-func storeGoValueInSlot(fl_slot C.FLSlot, v interface{}) error {
+// Decodes document properties and query results. Integers stay int64 (or uint64), as Props
+// has always had them, and blob references become *Blob.
+func propsDecoder() fleece.Decoder {
+	return fleece.Decoder{UseInt64: true, ConvertDict: blobConverter}
+}
 
-	switch val := reflect.TypeOf(v); val.Kind() {
-	case reflect.String:
-		value := v.(string)
-		s := C.CString(value)
-		// Create a key in the dict. Returns an FLSlot, and set the slot with the value
-		C.FLSlot_SetString(fl_slot, C.FLStr(s))
-		C.free(unsafe.Pointer(s))
-		break
-	case reflect.Array:
-		return ErrUnsupportedGoType
-	case reflect.Slice:
-	//case []byte:
-		// We have to iterate through the array.
-		mutable_array := C.FLMutableArray_New()
-		v_arr := v.([]interface{})
-		for i:=0; i < len(v_arr); i++ {
-			v_slot := C.FLMutableArray_Append(mutable_array)
-			storeGoValueInSlot(v_slot, v_arr[i]);
-		}
-		fl_arr := C.FLMutableArray_GetSource(mutable_array)
-		C.FLSlot_SetValue(fl_slot, C.FLArray_AsValue(fl_arr))
-		// C.FLArray_Release(fl_arr)
-		// C.FLMutableArray_Release(mutable_array)
-		break
-	case reflect.Int:
-		value := v.(int)
-		C.FLSlot_SetInt(fl_slot, C.int64_t(value))
-		break
-	case reflect.Int8:
-		value := v.(int8)
-		C.FLSlot_SetInt(fl_slot, C.int64_t(value))
-		break
-	case reflect.Int16:
-		value := v.(int16)
-		C.FLSlot_SetInt(fl_slot, C.int64_t(value))
-		break
-	case reflect.Int32:
-		value := v.(int32)
-		C.FLSlot_SetInt(fl_slot, C.int64_t(value))
-		break
-	case reflect.Int64:
-		value := v.(int64)
-		C.FLSlot_SetInt(fl_slot, C.int64_t(value))
-		break
-	case reflect.Uint:
-		value := v.(uint)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Uintptr:
-		value := v.(uintptr)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Uint8:
-		value := v.(uint8)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Uint16:
-		value := v.(uint16)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Uint32:
-		value := v.(uint32)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Uint64:
-		value := v.(uint64)
-		C.FLSlot_SetUInt(fl_slot, C.uint64_t(value))
-		break
-	case reflect.Float32:
-		value := v.(float32)
-		C.FLSlot_SetFloat(fl_slot, C.float(value))
-		break
-	case reflect.Float64:
-		value := v.(float64)
-		C.FLSlot_SetDouble(fl_slot, C.double(value))
-		// double
-		break;
-	case reflect.Bool:
-		value := v.(bool)
-		C.FLSlot_SetBool(fl_slot, C.bool(value))
-		break
-	case reflect.Map:
-		switch v.(type) {
-		case map[string]interface{}:
-			v_map := v.(map[string]interface{})
-			mutable_dict := C.FLMutableDict_New()
+// Returns a sequence or count decoded from a property or result, or 0.
+func uint64Value(value interface{}) uint64 {
+	switch value := value.(type) {
+	case int64:
+		return uint64(value)
+	case uint64:
+		return value
+	}
+	return 0
+}
 
-			for key, val := range v_map {
-				c_key := C.CString(key)
-				v_slot := C.FLMutableDict_Set(mutable_dict, C.FLStr(c_key))
-				storeGoValueInSlot(v_slot, val)
-				C.free(unsafe.Pointer(c_key))
-			}
+// Returns a flag decoded from a property or result, which queries may return as 0 or 1.
+func boolValue(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case int64:
+		return value != 0
+	}
+	return false
+}
 
-			fl_dict := C.FLMutableDict_GetSource(mutable_dict)
-			C.FLSlot_SetValue(fl_slot, C.FLDict_AsValue(fl_dict))
-			// C.FLDict_Release(fl_dict)
-			// C.FLMutableDict_Release(mutable_dict)
-			break
-		default:
-			return ErrUnsupportedGoType
-		}
-	default:
-		return ErrUnsupportedGoType
+// Converts blob references found in documents and results to *Blob.
+func blobConverter(d fleece.Dict) (interface{}, bool) {
+	fl_dict := C.FLDict(d.CPointer())
+	if !isBlob(fl_dict) {
+		return nil, false
+	}
+	if blob, err := getBlob(fl_dict); err == nil {
+		return blob, true
 	}
-	return nil
+	return nil, false
 }
 
 func storeContextInMutableDict(ctx context.Context, keys []string) C.FLMutableDict {
-	mutableDict := C.FLMutableDict_New()
+	mutableDict := fleece.NewMutableDict()
 
 	for i:=0; i < len(keys); i++ {
-		c_key := C.CString(keys[i])
-		fl_slot := C.FLMutableDict_Set(mutableDict, C.FLStr(c_key))
-		storeGoValueInSlot(fl_slot, ctx.Value(keys[i]))
+		mutableDict.SetInterface(keys[i], ctx.Value(keys[i]))
 	}
 
-	return mutableDict
-}
\ No newline at end of file
+	return C.FLMutableDict(mutableDict.CPointer())
+}
+
+//export logBridge
+func logBridge(level C.CBLLogLevel, domain C.CBLLogDomain, message *C.char) {
+	if callback := GetLogCallback(); callback != nil {
+		callback(LogLevel(level), LogDomain(domain), C.GoString(message))
+	}
+}
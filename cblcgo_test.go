@@ -6,6 +6,28 @@ import "testing"
 import "fmt"
 import "context"
 import "time"
+import "bytes"
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/json"
+import "errors"
+import "math"
+import "math/big"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "runtime"
+import "sort"
+import "strconv"
+import "strings"
+import "testing/quick"
+
+import "github.com/svr4/couchbase-lite-cgo/fleece"
 
 func TestConnection(t *testing.T) {
 	var config DatabaseConfiguration
@@ -31,7 +53,7 @@ func TestConnection(t *testing.T) {
 			t.Error("Can't delete database.")
 		}
 	
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 	} else {
@@ -126,7 +148,7 @@ func TestSaveAndDeleteDocuments(t *testing.T) {
 			}
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -170,7 +192,7 @@ func TestSaveAndRetrieveDocuments(t *testing.T) {
 			t.Error(err)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -219,7 +241,7 @@ func TestProperties(t *testing.T) {
 			t.Error("Couldn't set the properties with new map.")
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 		
@@ -267,7 +289,7 @@ func TestDocumentListener(t *testing.T) {
 			t.Error(err)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -346,7 +368,7 @@ func TestQuery(t *testing.T) {
 			t.Error("Couldn't Create Index.")
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -423,7 +445,7 @@ func TestBlob(t *testing.T) {
 			t.Error(berr)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -484,7 +506,7 @@ func TestListeners(t *testing.T) {
 			t.Error(dberr)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -541,7 +563,7 @@ func TestNotificationCallback(t *testing.T) {
 			t.Error(err)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -549,3 +571,1969 @@ func TestNotificationCallback(t *testing.T) {
 		t.Error(db_err)
 	}
 }
+
+func TestLiveObjects(t *testing.T) {
+	var config DatabaseConfiguration
+
+	var encryption_key EncryptionKey
+	encryption_key.Algorithm = EncryptionNone
+	encryption_key.Bytes = make([]byte, 0)
+
+	config.Directory = "./db"
+	config.EncryptionKey = encryption_key
+	config.Flags = Database_Create
+
+	before := len(LiveObjects())
+
+	if db, db_err := Open("my_db_live", &config); db_err == nil {
+		doc := NewDocumentWithId("live")
+		query, err := db.NewQuery(N1QLLanguage, "SELECT name")
+		if err != nil {
+			t.Error(err)
+		}
+
+		live := LiveObjects()
+		if len(live) != before+3 {
+			t.Errorf("Expected %d live objects, got %d: %v", before+3, len(live), live)
+		}
+		if last := live[len(live)-1]; last.Kind != "Query" || last.Description != "SELECT name" {
+			t.Errorf("Unexpected live object %v", last)
+		}
+
+		// Close is idempotent.
+		for i := 0; i < 2; i++ {
+			if err := doc.Close(); err != nil {
+				t.Error(err)
+			}
+			if err := query.Close(); err != nil {
+				t.Error(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Error("Couldn't close the database.")
+			}
+		}
+
+		if after := len(LiveObjects()); after != before {
+			t.Errorf("Expected %d live objects after closing, got %d", before, after)
+		}
+	} else {
+		t.Error(db_err)
+	}
+}
+
+// Returns the resident set size of the process, or 0 where /proc isn't available.
+func residentMemory() uint64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	var size, resident uint64
+	if _, err := fmt.Sscan(string(data), &size, &resident); err != nil {
+		return 0
+	}
+	return resident * uint64(os.Getpagesize())
+}
+
+func TestMemoryGrowth(t *testing.T) {
+	var config DatabaseConfiguration
+
+	var encryption_key EncryptionKey
+	encryption_key.Algorithm = EncryptionNone
+	encryption_key.Bytes = make([]byte, 0)
+
+	config.Directory = "./db"
+	config.EncryptionKey = encryption_key
+	config.Flags = Database_Create
+
+	const iterations = 5000
+	const maxGrowth = 16 << 20
+
+	db, db_err := Open("my_db_memory", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	key, kerr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "memory.example.org"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(24 * time.Hour),
+	}
+	der, cerr := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	// Left over by an interrupted run.
+	DeleteDatabase("my_db_memory_copy", "./db")
+
+	exercise := func() {
+		doc := NewDocumentWithId("memory")
+		doc.Props["name"] = "Marcel"
+		doc.Props["tags"] = []interface{}{"a", "b"}
+		doc.Props["address"] = map[string]interface{}{"city": "San Juan"}
+		if _, err := db.Save(doc, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		doc.ToJSONString()
+		doc.Close()
+
+		if saved, err := db.GetMutableDocument("memory"); err == nil {
+			saved.SetPropertiesAsJSON("{\"name\": \"Rivera\"}")
+			saved.Close()
+		}
+		db.SetDocumentExpiration("memory", 0)
+		db.GetDocumentExpiration("memory")
+
+		if query, err := db.NewQuery(N1QLLanguage, "SELECT name WHERE name = $name"); err == nil {
+			query.SetParameters(map[string]interface{}{"name": "Rivera"})
+			if rs, err := query.Execute(); err == nil {
+				for rs.Next() {
+					rs.ValueForKey("name")
+				}
+				rs.Release()
+			}
+			query.Close()
+		}
+
+		db.CreateIndex("memory_idx", IndexSpec{ValueIndex, "[[\".name\"]]", false, ""})
+		db.IndexNames()
+		db.DeleteIndex("memory_idx")
+
+		if blob, err := NewBlobWithData("text/plain", []byte("memory")); err == nil {
+			blob.Digest()
+			blob.ContentType()
+			blob.Close()
+		}
+
+		DatabaseExists("my_db_memory", "./db")
+		NewEndpointWithURL("ws://localhost:4984/db").Free()
+		NewBasicAuthentication("user", "password").Free()
+
+		// Created and closed without starting, so no server is needed.
+		endpoint := NewEndpointWithURL("wss://localhost:4984/db")
+		auth := NewBasicAuthentication("user", "password")
+		if rep, err := NewReplicator(ReplicatorConfiguration{
+			Db: db,
+			Endpt: endpoint,
+			Auth: auth,
+			Proxy: NewProxySettings(ProxyHTTP, "proxy.example.org", 3128, "user", "password"),
+			PinnedCertificate: cert,
+			Headers: map[string]interface{}{"X-Memory": "test"},
+			Channels: []string{"a", "b"},
+			DocumentIds: []string{"memory"},
+		}); err == nil {
+			rep.Close()
+		} else {
+			t.Fatal(err)
+		}
+		auth.Free()
+		endpoint.Free()
+
+		if !CopyDatabase(db.Path(), "my_db_memory_copy", &config) {
+			t.Fatal("Couldn't copy the database.")
+		}
+		if other, err := Open("my_db_memory_copy", &config); err == nil {
+			other.Close()
+		} else {
+			t.Fatal(err)
+		}
+		DeleteDatabase("my_db_memory_copy", "./db")
+	}
+
+	// Warm up caches and allocator arenas before taking the baseline.
+	for i := 0; i < 100; i++ {
+		exercise()
+	}
+	runtime.GC()
+	instances := InstanceCount()
+	live := len(LiveObjects())
+	before := residentMemory()
+
+	for i := 0; i < iterations; i++ {
+		exercise()
+	}
+
+	runtime.GC()
+	if count := InstanceCount(); count > instances {
+		t.Errorf("Instance count grew from %d to %d", instances, count)
+	}
+	if count := len(LiveObjects()); count != live {
+		t.Errorf("Live objects grew from %d to %d", live, count)
+	}
+	if after := residentMemory(); before > 0 && after > before+maxGrowth {
+		t.Errorf("Resident memory grew by %d bytes over %d iterations", after-before, iterations)
+	}
+}
+
+type testSugaredLogger struct {
+	lines []string
+}
+
+func (l *testSugaredLogger) log(level, msg string, keysAndValues []interface{}) {
+	l.lines = append(l.lines, fmt.Sprint(level, " ", msg, " ", keysAndValues))
+}
+func (l *testSugaredLogger) Debugw(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *testSugaredLogger) Infow(msg string, kv ...interface{}) { l.log("info", msg, kv) }
+func (l *testSugaredLogger) Warnw(msg string, kv ...interface{}) { l.log("warn", msg, kv) }
+func (l *testSugaredLogger) Errorw(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func TestLogCallback(t *testing.T) {
+	previous := ConsoleLevel()
+	SetConsoleLevel(LogWarning)
+	if level := ConsoleLevel(); level != LogWarning {
+		t.Errorf("Console level is %s, expected warning", level)
+	}
+	SetConsoleLevel(previous)
+
+	messages := make(chan string, 100)
+	SetLogCallback(func(level LogLevel, domain LogDomain, message string) {
+		select {
+		case messages <- fmt.Sprintf("%s %s: %s", level, domain, message):
+		default:
+		}
+	})
+	if GetLogCallback() == nil {
+		t.Error("Log callback wasn't set.")
+	}
+	SetLogLevel(LogVerbose, LogDomainAll)
+
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+	if db, err := Open("my_db_log", &config); err == nil {
+		db.Close()
+	} else {
+		t.Error(err)
+	}
+
+	select {
+	case <-messages:
+	case <-time.After(5 * time.Second):
+		t.Error("No log messages were received.")
+	}
+	SetLogCallback(nil)
+	SetLogLevel(LogWarning, LogDomainAll)
+	if GetLogCallback() != nil {
+		t.Error("Log callback wasn't removed.")
+	}
+
+	logger := &testSugaredLogger{}
+	callback := NewSugaredLogCallback(logger)
+	callback(LogVerbose, LogDomainQuery, "compiled")
+	callback(LogError, LogDomainNetwork, "refused")
+	if len(logger.lines) != 2 || logger.lines[0] != "debug compiled [domain query]" || logger.lines[1] != "error refused [domain network]" {
+		t.Errorf("Unexpected adapter output %q", logger.lines)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	metrics := NewMetrics()
+	EnableMetrics(metrics)
+	defer EnableMetrics(nil)
+
+	if db, db_err := Open("my_db_metrics", &config); db_err == nil {
+		db.BeginBatch()
+		for i := 0; i < 3; i++ {
+			doc := NewDocumentWithId(fmt.Sprintf("metrics%d", i))
+			doc.Props["name"] = "Marcel"
+			if _, err := db.Save(doc, LastWriteWins); err != nil {
+				t.Error(err)
+			}
+			doc.Close()
+		}
+		db.EndBatch()
+		db.PurgeById("metrics0")
+
+		if query, err := db.NewNamedQuery("byName", N1QLLanguage, "SELECT name WHERE name = 'Marcel'"); err == nil {
+			if rs, err := query.Execute(); err == nil {
+				for rs.Next() {
+				}
+				rs.Release()
+			}
+			query.Close()
+		} else {
+			t.Error(err)
+		}
+		db.Close()
+	} else {
+		t.Error(db_err)
+	}
+
+	snapshot := metrics.Snapshot()
+	if n := snapshot.Counters["cbl_documents_saved_total"]; n != 3 {
+		t.Errorf("Expected 3 saves, got %v", n)
+	}
+	if n := snapshot.Counters["cbl_documents_purged_total"]; n != 1 {
+		t.Errorf("Expected 1 purge, got %v", n)
+	}
+	if n := snapshot.Counters[`cbl_query_rows_total{query="byName"}`]; n != 2 {
+		t.Errorf("Expected 2 rows, got %v", n)
+	}
+	if h := snapshot.Histograms["cbl_batch_duration_seconds"]; h.Count != 1 {
+		t.Errorf("Expected 1 batch, got %d", h.Count)
+	}
+	if h := snapshot.Histograms[`cbl_query_execute_seconds{query="byName"}`]; h.Count != 1 || h.Buckets["+Inf"] != 1 {
+		t.Errorf("Unexpected execute histogram %+v", h)
+	}
+
+	// Replicator metrics are derived from successive statuses.
+	now := time.Unix(0, 0)
+	metrics.now = func() time.Time { return now }
+	failure := Error{0, 1, uint32(ErrorDomainNetwork)}
+	metrics.ObserveReplicatorStatus("sync", ReplicatorStatus{Busy, ReplicatorProgress{0.5, 10}, Error{}})
+	now = now.Add(2 * time.Second)
+	metrics.ObserveReplicatorStatus("sync", ReplicatorStatus{Offline, ReplicatorProgress{1, 15}, failure})
+	now = now.Add(time.Second)
+	metrics.ObserveReplicatorStatus("sync", ReplicatorStatus{Offline, ReplicatorProgress{1, 15}, failure})
+
+	var out bytes.Buffer
+	metrics.WritePrometheus(&out)
+	for _, line := range []string{
+		`cbl_replicator_documents_total{replicator="sync"} 15`,
+		`cbl_replicator_errors_total{replicator="sync"} 1`,
+		`cbl_replicator_activity_seconds_total{replicator="sync",activity="busy"} 2`,
+		`cbl_replicator_activity_seconds_total{replicator="sync",activity="offline"} 1`,
+		"# TYPE cbl_query_execute_seconds histogram",
+		`cbl_query_execute_seconds_bucket{query="byName",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing %q in:\n%s", line, out.String())
+		}
+	}
+
+	if labels := renderLabels("query", "café \"q\"\\\n"); labels != `query="café \"q\"\\\n"` {
+		t.Errorf("Unexpected label escaping %s", labels)
+	}
+}
+
+type testSpan struct {
+	name string
+	attrs map[string]interface{}
+	err error
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+func (s *testSpan) RecordError(err error) { s.err = err }
+func (s *testSpan) End() { s.ended = true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: make(map[string]interface{})}
+	span.SetAttributes(attrs...)
+	tr.spans = append(tr.spans, span)
+	return ctx, span
+}
+
+func TestTracing(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	tracer := &testTracer{}
+	ctx := ContextWithTracer(context.Background(), tracer)
+
+	db, db_err := OpenContext(ctx, "my_db_tracing", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	doc := NewDocumentWithId("traced")
+	doc.Props["name"] = "Marcel"
+	if _, err := db.SaveContext(ctx, doc, FailOnConflict); err != nil {
+		t.Error(err)
+	}
+	doc.Close()
+	if query, err := db.NewQueryContext(ctx, N1QLLanguage, "SELECT name WHERE name = 'Marcel'"); err == nil {
+		if rs, err := query.ExecuteContext(ctx); err == nil {
+			for rs.Next() {
+			}
+			rs.Release()
+		}
+		query.Close()
+	} else {
+		t.Error(err)
+	}
+	// Leave the database empty so the test can run again.
+	db.PurgeById("traced")
+	db.Close()
+
+	// Without a tracer nothing is recorded.
+	if db, err := OpenContext(context.Background(), "my_db_tracing", &config); err == nil {
+		db.Close()
+	}
+
+	expected := []string{"cbl.Open", "cbl.Save", "cbl.NewQuery", "cbl.Execute"}
+	if len(tracer.spans) != len(expected) {
+		t.Fatalf("Expected %d spans, got %d", len(expected), len(tracer.spans))
+	}
+	for i, span := range tracer.spans {
+		if span.name != expected[i] || !span.ended || span.err != nil {
+			t.Errorf("Unexpected span %+v", span)
+		}
+		if span.attrs[AttrDBSystem] != "couchbase-lite" {
+			t.Errorf("Span %s is missing %s", span.name, AttrDBSystem)
+		}
+	}
+	if save := tracer.spans[1]; save.attrs[AttrDocumentID] != "traced" || save.attrs[AttrConcurrency] != "fail_on_conflict" {
+		t.Errorf("Unexpected save attributes %v", save.attrs)
+	}
+	if exec := tracer.spans[3]; exec.attrs[AttrQueryRows] != 1 {
+		t.Errorf("Expected 1 row, got %v", exec.attrs[AttrQueryRows])
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_context", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := db.CompactContext(canceled); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if err := db.CompactContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.PurgeExpiredDocumentsContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := CopyDatabaseContext(canceled, "./db/my_db_context.cblite2", "my_db_context2", &config); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		doc := NewDocumentWithId(fmt.Sprintf("context%d", i))
+		doc.Props["name"] = "Marcel"
+		db.Save(doc, LastWriteWins)
+		doc.Close()
+	}
+	if query, err := db.NewQuery(N1QLLanguage, "SELECT name WHERE name = 'Marcel'"); err == nil {
+		if _, err := query.ExecuteContext(canceled); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		if rs, err := query.ExecuteContext(ctx); err == nil {
+			rows := 0
+			for rs.Next() {
+				rows++
+				stop()
+			}
+			if rows != 1 || rs.Err() != context.Canceled {
+				t.Errorf("Expected iteration to stop after 1 row with context.Canceled, got %d rows and %v", rows, rs.Err())
+			}
+			rs.Release()
+		} else {
+			t.Error(err)
+		}
+		stop()
+		query.Close()
+	} else {
+		t.Error(err)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	if blob, err := NewBlobWithData("text/plain", content); err == nil {
+		var out bytes.Buffer
+		if n, err := blob.WriteToContext(context.Background(), &out); err != nil || n != int64(len(content)) || !bytes.Equal(out.Bytes(), content) {
+			t.Errorf("Streamed %d bytes with error %v", n, err)
+		}
+		if _, err := blob.WriteToContext(canceled, &out); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+		blob.Close()
+	} else {
+		t.Error(err)
+	}
+}
+
+func TestBlobStreams(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_streams", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	content := bytes.Repeat([]byte("streamed blob "), 20000)
+	w, err := db.CreateBlob("text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if n, err := io.Copy(w, bytes.NewReader(content)); err != nil || n != int64(len(content)) {
+		t.Fatalf("Wrote %d bytes with error %v", n, err)
+	}
+	blob, err := w.Blob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if _, err := w.Write([]byte("late")); err != ErrBlobStreamClosed {
+		t.Errorf("Expected ErrBlobStreamClosed, got %v", err)
+	}
+
+	doc := NewDocumentWithId("streamed")
+	doc.Props["blob"] = blob
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	r, err := blob.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if n, err := io.Copy(&out, r); err != nil || !bytes.Equal(out.Bytes(), content) {
+		t.Errorf("Read %d bytes with error %v", n, err)
+	}
+	if n, err := r.Read(make([]byte, 16)); n != 0 || err != io.EOF {
+		t.Errorf("Expected io.EOF after the content, got %d, %v", n, err)
+	}
+	r.Close()
+
+	// An abandoned writer leaves nothing behind.
+	if aborted, err := db.CreateBlob(""); err == nil {
+		aborted.Write([]byte("discarded"))
+		aborted.Close()
+		if _, err := aborted.Blob(); err != ErrBlobStreamClosed {
+			t.Errorf("Expected ErrBlobStreamClosed, got %v", err)
+		}
+	} else {
+		t.Error(err)
+	}
+	for _, obj := range LiveObjects() {
+		if obj.Kind == "BlobReader" || obj.Kind == "BlobWriter" {
+			t.Errorf("Stream still open: %v", obj)
+		}
+	}
+}
+
+func TestServeBlob(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_streams", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	blob, err := NewBlobWithData("text/plain", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	doc := NewDocumentWithId("served/1")
+	doc.Props["file"] = blob
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	r, err := blob.OpenReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	r.Seek(10, io.SeekStart)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "abcd" {
+		t.Errorf("Read %q after seeking forwards, error %v", buf, err)
+	}
+	r.Seek(-6, io.SeekCurrent)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "89ab" {
+		t.Errorf("Read %q after seeking backwards, error %v", buf, err)
+	}
+	if end, _ := r.Seek(0, io.SeekEnd); end != int64(len(content)) {
+		t.Errorf("Expected the end at %d, got %d", len(content), end)
+	}
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("Expected io.EOF at the end, got %v", err)
+	}
+	r.Close()
+
+	server := httptest.NewServer(http.StripPrefix("/attachments", NewBlobHandler(db)))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/attachments/served/1/file", nil)
+	req.Header.Set("Range", "bytes=10-13")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "abcd" {
+		t.Errorf("Range request returned %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != "text/plain" || resp.Header.Get("ETag") != `"`+blob.Digest()+`"` {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+
+	req.Header.Del("Range")
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Conditional request returned %d", resp.StatusCode)
+		}
+	} else {
+		t.Error(err)
+	}
+
+	if resp, err := http.Get(server.URL + "/attachments/served/1/missing"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Missing blob returned %d", resp.StatusCode)
+		}
+	} else {
+		t.Error(err)
+	}
+}
+
+func TestBlobInventory(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	DeleteDatabase("my_db_blobs", "./db")
+	db, db_err := Open("my_db_blobs", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	photo, _ := NewBlobWithData("image/png", []byte("not really a png"))
+	notes, _ := NewBlobWithData("text/plain", []byte("some notes"))
+	defer photo.Close()
+	defer notes.Close()
+	first := NewDocumentWithId("inventory1")
+	first.Props["photo"] = photo
+	first.Props["notes"] = notes
+	second := NewDocumentWithId("inventory2")
+	second.Props["photo"] = photo
+	for _, doc := range []*Document{first, second} {
+		if _, err := db.Save(doc, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+	}
+
+	// A blob written to the store but never saved in a document.
+	if w, err := db.CreateBlob(""); err == nil {
+		w.Write([]byte("orphan"))
+		if orphan, err := w.Blob(); err == nil {
+			orphan.Close()
+		} else {
+			t.Error(err)
+		}
+	} else {
+		t.Error(err)
+	}
+
+	it, err := db.Blobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for it.Next() {
+		ref := it.Ref()
+		refs = append(refs, ref.DocumentID+ref.KeyPath)
+		if ref.KeyPath == "/photo" && (ref.Digest != photo.Digest() || ref.Length != 16 || ref.ContentType != "image/png") {
+			t.Errorf("Unexpected reference %+v", ref)
+		}
+	}
+	sort.Strings(refs)
+	if strings.Join(refs, ",") != "inventory1/notes,inventory1/photo,inventory2/photo" {
+		t.Errorf("Unexpected references %v", refs)
+	}
+
+	stats, err := db.BlobStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 2 || stats.References != 3 || stats.TotalSize != 26 || stats.UnreferencedCount != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if unreferenced, err := db.UnreferencedBlobs(); err != nil || len(unreferenced) != 1 || unreferenced[0].Size != 6 {
+		t.Errorf("Unexpected unreferenced blobs %v, error %v", unreferenced, err)
+	}
+
+	db.Compact()
+	if unreferenced, err := db.UnreferencedBlobs(); err != nil || len(unreferenced) != 0 {
+		t.Errorf("Compact left unreferenced blobs %v, error %v", unreferenced, err)
+	}
+}
+
+func TestVerifyBlobs(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	DeleteDatabase("my_db_verify", "./db")
+	db, db_err := Open("my_db_verify", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	file, err := ioutil.TempFile("", "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("attachment content")
+	file.Close()
+
+	blob, err := db.NewBlobFromFile(file.Name(), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := NewDocumentWithId("verified")
+	doc.Props["file"] = blob
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	blob.Close()
+
+	// The same content is found in the document instead of being written again.
+	if dup, err := db.NewBlobFromFile(file.Name(), "application/octet-stream"); err == nil {
+		if dup.Digest() != blob.Props["digest"] || dup.ContentType() != "text/plain" {
+			t.Errorf("Expected the stored blob, got %v", dup.Props)
+		}
+		dup.Close()
+	} else {
+		t.Error(err)
+	}
+
+	if problems, err := db.VerifyBlobs(context.Background()); err != nil || len(problems) != 0 {
+		t.Errorf("Unexpected problems %v, error %v", problems, err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.VerifyBlobs(canceled); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	path := db.blobFilePath(blob.Props["digest"].(string))
+	if err := ioutil.WriteFile(path, []byte("attachment c0ntent"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if problems, _ := db.VerifyBlobs(context.Background()); len(problems) != 1 || problems[0].Err != ErrBlobCorrupt || problems[0].Ref.DocumentID != "verified" {
+		t.Errorf("Expected a corrupt blob, got %v", problems)
+	}
+	os.Remove(path)
+	if problems, _ := db.VerifyBlobs(context.Background()); len(problems) != 1 || problems[0].Err != ErrBlobMissing {
+		t.Errorf("Expected a missing blob, got %v", problems)
+	}
+}
+
+func TestFleeceProperties(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_fleece", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	doc := NewDocumentWithId("fleece")
+	doc.Props["name"] = "Marcel"
+	doc.Props["age"] = 30
+	doc.Props["ratio"] = 0.5
+	doc.Props["active"] = true
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	lazy, err := db.GetLazyDocument("fleece")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	if len(lazy.Props) != 0 {
+		t.Errorf("Expected no decoded properties, got %v", lazy.Props)
+	}
+	props := lazy.Properties()
+	if props.Count() != 4 || props.Get("name").AsString() != "Marcel" || props.Get("age").AsInt() != 30 ||
+		props.Get("ratio").AsFloat64() != 0.5 || !props.Get("active").AsBool() {
+		t.Errorf("Unexpected properties %s", props.ToJSON())
+	}
+	if missing := props.Get("missing"); missing.Exists() || missing.Type() != fleece.Undefined {
+		t.Errorf("Expected a missing value, got %v", missing)
+	}
+	keys := props.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "active,age,name,ratio" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+	if decoded := props.Interface(); decoded["age"] != float64(30) || decoded["ratio"] != 0.5 {
+		t.Errorf("Unexpected conversion %v", decoded)
+	}
+	if decoded := (fleece.Decoder{UseInt64: true}).DecodeDict(props); decoded["age"] != int64(30) || decoded["ratio"] != 0.5 {
+		t.Errorf("Unexpected conversion with UseInt64 %v", decoded)
+	}
+
+	edited := props.MutableCopy(true)
+	defer edited.Release()
+	tags := fleece.NewMutableArray()
+	tags.Append().SetString("a")
+	tags.Append().SetString("b")
+	edited.Set("tags").SetValue(tags.Array().AsValue())
+	tags.Release()
+	edited.Set("name").SetString("Rivera")
+	edited.Remove("active")
+	if !edited.IsChanged() || edited.Dict().Get("tags").AsArray().Get(1).AsString() != "b" ||
+		edited.Dict().Get("name").AsString() != "Rivera" || edited.Dict().Get("active").Exists() {
+		t.Errorf("Unexpected mutable copy %s", edited.Dict().ToJSON())
+	}
+	if props.Get("name").AsString() != "Marcel" {
+		t.Error("Modifying the mutable copy changed the document")
+	}
+	count := 0
+	for it := edited.Dict().Get("tags").AsArray().Iterator(); it.Next(); count++ {
+		if it.Index() != count || it.Value().Type() != fleece.String {
+			t.Errorf("Unexpected item %d: %v", it.Index(), it.Value())
+		}
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 items, got %d", count)
+	}
+
+	mutable, err := db.GetMutableDocument("fleece")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mutable.Close()
+	mutable.Props["ratio"] = 0.75
+	in_place := mutable.MutableProperties()
+	if in_place.Dict().Get("ratio").AsFloat64() != 0.75 {
+		t.Errorf("Expected the mutable properties to hold Props, got %s", in_place.Dict().ToJSON())
+	}
+	in_place.Set("name").SetString("Rivera")
+	if mutable.ToJSONString() == "" || mutable.Props["name"] != "Rivera" {
+		t.Errorf("Expected Props to be reloaded, got %v", mutable.Props)
+	}
+	in_place.Remove("active")
+	if _, err := db.Save(mutable, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := db.GetLazyDocument("fleece")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	if saved_props := saved.Properties(); saved_props.Get("name").AsString() != "Rivera" ||
+		saved_props.Get("ratio").AsFloat64() != 0.75 || saved_props.Get("active").Exists() {
+		t.Errorf("In-place edits weren't saved: %s", saved_props.ToJSON())
+	}
+	if read_only := saved.MutableProperties(); read_only.CPointer() != nil {
+		t.Error("Expected a null dictionary for a read-only document")
+	}
+}
+
+type fleeceTestRecord struct {
+	Name string `json:"name"`
+	Tags []string `json:"tags"`
+	Raw []byte `json:"raw"`
+	Skipped string `json:"-"`
+}
+
+func TestFleeceEncoding(t *testing.T) {
+	value := map[string]interface{}{
+		"name": "Marcel",
+		"tags": []string{"a", "b"},
+		"raw": []byte{0, 1, 2},
+		"nested": map[string]interface{}{"ok": true, "none": nil},
+	}
+	data, err := fleece.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded interface{}
+	if err := fleece.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	m := decoded.(map[string]interface{})
+	if m["name"] != "Marcel" || fmt.Sprint(m["tags"]) != "[a b]" || !bytes.Equal(m["raw"].([]byte), []byte{0, 1, 2}) ||
+		m["nested"].(map[string]interface{})["ok"] != true {
+		t.Errorf("Unexpected round trip %v", decoded)
+	}
+
+	var record fleeceTestRecord
+	if err := fleece.Unmarshal(data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Name != "Marcel" || len(record.Tags) != 2 || !bytes.Equal(record.Raw, []byte{0, 1, 2}) {
+		t.Errorf("Unexpected struct %+v", record)
+	}
+	record.Skipped = "not encoded"
+	if data, err := fleece.Marshal(record); err == nil {
+		text, _ := fleece.ToJSON(data)
+		if strings.Contains(text, "Skipped") || !strings.Contains(text, `"name":"Marcel"`) {
+			t.Errorf("Unexpected struct encoding %s", text)
+		}
+	} else {
+		t.Error(err)
+	}
+
+	if data, err := fleece.FromJSON(`{"a":[1,2.5,"x"]}`); err == nil {
+		if text, err := fleece.ToJSON(data); err != nil || text != `{"a":[1,2.5,"x"]}` {
+			t.Errorf("Unexpected JSON %s, error %v", text, err)
+		}
+	} else {
+		t.Error(err)
+	}
+	if err := fleece.Unmarshal([]byte("not fleece"), &decoded); err != fleece.ErrInvalidData {
+		t.Errorf("Expected ErrInvalidData, got %v", err)
+	}
+	if _, err := fleece.Marshal(map[int]string{1: "a"}); err != fleece.ErrUnsupportedType {
+		t.Errorf("Expected ErrUnsupportedType, got %v", err)
+	}
+
+	// Documents use the same conversions, including blobs nested in collections.
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+	db, db_err := Open("my_db_fleece", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	blob, _ := NewBlobWithData("text/plain", []byte("nested"))
+	defer blob.Close()
+	doc := NewDocumentWithId("fleece_nested")
+	doc.Props["tags"] = []interface{}{"a", "b"}
+	doc.Props["address"] = map[string]interface{}{"city": "San Juan", "photos": []interface{}{blob}}
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	saved, err := db.GetReadOnlyDocument("fleece_nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	address := saved.Props["address"].(map[string]interface{})
+	photo, ok := address["photos"].([]interface{})[0].(*Blob)
+	if fmt.Sprint(saved.Props["tags"]) != "[a b]" || address["city"] != "San Juan" || !ok || photo.Digest() != blob.Digest() {
+		t.Errorf("Unexpected properties %v", saved.Props)
+	}
+}
+
+func fleeceRoundTrip(v interface{}, decoder fleece.Decoder) (interface{}, error) {
+	data, err := fleece.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	err = decoder.Unmarshal(data, &decoded)
+	return decoded, err
+}
+
+func TestNumericRoundTrip(t *testing.T) {
+	cases := []struct {
+		in interface{}
+		float float64 // as encoding/json decodes it
+		out interface{} // with UseInt64
+		number string
+	}{
+		{0, 0, int64(0), "0"},
+		{int8(-1), -1, int64(-1), "-1"},
+		{int64(math.MaxInt64), math.MaxInt64, int64(math.MaxInt64), "9223372036854775807"},
+		{int64(math.MinInt64), math.MinInt64, int64(math.MinInt64), "-9223372036854775808"},
+		{uint64(math.MaxInt64) + 1, math.MaxInt64 + 1, uint64(math.MaxInt64) + 1, "9223372036854775808"},
+		{uint64(math.MaxUint64), math.MaxUint64, uint64(math.MaxUint64), "18446744073709551615"},
+		{uint32(7), 7, int64(7), "7"},
+		{0.1, 0.1, 0.1, "0.1"},
+		{-2.5, -2.5, -2.5, "-2.5"},
+		{float32(0.1), 0.1, 0.1, "0.1"},
+		{math.MaxFloat64, math.MaxFloat64, math.MaxFloat64, "1.7976931348623157e+308"},
+		{math.SmallestNonzeroFloat64, math.SmallestNonzeroFloat64, math.SmallestNonzeroFloat64, "5e-324"},
+		{2.0, 2, int64(2), "2"}, // integral floats are stored as integers
+		{json.Number("12345678901234567890"), 12345678901234567890, uint64(12345678901234567890), "12345678901234567890"},
+		{json.Number("1.25"), 1.25, 1.25, "1.25"},
+	}
+	for _, c := range cases {
+		if out, err := fleeceRoundTrip(c.in, fleece.Decoder{}); err != nil || out != c.float {
+			t.Errorf("%T %v decoded as %T %v, error %v", c.in, c.in, out, out, err)
+		}
+		var json_out interface{}
+		if data, err := json.Marshal(c.in); err != nil || json.Unmarshal(data, &json_out) != nil || json_out != c.float {
+			t.Errorf("%T %v decoded by encoding/json as %v, not %v", c.in, c.in, json_out, c.float)
+		}
+		if out, err := fleeceRoundTrip(c.in, fleece.Decoder{UseInt64: true}); err != nil || out != c.out {
+			t.Errorf("%T %v decoded as %T %v with UseInt64, error %v", c.in, c.in, out, out, err)
+		}
+		if out, err := fleeceRoundTrip(c.in, fleece.Decoder{UseNumber: true}); err != nil || out != json.Number(c.number) {
+			t.Errorf("%T %v decoded as %v with UseNumber, error %v", c.in, c.in, out, err)
+		}
+	}
+
+	for _, bad := range []interface{}{math.NaN(), math.Inf(1), float32(math.Inf(-1))} {
+		if _, err := fleece.Marshal(bad); err != fleece.ErrUnsupportedValue {
+			t.Errorf("Expected ErrUnsupportedValue for %v, got %v", bad, err)
+		}
+	}
+
+	var record struct {
+		Big uint64 `json:"big"`
+		Any interface{} `json:"any"`
+	}
+	data, _ := fleece.Marshal(map[string]interface{}{"big": uint64(math.MaxUint64), "any": int64(math.MaxInt64)})
+	if err := (fleece.Decoder{UseNumber: true}).Unmarshal(data, &record); err != nil || record.Big != math.MaxUint64 || record.Any != json.Number("9223372036854775807") {
+		t.Errorf("Unexpected struct %+v, error %v", record, err)
+	}
+
+	ints := func(i int64) bool { out, err := fleeceRoundTrip(i, fleece.Decoder{UseInt64: true}); return err == nil && out == i }
+	uints := func(u uint64) bool {
+		out, err := fleeceRoundTrip(u, fleece.Decoder{UseNumber: true})
+		return err == nil && out == json.Number(strconv.FormatUint(u, 10))
+	}
+	floats := func(f float64) bool {
+		if out, err := fleeceRoundTrip(f, fleece.Decoder{}); err != nil || out != f {
+			return false
+		}
+		out, err := fleeceRoundTrip(f, fleece.Decoder{UseInt64: true})
+		if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+			return err == nil && out == int64(f)
+		}
+		return err == nil && out == f
+	}
+	for _, property := range []interface{}{ints, uints, floats} {
+		if err := quick.Check(property, nil); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Documents use the same mapping.
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+	db, db_err := Open("my_db_fleece", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+	doc := NewDocumentWithId("numbers")
+	doc.Props["big"] = uint64(math.MaxUint64)
+	doc.Props["small"] = float32(0.1)
+	doc.Props["count"] = 3
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	if saved, err := db.GetReadOnlyDocument("numbers"); err == nil {
+		if saved.Props["big"] != uint64(math.MaxUint64) || saved.Props["small"] != 0.1 || saved.Props["count"] != int64(3) {
+			t.Errorf("Unexpected numbers %v", saved.Props)
+		}
+		saved.Close()
+	} else {
+		t.Error(err)
+	}
+}
+
+func TestDocumentPatch(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_patch", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	doc := NewDocumentWithId("patched")
+	doc.Props["name"] = "Marcel"
+	doc.Props["a/b"] = 1
+	doc.Props["address"] = map[string]interface{}{"city": "Paris", "zip": "75001"}
+	doc.Props["tags"] = []string{"x", "y"}
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	before, err := db.GetReadOnlyDocument("patched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	edited, err := db.GetMutableDocument("patched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer edited.Close()
+	edited.Props["address"].(map[string]interface{})["city"] = "Lyon"
+	delete(edited.Props, "a/b")
+	edited.Props["age"] = 30
+	edited.Props["tags"] = []interface{}{"x", "z"}
+
+	patch := DiffDocuments(before, edited)
+	expected := `[{"op":"remove","path":"/a~1b"},{"op":"replace","path":"/address/city","value":"Lyon"},` +
+		`{"op":"add","path":"/age","value":30},{"op":"replace","path":"/tags","value":["x","z"]}]`
+	if text, _ := json.Marshal(patch); string(text) != expected {
+		t.Errorf("Unexpected patch %s", text)
+	}
+	if len(DiffDocuments(before, before)) != 0 {
+		t.Error("Expected an empty patch for equal documents")
+	}
+
+	saved, err := db.PatchDocument("patched", patch, FailOnConflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Props["address"].(map[string]interface{})["city"] != "Lyon" || saved.Props["age"] != int64(30) {
+		t.Errorf("Unexpected properties %v", saved.Props)
+	}
+	if _, ok := saved.Props["a/b"]; ok {
+		t.Errorf("Expected a/b to be removed, got %v", saved.Props)
+	}
+	if len(DiffDocuments(edited, saved)) != 0 {
+		t.Errorf("Expected the patched document to match, got %v", DiffDocuments(edited, saved))
+	}
+	saved.Close()
+
+	var ops Patch
+	text := `[{"op":"test","path":"/name","value":"Marcel"},{"op":"add","path":"/tags/1","value":"w"},` +
+		`{"op":"move","from":"/address/zip","path":"/zip"},{"op":"copy","from":"/tags/0","path":"/tags/-"}]`
+	if err := json.Unmarshal([]byte(text), &ops); err != nil {
+		t.Fatal(err)
+	}
+	if err := edited.ApplyPatch(ops); err != nil {
+		t.Fatal(err)
+	}
+	tags := edited.Props["tags"].([]interface{})
+	if len(tags) != 4 || tags[1] != "w" || tags[3] != "x" || edited.Props["zip"] != "75001" {
+		t.Errorf("Unexpected properties %v", edited.Props)
+	}
+
+	failing := Patch{{Op: PatchReplace, Path: "/age", Value: 31}, {Op: PatchTest, Path: "/name", Value: "Bob"}}
+	if err := edited.ApplyPatch(failing); !errors.Is(err, ErrPatchTestFailed) || edited.Props["age"] != 30 {
+		t.Errorf("Expected ErrPatchTestFailed and no changes, got %v, %v", err, edited.Props)
+	}
+	for _, bad := range []Patch{
+		{{Op: "rename", Path: "/name"}},
+		{{Op: PatchRemove, Path: "/missing"}},
+		{{Op: PatchAdd, Path: "/tags/9", Value: 1}},
+		{{Op: PatchMove, From: "/address", Path: "/address/inner"}},
+		{{Op: PatchReplace, Path: "name", Value: 1}},
+	} {
+		if err := edited.ApplyPatch(bad); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("Expected ErrInvalidPatch for %v, got %v", bad, err)
+		}
+	}
+	if err := before.ApplyPatch(ops); err != ErrDocumentIsReadOnly {
+		t.Errorf("Expected ErrDocumentIsReadOnly, got %v", err)
+	}
+
+	// Patches aren't applied over in-place edits, which would overwrite them; once saved, they are.
+	in_place, _ := db.GetMutableDocument("patched")
+	defer in_place.Close()
+	in_place.MutableProperties().Set("name").SetString("Rivera")
+	rename := Patch{{Op: PatchReplace, Path: "/name", Value: "Bob"}}
+	if err := in_place.ApplyPatch(rename); err != ErrDocumentEditedInPlace {
+		t.Errorf("Expected ErrDocumentEditedInPlace, got %v", err)
+	}
+	if _, err := db.Save(in_place, FailOnConflict); err != nil || in_place.Props["name"] != "Rivera" {
+		t.Fatalf("Expected the in-place edit to be saved, got %v, error %v", in_place.Props, err)
+	}
+	if err := in_place.ApplyPatch(rename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Save(in_place, FailOnConflict); err != nil {
+		t.Fatal(err)
+	}
+	if renamed, _ := db.GetReadOnlyDocument("patched"); renamed == nil || renamed.Props["name"] != "Bob" {
+		t.Errorf("Expected the patch to be saved after the in-place edit, got %v", renamed)
+	} else {
+		renamed.Close()
+	}
+
+	// A stale revision conflicts.
+	stale, _ := db.GetMutableDocument("patched")
+	defer stale.Close()
+	if _, err := db.PatchDocument("patched", Patch{{Op: PatchAdd, Path: "/count", Value: 1}}, FailOnConflict); err != nil {
+		t.Fatal(err)
+	}
+	stale.Props["count"] = 2
+	if _, err := db.Save(stale, FailOnConflict); err != ErrDocumentConflict {
+		t.Errorf("Expected ErrDocumentConflict, got %v", err)
+	}
+
+	// PatchDocument retries when another writer saves between its read and its save, and gives
+	// up after patchDocumentRetries retries.
+	writes := 0
+	concurrent := 1
+	patchDocumentBeforeSave = func(docId string) {
+		if writes >= concurrent {
+			return
+		}
+		writes++
+		other, err := db.GetMutableDocument(docId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other.Props["writer"] = writes
+		if _, err := db.Save(other, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		other.Close()
+	}
+	defer func() { patchDocumentBeforeSave = nil }()
+	retried, err := db.PatchDocument("patched", Patch{{Op: PatchReplace, Path: "/count", Value: 3}}, FailOnConflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writes != 1 || retried.Props["count"] != int64(3) || retried.Props["writer"] != int64(1) {
+		t.Errorf("Expected the patch to be retried on the concurrent revision, got %v after %d writes", retried.Props, writes)
+	}
+	retried.Close()
+
+	writes, concurrent = 0, patchDocumentRetries + 100
+	if _, err := db.PatchDocument("patched", Patch{{Op: PatchReplace, Path: "/count", Value: 4}}, FailOnConflict); err != ErrDocumentConflict {
+		t.Errorf("Expected ErrDocumentConflict once out of retries, got %v", err)
+	}
+	if writes != patchDocumentRetries + 1 {
+		t.Errorf("Expected %d attempts, got %d", patchDocumentRetries + 1, writes)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_audited", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+	audit_db, db_err := Open("my_db_audit_log", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer audit_db.Close()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file_sink, err := NewAuditFileSink(dir+"/audit.log", 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file_sink.Close()
+	db_sink, err := NewAuditDatabaseSink(audit_db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAuditLog(audit_db, db_sink, AuditOptions{}); err != ErrInvalidArguments {
+		t.Errorf("Expected ErrInvalidArguments for a sink in the audited database, got %v", err)
+	}
+
+	for _, sink := range []AuditSink{file_sink, db_sink} {
+		audit, err := NewAuditLog(db, sink, AuditOptions{
+			Filter: func(docID string) bool { return strings.HasPrefix(docID, "audited") },
+			OnError: func(docID string, err error) { t.Errorf("Failed to audit %s: %v", docID, err) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docID := fmt.Sprintf("audited-%T", sink)
+		ctx := ContextWithActor(context.Background(), "alice")
+
+		doc := NewDocumentWithId(docID)
+		doc.Props["name"] = "Marcel"
+		doc.Props["age"] = 30
+		if _, err := audit.Save(ctx, doc, FailOnConflict); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+		if _, err := audit.PatchDocument(ContextWithActor(ctx, "bob"), docID,
+			Patch{{Op: PatchReplace, Path: "/age", Value: 31}}, FailOnConflict); err != nil {
+			t.Fatal(err)
+		}
+		ignored := NewDocumentWithId("ignored")
+		if _, err := audit.Save(ctx, ignored, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		ignored.Close()
+		doc, _ = db.GetMutableDocument(docID)
+		if err := audit.DeleteDocument(ctx, doc, FailOnConflict); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+
+		var history []AuditEntry
+		for i := 0; i < 50 && len(history) < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			history, err = audit.History(docID)
+		}
+		audit.Close()
+		if err != nil || len(history) != 3 {
+			t.Fatalf("Expected 3 entries for %s, got %v, error %v", docID, history, err)
+		}
+		if !history[0].Full || history[0].Actor != "alice" || history[0].Generation != 1 || len(history[0].Patch) != 2 ||
+			!strings.HasPrefix(history[0].Revision, "1-") || history[0].Sequence == 0 {
+			t.Errorf("Unexpected first entry %+v", history[0])
+		}
+		if history[1].Full || history[1].Actor != "bob" || len(history[1].Patch) != 1 || history[1].Patch[0].Path != "/age" {
+			t.Errorf("Unexpected second entry %+v", history[1])
+		}
+		if !history[2].Deleted || history[2].Actor != "alice" || len(history[2].Patch) != 2 || history[2].Generation != 3 {
+			t.Errorf("Unexpected third entry %+v", history[2])
+		}
+		if !history[0].Timestamp.Before(history[2].Timestamp) {
+			t.Errorf("Expected increasing timestamps, got %v and %v", history[0].Timestamp, history[2].Timestamp)
+		}
+		if ignored_history, _ := sink.History("ignored"); len(ignored_history) != 0 {
+			t.Errorf("Expected filtered documents not to be audited, got %v", ignored_history)
+		}
+		if err := audit.Err(); err != nil {
+			t.Error(err)
+		}
+		if len(audit.actors) != 0 {
+			t.Errorf("Expected no pending actors, got %v", audit.actors)
+		}
+	}
+
+	if _, err := os.Stat(dir + "/audit.log.1"); err != nil {
+		t.Errorf("Expected the audit file to rotate: %v", err)
+	}
+
+	// Blobs are recorded as their metadata.
+	audit, err := NewAuditLog(db, db_sink, AuditOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := NewBlobWithData("text/plain", []byte("audited"))
+	defer blob.Close()
+	with_blob := NewDocumentWithId("audited-blob")
+	with_blob.Props["file"] = blob
+	if _, err := audit.Save(context.Background(), with_blob, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	with_blob.Close()
+	var history []AuditEntry
+	for i := 0; i < 50 && len(history) < 1; i++ {
+		time.Sleep(20 * time.Millisecond)
+		history, _ = audit.History("audited-blob")
+	}
+	audit.Close()
+	if len(history) != 1 || len(history[0].Patch) != 1 {
+		t.Fatalf("Unexpected entries for the blob document %+v", history)
+	}
+	if file, ok := history[0].Patch[0].Value.(map[string]interface{}); !ok || file["digest"] != blob.Digest() || file["@type"] != "blob" {
+		t.Errorf("Expected the blob's metadata, got %v", history[0].Patch[0].Value)
+	}
+}
+
+func TestChangesFeed(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_changes", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	var base uint64
+	if changes, err := db.ChangesSince(0, 0); err != nil {
+		t.Fatal(err)
+	} else if len(changes) > 0 {
+		base = changes[len(changes)-1].Sequence
+	}
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 10)
+	for _, id := range []string{"a", "b", "c"} {
+		doc := NewDocumentWithId(id + suffix)
+		doc.Props["name"] = id
+		if _, err := db.Save(doc, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+	}
+	doc, _ := db.GetMutableDocument("b" + suffix)
+	if err := db.DeleteDocument(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	changes, err := db.ChangesSince(base, 0)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %v, error %v", changes, err)
+	}
+	if changes[0].ID != "a"+suffix || changes[1].ID != "c"+suffix || changes[2].ID != "b"+suffix ||
+		changes[0].Deleted || !changes[2].Deleted || changes[0].Sequence >= changes[1].Sequence {
+		t.Errorf("Unexpected changes %v", changes)
+	}
+	if limited, err := db.ChangesSince(base, 2); err != nil || len(limited) != 2 || limited[1] != changes[1] {
+		t.Errorf("Expected the first 2 changes, got %v, error %v", limited, err)
+	}
+
+	consumer, err := NewChangesConsumer(db, "test-"+suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Reset(base); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("indexer failed")
+	if _, err := consumer.ProcessChanges(2, func([]DocumentChange) error { return failure }); err != failure || consumer.Checkpoint() != base {
+		t.Errorf("Expected the checkpoint to stay at %d, got %d, error %v", base, consumer.Checkpoint(), err)
+	}
+	var seen []DocumentChange
+	collect := func(batch []DocumentChange) error {
+		seen = append(seen, batch...)
+		return nil
+	}
+	if handled, err := consumer.ProcessChanges(2, collect); err != nil || handled != 3 || len(seen) != 3 || seen[2] != changes[2] {
+		t.Errorf("Expected the 3 changes, got %d: %v, error %v", handled, seen, err)
+	}
+
+	resumed, _ := NewChangesConsumer(db, "test-"+suffix)
+	if resumed.Checkpoint() < changes[2].Sequence {
+		t.Errorf("Expected to resume after %d, got %d", changes[2].Sequence, resumed.Checkpoint())
+	}
+	seen = nil
+	if handled, err := resumed.ProcessChanges(2, collect); err != nil || handled != 0 {
+		t.Errorf("Expected no changes after resuming, got %v, error %v", seen, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := resumed.Run(ctx, 10, 10*time.Millisecond, collect); err != context.DeadlineExceeded || len(seen) != 0 {
+		t.Errorf("Expected Run to stop with the context and see nothing, got %v, %v", err, seen)
+	}
+}
+
+func TestExpiryScheduler(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_expiry", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	forever := NewDocumentWithId("forever")
+	if _, err := db.SaveWithTTL(forever, 0); err != nil {
+		t.Fatal(err)
+	}
+	forever.Close()
+	if expiration, err := db.GetDocumentExpirationTime("forever"); err != nil || !expiration.IsZero() {
+		t.Errorf("Expected no expiration, got %v, error %v", expiration, err)
+	}
+
+	start := time.Now()
+	doc := NewDocumentWithId("ephemeral")
+	doc.Props["name"] = "gone soon"
+	if _, err := db.SaveWithTTL(doc, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	expiration, err := db.GetDocumentExpirationTime("ephemeral")
+	if err != nil || expiration.Before(start.Add(190*time.Millisecond)) || expiration.After(time.Now().Add(200*time.Millisecond)) {
+		t.Errorf("Unexpected expiration %v, error %v", expiration, err)
+	}
+	if next := db.NextDocExpirationTime(); !next.Equal(expiration) {
+		t.Errorf("Expected the next expiration at %v, got %v", expiration, next)
+	}
+	if err := db.SetDocumentExpirationTime("forever", time.Now().Add(time.Hour)); err != nil {
+		t.Error(err)
+	}
+	if err := db.SetDocumentTTL("forever", 0); err != nil {
+		t.Error(err)
+	}
+
+	events := make(chan ExpiryEvent, 1)
+	scheduler := NewExpiryScheduler(db, ExpiryOptions{MaxSleep: time.Second, OnPurge: func(event ExpiryEvent) { events <- event }})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- scheduler.Run(ctx) }()
+
+	select {
+	case event := <-events:
+		if event.Err != nil || event.Purged != 1 || len(event.DocumentIDs) != 1 || event.DocumentIDs[0] != "ephemeral" ||
+			event.Time.Before(expiration) {
+			t.Errorf("Unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the document to be purged")
+	}
+	if gone, err := db.GetReadOnlyDocument("ephemeral"); err == nil {
+		gone.Close()
+		t.Error("Expected the expired document to be purged")
+	}
+	if kept, err := db.GetReadOnlyDocument("forever"); err == nil {
+		kept.Close()
+	} else {
+		t.Error("Expected the document without expiration to be kept")
+	}
+	if err := scheduler.Run(ctx); err != ErrExpirySchedulerRunning {
+		t.Errorf("Expected ErrExpirySchedulerRunning, got %v", err)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for the scheduler to stop")
+	}
+}
+
+func TestAllDocuments(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_all_docs", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	prefix := "list" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		doc := NewDocumentWithId(prefix + id)
+		doc.Props["name"] = id
+		if _, err := db.Save(doc, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+	}
+	doc, _ := db.GetMutableDocument(prefix + "c")
+	if err := db.DeleteDocument(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+
+	list := func(opts AllDocumentsOptions) []string {
+		it, err := db.AllDocuments(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		ids := []string{}
+		for it.Next() {
+			ids = append(ids, strings.TrimPrefix(it.Handle().ID, prefix))
+		}
+		if err := it.Err(); err != nil {
+			t.Error(err)
+		}
+		return ids
+	}
+	cases := []struct {
+		opts AllDocumentsOptions
+		ids string
+	}{
+		{AllDocumentsOptions{Prefix: prefix}, "a b d e"},
+		{AllDocumentsOptions{Prefix: prefix, IncludeDeleted: true}, "a b c d e"},
+		{AllDocumentsOptions{Prefix: prefix, Descending: true}, "e d b a"},
+		{AllDocumentsOptions{Prefix: prefix, Limit: 2}, "a b"},
+		{AllDocumentsOptions{Prefix: prefix, Limit: 2, Skip: 2}, "d e"},
+		{AllDocumentsOptions{Prefix: prefix, Skip: 3}, "e"},
+		{AllDocumentsOptions{StartKey: prefix + "b", EndKey: prefix + "d"}, "b d"},
+		{AllDocumentsOptions{StartKey: prefix + "d", EndKey: prefix + "b", Descending: true}, "d b"},
+		{AllDocumentsOptions{Prefix: prefix + "z"}, ""},
+	}
+	for _, c := range cases {
+		if ids := strings.Join(list(c.opts), " "); ids != c.ids {
+			t.Errorf("Expected %q for %+v, got %q", c.ids, c.opts, ids)
+		}
+	}
+
+	it, err := db.AllDocuments(AllDocumentsOptions{Prefix: prefix, IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	var last, deleted uint64
+	for it.Next() {
+		handle := it.Handle()
+		if handle.Sequence == 0 || handle.Deleted != (handle.ID == prefix+"c") {
+			t.Errorf("Unexpected handle %+v", handle)
+		}
+		if handle.Deleted {
+			deleted = handle.Sequence
+		} else if handle.Sequence > last {
+			last = handle.Sequence
+		}
+		doc, err := handle.Get()
+		if handle.Deleted {
+			if err == nil {
+				doc.Close()
+				t.Error("Expected reading a deleted document to fail")
+			}
+			continue
+		}
+		if err != nil || doc.Props["name"] != strings.TrimPrefix(handle.ID, prefix) {
+			t.Errorf("Unexpected document for %s: %v, error %v", handle.ID, doc, err)
+		}
+		if doc != nil {
+			doc.Close()
+		}
+	}
+	if deleted <= last {
+		t.Errorf("Expected the deletion to have the highest sequence, got %d and %d", deleted, last)
+	}
+}
+
+func TestResultSet(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_result_set", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	prefix := "rows" + strconv.FormatInt(time.Now().UnixNano(), 10) + ":"
+	for i, name := range []string{"a", "b", "c"} {
+		doc := NewDocumentWithId(prefix + name)
+		doc.Props["name"] = name
+		doc.Props["rank"] = i
+		if _, err := db.Save(doc, LastWriteWins); err != nil {
+			t.Fatal(err)
+		}
+		doc.Close()
+	}
+
+	query, err := db.NewQuery(N1QLLanguage, "SELECT name, rank WHERE meta().id LIKE $prefix ORDER BY rank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer query.Close()
+	if err := query.SetParameters(map[string]interface{}{"prefix": prefix + "%"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(LiveObjects())
+	results, err := query.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(LiveObjects()) != before + 1 {
+		t.Error("Expected the result set to be tracked")
+	}
+	if _, err := results.Count(); err != ErrResultSetNotMaterialized {
+		t.Errorf("Expected ErrResultSetNotMaterialized, got %v", err)
+	}
+	names := []string{}
+	for results.Next() {
+		row := results.Row()
+		names = append(names, row.ValueForKey("name").(string))
+		if row.ValueAtIndex(0) != results.ValueForKey("name") {
+			t.Errorf("Row and result set disagree: %v", row.ToMap())
+		}
+	}
+	if err := results.Err(); err != nil {
+		t.Error(err)
+	}
+	if strings.Join(names, " ") != "a b c" {
+		t.Errorf("Unexpected names %v", names)
+	}
+	if len(LiveObjects()) != before + 1 {
+		t.Error("Expected the result set to stay allocated until it is closed")
+	}
+	results.Close()
+	if len(LiveObjects()) != before {
+		t.Error("Expected the result set to be released")
+	}
+
+	results, err = query.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+	if err := results.Materialize(); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := results.Count(); err != nil || count != 3 {
+		t.Errorf("Expected 3 results, got %d, error %v", count, err)
+	}
+	rows := []Result{}
+	for results.Next() {
+		rows = append(rows, results.Row())
+	}
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows, got %d", len(rows))
+	}
+	if json := rows[1].ToJSON(); json != `{"name":"b","rank":1}` {
+		t.Errorf("Unexpected JSON %s", json)
+	}
+	if cols := strings.Join(rows[0].Columns(), " "); cols != "name rank" {
+		t.Errorf("Unexpected columns %q", cols)
+	}
+	if rows[2].ValueForKey("missing") != nil || rows[2].ValueAtIndex(5) != nil {
+		t.Error("Expected nil for missing columns")
+	}
+
+	blob, err := NewBlobWithData("text/plain", []byte("row blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	doc := NewDocumentWithId(prefix + "blob")
+	doc.Props["file"] = blob
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	blob_query, err := db.NewQuery(N1QLLanguage, "SELECT file WHERE meta().id = $id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob_query.Close()
+	blob_query.SetParameters(map[string]interface{}{"id": prefix + "blob"})
+	blob_results, err := blob_query.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob_results.Close()
+	if !blob_results.Next() {
+		t.Fatal("Expected the document with a blob")
+	}
+	if json := blob_results.Row().ToJSON(); !strings.Contains(json, `"digest":"`+blob.Digest()+`"`) ||
+		!strings.Contains(json, `"@type":"blob"`) || strings.Contains(json, `"Props"`) {
+		t.Errorf("Expected the blob's metadata, got %s", json)
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_query_plan", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	if !db.CreateIndex("planByName", IndexSpec{Type: ValueIndex, KeyExpressionsJSON: `[[".name"]]`}) {
+		t.Fatal("Couldn't create the index")
+	}
+
+	indexed, err := db.NewQuery(N1QLLanguage, "SELECT meta().id WHERE name = $name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer indexed.Close()
+	if !indexed.UsesIndex("planByName") || indexed.HasFullScan() {
+		t.Errorf("Expected the query to use planByName:\n%s", indexed.Explain())
+	}
+	plan := indexed.Plan()
+	if plan.SQL == "" || plan.Query == "" || len(plan.Steps) == 0 {
+		t.Errorf("Unexpected plan %+v", plan)
+	}
+
+	scan, err := db.NewQuery(N1QLLanguage, "SELECT meta().id WHERE email = $email ORDER BY age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scan.Close()
+	if scan.UsesIndex("planByName") || !scan.HasFullScan() {
+		t.Errorf("Expected a full scan:\n%s", scan.Explain())
+	}
+	if plan := scan.Plan(); len(plan.TempBTrees) != 1 || plan.TempBTrees[0] != "ORDER BY" {
+		t.Errorf("Expected a temp B-tree for ORDER BY, got %v", plan.TempBTrees)
+	}
+
+	plan = ParseQueryPlan("SELECT 1\n\n3|0|0| SEARCH TABLE kv_default AS _doc USING COVERING INDEX byName (<expr>=?)\n5|0|0| SCAN TABLE \"kv_default::byText\" VIRTUAL TABLE INDEX 5:\n\n{}\n")
+	if plan.SQL != "SELECT 1" || plan.Query != "{}" || !plan.UsesIndex("byName") || !plan.UsesIndex("byText") ||
+		plan.HasFullScan() || !plan.Steps[0].Covering || plan.Steps[0].Alias != "_doc" {
+		t.Errorf("Unexpected plan %+v", plan)
+	}
+}
+
+func TestDocumentBlobAfterSave(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	db, db_err := Open("my_db_blob_lifetime", &config)
+	if db_err != nil {
+		t.Fatal(db_err)
+	}
+	defer db.Close()
+
+	content := []byte("still readable")
+	blob, err := NewBlobWithData("text/plain", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := NewDocumentWithId("blob-lifetime")
+	doc.Props["file"] = blob
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	blob.Close()
+
+	doc, err = db.GetMutableDocument("blob-lifetime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, ok := doc.Props["file"].(*Blob)
+	if !ok {
+		t.Fatalf("Expected a blob, got %v", doc.Props["file"])
+	}
+	// Save replaces, and Close releases, the document the blob was read from.
+	doc.Props["saved"] = true
+	if _, err := db.Save(doc, LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+	doc.Close()
+	runtime.GC()
+
+	if read.Length() != uint64(len(content)) || read.ContentType() != "text/plain" || read.Digest() == "" {
+		t.Errorf("Unexpected blob metadata %v", read.Props)
+	}
+	r, err := read.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != string(content) {
+		t.Errorf("Read %q, error %v", data, err)
+	}
+}
+
+func TestOpenIDConnectSession(t *testing.T) {
+	if AuthDefaultCookieName != "SyncGatewaySession" {
+		t.Errorf("Unexpected default cookie name %q", AuthDefaultCookieName)
+	}
+	cookies := []*http.Cookie{{Name: "tracking", Value: "tracker"}, {Name: "SyncGatewaySession", Value: "session"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer id-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		for _, cookie := range cookies {
+			http.SetCookie(w, cookie)
+		}
+	}))
+	defer server.Close()
+	tokens := TokenSourceFunc(func(ctx context.Context) (string, time.Time, error) {
+		return "id-token", time.Time{}, nil
+	})
+
+	source := &openIDConnectSource{server.URL, AuthDefaultCookieName, tokens, server.Client()}
+	creds, err := source.credentials(context.Background())
+	if err != nil || creds.sessionId != "session" || creds.cookieName != "SyncGatewaySession" {
+		t.Errorf("Expected the Sync Gateway session, got %+v, error %v", creds, err)
+	}
+
+	// Other cookies are only taken when asked for.
+	cookies = cookies[:1]
+	if creds, err := source.credentials(context.Background()); err == nil {
+		t.Errorf("Expected no session without the session cookie, got %+v", creds)
+	}
+	source.cookieName = AnySessionCookie
+	creds, err = source.credentials(context.Background())
+	if err != nil || creds.sessionId != "tracker" || creds.cookieName != "tracking" {
+		t.Errorf("Expected any cookie to be taken, got %+v, error %v", creds, err)
+	}
+
+	if _, err := NewOpenIDConnectAuthenticatorWithCookie(server.URL, "", tokens, server.Client()); err != ErrInvalidArguments {
+		t.Errorf("Expected ErrInvalidArguments for an empty cookie name, got %v", err)
+	}
+	auth, err := NewOpenIDConnectAuthenticatorWithCookie(server.URL, "tracking", tokens, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Free()
+	if !auth.Rotates() || auth.currentGeneration() != 1 {
+		t.Errorf("Expected a rotating authenticator with one session, got generation %d", auth.currentGeneration())
+	}
+}
+
+func TestCertificateValidation(t *testing.T) {
+	key, kerr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if kerr != nil {
+		t.Fatal(kerr)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "expired.example.org"},
+		NotBefore: time.Now().Add(-48 * time.Hour),
+		NotAfter: time.Now().Add(-24 * time.Hour),
+	}
+	der, cerr := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	var config ReplicatorConfiguration
+	config.PinnedServerCertificate = der
+	if _, _, err := replicatorCertificates(&config); !errors.Is(err, ErrCertificateExpired) {
+		t.Error("Expired pinned certificate wasn't rejected:", err)
+	}
+
+	config.PinnedServerCertificate = []byte("not a certificate")
+	if _, _, err := replicatorCertificates(&config); !errors.Is(err, ErrCertificateFormat) {
+		t.Error("Malformed pinned certificate wasn't rejected:", err)
+	}
+
+	config.PinnedServerCertificate = nil
+	config.TrustedRootCertificates = der
+	if _, _, err := replicatorCertificates(&config); !errors.Is(err, ErrCertificateFormat) {
+		t.Error("DER trusted roots weren't rejected:", err)
+	}
+
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	der, _ = x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	config.TrustedRootCertificates = nil
+	config.TrustedRoots = []*x509.Certificate{cert}
+	if _, trusted, err := replicatorCertificates(&config); err != nil || !bytes.HasPrefix(trusted, []byte("-----BEGIN CERTIFICATE-----")) {
+		t.Error("Valid trusted roots weren't converted to PEM:", err)
+	}
+}
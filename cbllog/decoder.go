@@ -0,0 +1,361 @@
+/**
+    Package cbllog decodes the binary log files Couchbase Lite writes when
+    LogFileConfiguration.UsePlainText is false.
+
+    A binary log starts with a header (magic number, format version, pointer size and the time
+    the file was started), followed by entries. Each entry holds the microseconds elapsed since
+    the previous entry, the level, the domain, the object the message is about, and the message's
+    printf-style format string followed by its arguments. Strings that repeat (domains, format
+    strings, object descriptions) are written once and then referred to by number.
+ */
+package cbllog
+
+import "bufio"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "os"
+import "strconv"
+import "strings"
+import "time"
+
+/** The first bytes of every binary log file. */
+var Magic = []byte{0xcf, 0xb2, 0xab, 0x1b}
+
+/** The newest format version the decoder understands. */
+const FormatVersion = 1
+
+var (
+	ErrNotBinaryLog = errors.New("cbllog: not a binary Couchbase Lite log")
+	ErrUnsupportedVersion = errors.New("cbllog: unsupported log format version")
+	ErrCorrupt = errors.New("cbllog: corrupt log data")
+)
+
+/** The level of a log entry. */
+type Level int8
+
+const (
+	LevelDebug Level = iota
+	LevelVerbose
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"debug", "verbose", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return fmt.Sprintf("level%d", int8(l))
+}
+
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+/** A decoded log entry. */
+type Entry struct {
+	Time time.Time `json:"time"`
+	Level Level `json:"level"`
+	Domain string `json:"domain"`
+	ObjectID uint64 `json:"objectId,omitempty"` ///< 0 if the message isn't about an object
+	Object string `json:"object,omitempty"` ///< Description of the object, e.g. "DB@0x7f..."
+	Message string `json:"message"`
+}
+
+/** Formats the entry as a line of text, without a trailing newline. */
+func (e Entry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+	fmt.Fprintf(&b, " [%s] %s: ", e.Domain, e.Level)
+	if e.ObjectID != 0 {
+		fmt.Fprintf(&b, "{%s#%d} ", e.Object, e.ObjectID)
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+/** Reads entries from a binary log. */
+type Decoder struct {
+	r *bufio.Reader
+	Version uint8 ///< Format version from the header
+	PointerSize uint8 ///< Size of pointers on the machine that wrote the log
+	StartTime time.Time ///< When the log file was started
+	elapsed uint64 // microseconds since StartTime
+	tokens []string
+	objects map[uint64]string
+}
+
+/** Reads the header of a binary log and returns a decoder positioned at the first entry. */
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	d := &Decoder{r: bufio.NewReader(r), objects: make(map[uint64]string)}
+	var header [6]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return nil, ErrNotBinaryLog
+	}
+	if !IsBinaryLog(header[:]) {
+		return nil, ErrNotBinaryLog
+	}
+	d.Version, d.PointerSize = header[4], header[5]
+	if d.Version == 0 || d.Version > FormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, d.Version)
+	}
+	if d.PointerSize != 4 && d.PointerSize != 8 {
+		return nil, fmt.Errorf("%w: pointer size %d", ErrCorrupt, d.PointerSize)
+	}
+	start, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	d.StartTime = time.Unix(int64(start), 0)
+	return d, nil
+}
+
+/** Returns true if data starts with the binary log magic number. */
+func IsBinaryLog(data []byte) bool {
+	return len(data) >= len(Magic) && string(data[:len(Magic)]) == string(Magic)
+}
+
+/** Decodes the next entry. Returns io.EOF after the last one. */
+func (d *Decoder) Next() (*Entry, error) {
+	if _, err := d.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+	delta, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	d.elapsed += delta
+	level, err := d.r.ReadByte()
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	domain, err := d.token()
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		Time: d.StartTime.Add(time.Duration(d.elapsed) * time.Microsecond),
+		Level: Level(int8(level)),
+		Domain: domain,
+	}
+	if entry.ObjectID, err = d.uvarint(); err != nil {
+		return nil, err
+	}
+	if entry.ObjectID != 0 {
+		description, ok := d.objects[entry.ObjectID]
+		if !ok {
+			// The first reference to an object is followed by its description.
+			if description, err = d.cstring(); err != nil {
+				return nil, err
+			}
+			d.objects[entry.ObjectID] = description
+		}
+		entry.Object = description
+	}
+	if entry.Message, err = d.message(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Reads a format string token and its arguments, and formats them.
+func (d *Decoder) message() (string, error) {
+	format, err := d.token()
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+		// Parse the flags, width, precision and length modifiers, keeping the two that
+		// change how the argument is encoded: '-' (tokenized string) and ".*" (sized string).
+		minus, dotStar := false, false
+		for i < len(format) && strings.IndexByte("#0- +'", format[i]) >= 0 {
+			if format[i] == '-' {
+				minus = true
+			}
+			i++
+		}
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i < len(format) && format[i] == '.' {
+			i++
+			if i < len(format) && format[i] == '*' {
+				dotStar = true
+				i++
+			} else {
+				for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+					i++
+				}
+			}
+		}
+		for i < len(format) && strings.IndexByte("hljtzq", format[i]) >= 0 {
+			i++
+		}
+		if i >= len(format) {
+			return "", fmt.Errorf("%w: truncated format %q", ErrCorrupt, format)
+		}
+		switch format[i] {
+		case 'c', 'd', 'i':
+			sign, err := d.r.ReadByte()
+			if err != nil {
+				return "", corrupt(err)
+			}
+			v, err := d.uvarint()
+			if err != nil {
+				return "", err
+			}
+			if format[i] == 'c' {
+				out.WriteRune(rune(v))
+			} else if sign != 0 {
+				out.WriteString("-" + strconv.FormatUint(v, 10))
+			} else {
+				out.WriteString(strconv.FormatUint(v, 10))
+			}
+		case 'u':
+			v, err := d.uvarint()
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(strconv.FormatUint(v, 10))
+		case 'x', 'X':
+			v, err := d.uvarint()
+			if err != nil {
+				return "", err
+			}
+			s := strconv.FormatUint(v, 16)
+			if format[i] == 'X' {
+				s = strings.ToUpper(s)
+			}
+			out.WriteString(s)
+		case 'e', 'E', 'f', 'F', 'g', 'G', 'a', 'A':
+			var buf [8]byte
+			if _, err := io.ReadFull(d.r, buf[:]); err != nil {
+				return "", corrupt(err)
+			}
+			v := math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+			out.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case 's':
+			if minus && !dotStar {
+				s, err := d.token()
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(s)
+			} else {
+				size, err := d.uvarint()
+				if err != nil {
+					return "", err
+				}
+				if size > 1<<24 {
+					return "", fmt.Errorf("%w: string of %d bytes", ErrCorrupt, size)
+				}
+				buf := make([]byte, size)
+				if _, err := io.ReadFull(d.r, buf); err != nil {
+					return "", corrupt(err)
+				}
+				out.Write(buf)
+			}
+		case 'p':
+			buf := make([]byte, d.PointerSize)
+			if _, err := io.ReadFull(d.r, buf); err != nil {
+				return "", corrupt(err)
+			}
+			var p uint64
+			if d.PointerSize == 8 {
+				p = binary.LittleEndian.Uint64(buf)
+			} else {
+				p = uint64(binary.LittleEndian.Uint32(buf))
+			}
+			out.WriteString("0x" + strconv.FormatUint(p, 16))
+		default:
+			return "", fmt.Errorf("%w: unknown format specifier %%%c", ErrCorrupt, format[i])
+		}
+	}
+	return out.String(), nil
+}
+
+// Reads a string token: an index into the table of strings seen so far, or the next index
+// followed by a new string.
+func (d *Decoder) token() (string, error) {
+	id, err := d.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if id < uint64(len(d.tokens)) {
+		return d.tokens[id], nil
+	}
+	if id != uint64(len(d.tokens)) {
+		return "", fmt.Errorf("%w: invalid string token %d", ErrCorrupt, id)
+	}
+	s, err := d.cstring()
+	if err != nil {
+		return "", err
+	}
+	d.tokens = append(d.tokens, s)
+	return s, nil
+}
+
+func (d *Decoder) cstring() (string, error) {
+	s, err := d.r.ReadString(0)
+	if err != nil {
+		return "", corrupt(err)
+	}
+	return s[:len(s)-1], nil
+}
+
+func (d *Decoder) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, corrupt(err)
+	}
+	return v, nil
+}
+
+// Running out of data in the middle of an entry means the file is truncated or corrupt.
+func corrupt(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: unexpected end of data", ErrCorrupt)
+	}
+	return err
+}
+
+/** Decodes all entries of a binary log file. If the file is truncated (as the current file of
+    a running process may be), the entries before the damage are returned with the error. */
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := NewDecoder(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var entries []Entry
+	for {
+		entry, err := d.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, *entry)
+	}
+}
@@ -0,0 +1,217 @@
+package cbllog
+
+import "bytes"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "math"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+// A minimal encoder following the layout written by LiteCore, for building test logs.
+type testEncoder struct {
+	buf bytes.Buffer
+	tokens map[string]uint64
+	objects map[uint64]bool
+	elapsed time.Duration
+}
+
+func newTestEncoder(start time.Time, pointerSize byte) *testEncoder {
+	e := &testEncoder{tokens: make(map[string]uint64), objects: make(map[uint64]bool)}
+	e.buf.Write(Magic)
+	e.buf.Write([]byte{FormatVersion, pointerSize})
+	e.uvarint(uint64(start.Unix()))
+	return e
+}
+
+func (e *testEncoder) uvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func (e *testEncoder) cstring(s string) {
+	e.buf.WriteString(s)
+	e.buf.WriteByte(0)
+}
+
+func (e *testEncoder) token(s string) {
+	if id, ok := e.tokens[s]; ok {
+		e.uvarint(id)
+		return
+	}
+	id := uint64(len(e.tokens))
+	e.tokens[s] = id
+	e.uvarint(id)
+	e.cstring(s)
+}
+
+// Writes an entry. Arguments are encoded according to their Go type: int64 for %d, uint64
+// for %u/%x, float64 for %f, string for %s (or a token for %-s), and []byte for a raw %p.
+func (e *testEncoder) entry(at time.Duration, level Level, domain string, obj uint64, objDesc string, format string, args ...interface{}) {
+	e.uvarint(uint64((at - e.elapsed) / time.Microsecond))
+	e.elapsed = at
+	e.buf.WriteByte(byte(level))
+	e.token(domain)
+	e.uvarint(obj)
+	if obj != 0 && !e.objects[obj] {
+		e.objects[obj] = true
+		e.cstring(objDesc)
+	}
+	e.token(format)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case int64:
+			if v < 0 {
+				e.buf.WriteByte(1)
+				e.uvarint(uint64(-v))
+			} else {
+				e.buf.WriteByte(0)
+				e.uvarint(uint64(v))
+			}
+		case uint64:
+			e.uvarint(v)
+		case float64:
+			var tmp [8]byte
+			binary.LittleEndian.PutUint64(tmp[:], math.Float64bits(v))
+			e.buf.Write(tmp[:])
+		case string:
+			e.uvarint(uint64(len(v)))
+			e.buf.WriteString(v)
+		case tokenArg:
+			e.token(string(v))
+		case []byte:
+			e.buf.Write(v)
+		default:
+			panic(fmt.Sprintf("unsupported argument %T", arg))
+		}
+	}
+}
+
+type tokenArg string
+
+func TestDecode(t *testing.T) {
+	start := time.Unix(1571517982, 0)
+	e := newTestEncoder(start, 8)
+	e.entry(0, LevelInfo, "DB", 1, "DB@0x1234", "Opening database %s with %d%% of %u docs", "my_db", int64(-5), uint64(42))
+	e.entry(1500*time.Microsecond, LevelWarning, "Sync", 0, "", "retry in %.3f s, code %x", 2.5, uint64(255))
+	e.entry(2*time.Second, LevelError, "DB", 1, "", "%-s failed at %p", tokenArg("compact"), []byte{0xef, 0xbe, 0xad, 0xde, 0, 0, 0, 0})
+	e.entry(3*time.Second, LevelDebug, "Sync", 0, "", "%-s again", tokenArg("compact"))
+
+	d, err := NewDecoder(&e.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.StartTime.Equal(start) || d.PointerSize != 8 {
+		t.Errorf("Unexpected header: start %v, pointer size %d", d.StartTime, d.PointerSize)
+	}
+
+	expected := []Entry{
+		{start, LevelInfo, "DB", 1, "DB@0x1234", "Opening database my_db with -5% of 42 docs"},
+		{start.Add(1500 * time.Microsecond), LevelWarning, "Sync", 0, "", "retry in 2.5 s, code ff"},
+		{start.Add(2 * time.Second), LevelError, "DB", 1, "DB@0x1234", "compact failed at 0xdeadbeef"},
+		{start.Add(3 * time.Second), LevelDebug, "Sync", 0, "", "compact again"},
+	}
+	for i, want := range expected {
+		got, err := d.Next()
+		if err != nil {
+			t.Fatalf("Entry %d: %v", i, err)
+		}
+		if !got.Time.Equal(want.Time) || got.Level != want.Level || got.Domain != want.Domain ||
+			got.ObjectID != want.ObjectID || got.Object != want.Object || got.Message != want.Message {
+			t.Errorf("Entry %d: got %+v, expected %+v", i, *got, want)
+		}
+	}
+	if _, err := d.Next(); err == nil {
+		t.Error("Expected io.EOF after the last entry")
+	}
+
+	line := expected[0].String()
+	if line != "2019-10-19T20:46:22.000000Z [DB] info: {DB@0x1234#1} Opening database my_db with -5% of 42 docs" {
+		t.Errorf("Unexpected text %q", line)
+	}
+	data, _ := json.Marshal(expected[1])
+	if !strings.Contains(string(data), `"level":"warning"`) || strings.Contains(string(data), "objectId") {
+		t.Errorf("Unexpected JSON %s", data)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, err := NewDecoder(strings.NewReader("12:00:00| plaintext log")); !errors.Is(err, ErrNotBinaryLog) {
+		t.Errorf("Expected ErrNotBinaryLog, got %v", err)
+	}
+	header := append(append([]byte{}, Magic...), 9, 8, 0)
+	if _, err := NewDecoder(bytes.NewReader(header)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+	}
+
+	e := newTestEncoder(time.Unix(0, 0), 8)
+	e.entry(0, LevelInfo, "DB", 0, "", "value %d", int64(1))
+	data := e.buf.Bytes()
+	d, err := NewDecoder(bytes.NewReader(data[:len(data)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Next(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt for a truncated entry, got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cbllog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two rotations of the info log and a plaintext file that must be skipped.
+	start := time.Unix(1571517982, 0)
+	older := newTestEncoder(start, 8)
+	older.entry(0, LevelInfo, "DB", 0, "", "first")
+	older.entry(2*time.Second, LevelInfo, "DB", 0, "", "third")
+	newer := newTestEncoder(start.Add(time.Second), 4)
+	newer.entry(0, LevelInfo, "Sync", 0, "", "second")
+	newer.entry(5*time.Second, LevelInfo, "Sync", 0, "", "fourth")
+
+	files := map[string][]byte{
+		"cbl_info_1.cbllog": older.buf.Bytes(),
+		"cbl_info_2.cbllog": newer.buf.Bytes(),
+		"cbl_debug_1.cbllog": []byte("12:00:00| plaintext"),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := Files(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 binary logs, got %v", paths)
+	}
+	entries, err := Merge(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+	if strings.Join(messages, ",") != "first,second,third,fourth" {
+		t.Errorf("Entries merged out of order: %v", messages)
+	}
+
+	var out bytes.Buffer
+	if err := WriteJSON(&out, entries); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 4 {
+		t.Errorf("Expected 4 JSON lines, got %d", lines)
+	}
+}
@@ -0,0 +1,79 @@
+package cbllog
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+
+/** Returns the binary log files in a log directory (all levels and rotations), sorted by name.
+    Plaintext logs in the same directory are skipped. */
+func Files(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cbllog"))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, path := range paths {
+		if ok, err := isBinaryLogFile(path); err != nil {
+			return nil, err
+		} else if ok {
+			files = append(files, path)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func isBinaryLogFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(Magic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false, nil
+	}
+	return IsBinaryLog(header), nil
+}
+
+/** Decodes several log files, such as the rotations of one log or the logs of every level,
+    and merges their entries in chronological order. Entries with the same timestamp keep the
+    order of the files they came from. A file that can't be fully decoded contributes the
+    entries before the damage, and the first such error is returned with the merged entries. */
+func Merge(paths ...string) ([]Entry, error) {
+	var all []Entry
+	var firstErr error
+	for _, path := range paths {
+		entries, err := ReadFile(path)
+		all = append(all, entries...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Time.Before(all[j].Time) })
+	return all, firstErr
+}
+
+/** Writes entries as lines of text. */
+func WriteText(w io.Writer, entries []Entry) error {
+	for _, entry := range entries {
+		if _, err := fmt.Fprintln(w, entry.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/** Writes entries as JSON, one object per line. */
+func WriteJSON(w io.Writer, entries []Entry) error {
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package cblcgo
+
+import "context"
+import "strings"
+import "sync"
+import "time"
+
+/** \defgroup changes   Changes feed
+    @{
+    Unlike a \ref DatabaseChangeListener, which only hears about changes made while the process
+    is running, \ref Database.ChangesSince reads them back from the database by sequence. A
+    \ref ChangesConsumer builds on it to process every change once (or more, after a failure),
+    storing its checkpoint in the database so that it resumes where it left off after a restart:
+
+        consumer, err := cblcgo.NewChangesConsumer(db, "search-indexer")
+        err = consumer.Run(ctx, 100, time.Second, func(changes []cblcgo.DocumentChange) error {
+            return index(changes)
+        })
+
+    The checkpoint is an ordinary document whose ID starts with \ref ChangesCheckpointPrefix.
+    Consumers skip these documents; replicators pushing the database may want to filter them.
+ */
+
+/** A document's latest change. Purged documents have no changes. */
+type DocumentChange struct {
+	ID string
+	Sequence uint64
+	Deleted bool
+}
+
+/** Returns the documents changed after sequence `since`, ordered by sequence. Each document
+    appears once, at the sequence of its latest change. A limit of 0 or less returns all of
+    them. */
+func (db *Database) ChangesSince(since uint64, limit int) ([]DocumentChange, error) {
+	query_string := "SELECT meta().id, meta().sequence, meta().deleted WHERE meta().sequence > $since ORDER BY meta().sequence"
+	if limit > 0 {
+		query_string += " LIMIT $limit"
+	}
+	query, err := db.newQuery("", N1QLLanguage, query_string)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+	if err := query.SetParameters(map[string]interface{}{"since": since, "limit": limit}); err != nil {
+		return nil, err
+	}
+	results, err := query.Execute()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Release()
+
+	var changes []DocumentChange
+	for results.Next() {
+		change := DocumentChange{}
+		change.ID, _ = results.ValueAtIndex(0).(string)
+		change.Sequence = uint64Value(results.ValueAtIndex(1))
+		change.Deleted = boolValue(results.ValueAtIndex(2))
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+/** Prefix of the IDs of the documents storing \ref ChangesConsumer checkpoints. */
+const ChangesCheckpointPrefix = "cblcgo:checkpoint:"
+
+/** Processes a batch of changes. Returning an error stops the consumer without advancing its
+    checkpoint, so the batch is delivered again. */
+type ChangesHandler func(changes []DocumentChange) error
+
+/** A named, durable reader of a database's changes. */
+type ChangesConsumer struct {
+	db *Database
+	name string
+	mutex sync.Mutex
+	checkpoint uint64 // sequence of the last change handled or skipped
+}
+
+/** Returns the consumer with the given name, resuming from its saved checkpoint if it has
+    one. */
+func NewChangesConsumer(db *Database, name string) (*ChangesConsumer, error) {
+	if name == "" {
+		return nil, ErrInvalidArguments
+	}
+	consumer := &ChangesConsumer{db: db, name: name}
+	if doc, err := db.GetReadOnlyDocument(consumer.checkpointID()); err == nil {
+		consumer.checkpoint = uint64Value(doc.Props["sequence"])
+		doc.Close()
+	}
+	return consumer, nil
+}
+
+func (consumer *ChangesConsumer) checkpointID() string {
+	return ChangesCheckpointPrefix + consumer.name
+}
+
+/** Returns the sequence of the last change handled. */
+func (consumer *ChangesConsumer) Checkpoint() uint64 {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	return consumer.checkpoint
+}
+
+/** Moves the checkpoint, for instance to 0 to process every document again, and saves it. */
+func (consumer *ChangesConsumer) Reset(sequence uint64) error {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	return consumer.saveCheckpoint(sequence)
+}
+
+func (consumer *ChangesConsumer) saveCheckpoint(sequence uint64) error {
+	doc, err := consumer.db.GetMutableDocument(consumer.checkpointID())
+	if err != nil {
+		doc = NewDocumentWithId(consumer.checkpointID())
+	}
+	defer doc.Close()
+	doc.Props["sequence"] = sequence
+	if _, err := consumer.db.Save(doc, LastWriteWins); err != nil {
+		return err
+	}
+	consumer.checkpoint = sequence
+	return nil
+}
+
+/** Hands the changes after the checkpoint to handler in batches of up to batchSize, saving the
+    checkpoint after each batch, until there are none left. Returns the number of changes
+    handled. Checkpoint documents are skipped, and a batch made only of them advances the
+    checkpoint in memory without saving it, so that saving doesn't create more changes. */
+func (consumer *ChangesConsumer) ProcessChanges(batchSize int, handler ChangesHandler) (int, error) {
+	consumer.mutex.Lock()
+	defer consumer.mutex.Unlock()
+	handled := 0
+	for {
+		changes, err := consumer.db.ChangesSince(consumer.checkpoint, batchSize)
+		if err != nil || len(changes) == 0 {
+			return handled, err
+		}
+		last := changes[len(changes)-1].Sequence
+		batch := changes[:0]
+		for _, change := range changes {
+			if !strings.HasPrefix(change.ID, ChangesCheckpointPrefix) {
+				batch = append(batch, change)
+			}
+		}
+		if len(batch) == 0 {
+			consumer.checkpoint = last
+			continue
+		}
+		if err := handler(batch); err != nil {
+			return handled, err
+		}
+		handled += len(batch)
+		if err := consumer.saveCheckpoint(last); err != nil {
+			return handled, err
+		}
+		if batchSize <= 0 {
+			return handled, nil
+		}
+	}
+}
+
+/** Calls \ref ChangesConsumer.ProcessChanges every interval until ctx is done, which is
+    returned, or the handler or checkpoint fails. */
+func (consumer *ChangesConsumer) Run(ctx context.Context, batchSize int, interval time.Duration, handler ChangesHandler) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := consumer.ProcessChanges(batchSize, handler); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/** @} */
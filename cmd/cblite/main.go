@@ -0,0 +1,133 @@
+/**
+    Command cblite is a toolbox for working with Couchbase Lite files.
+
+    Usage:
+
+        cblite logcat [-json] [-level LEVEL] FILE|DIR...
+
+    logcat decodes binary .cbllog files into text (or JSON lines with -json). When several files
+    or a log directory are given, their entries are merged in chronological order.
+ */
+package main
+
+import "bufio"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+
+import "github.com/svr4/couchbase-lite-cgo/cbllog"
+
+// Returned by commands given bad arguments, once they have printed their usage.
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cblite <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  logcat    decode binary log files")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "logcat":
+		err = logcat(os.Args[2:], os.Stdout)
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "cblite: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	switch {
+	case err == errUsage:
+		os.Exit(2)
+	case err == flag.ErrHelp:
+		return
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "cblite: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func logcat(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("logcat", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write entries as JSON lines")
+	minLevel := flags.String("level", "debug", "lowest level to show: debug, verbose, info, warning or error")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: cblite logcat [-json] [-level LEVEL] FILE|DIR...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return err
+	} else if err != nil {
+		// The flag package has already printed the error and the usage.
+		return errUsage
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	level, ok := parseLevel(*minLevel)
+	if !ok {
+		return fmt.Errorf("unknown level %q", *minLevel)
+	}
+
+	var paths []string
+	for _, arg := range flags.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			files, err := cbllog.Files(arg)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, files...)
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+
+	entries, decodeErr := cbllog.Merge(paths...)
+	shown := entries[:0]
+	for _, entry := range entries {
+		if entry.Level >= level {
+			shown = append(shown, entry)
+		}
+	}
+
+	out := bufio.NewWriter(stdout)
+	var err error
+	if *asJSON {
+		err = cbllog.WriteJSON(out, shown)
+	} else {
+		err = cbllog.WriteText(out, shown)
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return err
+	}
+	// Report damage after printing what could be decoded.
+	return decodeErr
+}
+
+func parseLevel(name string) (cbllog.Level, bool) {
+	for level := cbllog.LevelDebug; level <= cbllog.LevelError; level++ {
+		if level.String() == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
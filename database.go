@@ -20,15 +20,14 @@ char * getDocIDFromArray(char **docIds, unsigned index) {
 	return docIds[index];
 }
 
-void Set_Null(void * ptr) {
-	ptr = NULL;
-}
-
 */
 import "C"
 import "unsafe"
 import "context"
 import "fmt"
+import "runtime"
+import "time"
+import "sync"
 
 type EncryptionAlgorithm uint32
 type DatabaseFlags uint32
@@ -47,14 +46,19 @@ const (
 
 type Database struct {
 	db *C.CBLDatabase
-	config *C.CBLDatabaseConfiguration
 	name string
+	// Nesting depth and start of the outermost batch, for metrics.
+	batchDepth int
+	batchStart time.Time
+	// Operations started by the Context methods; Close waits for them.
+	inflight sync.WaitGroup
 }
 
 type ListenerToken struct {
 	key string
 	token *C.CBLListenerToken
 	callbackType string
+	context C.FLMutableDict // passed to the callback; released with the listener
 }
 
 var dbCallbacks map[string]DatabaseChangeListener = make(map[string]DatabaseChangeListener)
@@ -71,6 +75,7 @@ var conflictResolverCallbacks map[string]ConflictResolver = make(map[string]Conf
 var uuid string = "UUID"
 var callback string = "CALLBACK"
 var pushCallback string = "PUSHCALLBACK"
+var replicatorNameKey string = "REPLICATORNAME" // set by Replicator.AddChangeListener
 var pullCallback string = "PULLCALLBACK"
 var conflictResolver string = "CONFLICTRESOLVER"
 
@@ -98,16 +103,9 @@ type DatabaseConfiguration struct {
                         absolute or relative path to the database. */
 //bool CBL_DatabaseExists(const char* _cbl_nonnull name, const char *inDirectory) CBLAPI;
 func DatabaseExists(name, inDirectory string) bool {
-	c_name := C.CString(name)
-	var c_inDirectory *C.char
-	if len(inDirectory) > 0 {
-		c_inDirectory = C.CString(inDirectory)
-		defer C.free(unsafe.Pointer(c_inDirectory))
-	} else {
-		C.Set_Null(unsafe.Pointer(c_inDirectory))
-	}
-	result := C.CBL_DatabaseExists(c_name, c_inDirectory)
-	C.free(unsafe.Pointer(c_name))
+	var mem cArena
+	defer mem.Free()
+	result := C.CBL_DatabaseExists(mem.CString(name), mem.OptionalCString(inDirectory))
 	return bool(result)
 }
 
@@ -123,9 +121,8 @@ func DatabaseExists(name, inDirectory string) bool {
 // 						CBLError*) CBLAPI;
 
 func CopyDatabase(fromPath, toName string, config *DatabaseConfiguration) bool {
-	c_fromPath := C.CString(fromPath)
-	c_toName := C.CString(toName)
-	c_dir := C.CString(config.Directory)
+	var mem cArena
+	defer mem.Free()
 
 	// need to check length and return false if diff or less than 32
 	var key_data [32]C.uint8_t
@@ -135,23 +132,65 @@ func CopyDatabase(fromPath, toName string, config *DatabaseConfiguration) bool {
 
 	encryption_key := C.CBLEncryptionKey{C.uint32_t(config.EncryptionKey.Algorithm), key_data}
 
-	c_config := (*C.CBLDatabaseConfiguration)(C.malloc(C.sizeof_CBLDatabaseConfiguration))
-	c_config.directory = c_dir
+	c_config := (*C.CBLDatabaseConfiguration)(mem.Calloc(C.sizeof_CBLDatabaseConfiguration))
+	c_config.directory = mem.OptionalCString(config.Directory)
 	c_config.flags = C.uint32_t(config.Flags)
 	c_config.encryptionKey = encryption_key
 	
-	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
-
-	result := C.CBL_CopyDatabase(c_fromPath, c_toName, c_config, err)
+	err := (*C.CBLError)(mem.Calloc(C.sizeof_CBLError))
 
-	C.free(unsafe.Pointer(c_fromPath))
-	C.free(unsafe.Pointer(c_toName))
-	C.free(unsafe.Pointer(c_dir))
-	C.free(unsafe.Pointer(err))
+	result := C.CBL_CopyDatabase(mem.CString(fromPath), mem.CString(toName), c_config, err)
 
 	return bool(result)
 }
 
+/** Same as \ref CopyDatabase, but returns ctx.Err() as soon as ctx is done. The copy can't be
+    interrupted, so it finishes in the background; check with \ref DatabaseExists before using
+    or deleting the copy. */
+func CopyDatabaseContext(ctx context.Context, fromPath, toName string, config *DatabaseConfiguration) error {
+	var result bool
+	if err := runWithContext(ctx, func() { result = CopyDatabase(fromPath, toName, config) }); err != nil {
+		return err
+	}
+	if !result {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Copying Database %s", fromPath)
+		return ErrCBLInternalError
+	}
+	return nil
+}
+
+// Runs op on its own goroutine, and waits until it finishes or ctx is done. C calls can't be
+// interrupted, so after cancellation op keeps running; inflight (nil entries are skipped) lets
+// the owners wait for it.
+func runWithContext(ctx context.Context, op func(), inflight ...*sync.WaitGroup) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	for _, wg := range inflight {
+		if wg != nil {
+			wg.Add(1)
+		}
+	}
+	go func() {
+		defer func() {
+			for _, wg := range inflight {
+				if wg != nil {
+					wg.Done()
+				}
+			}
+		}()
+		defer close(done)
+		op()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 /** Deletes a database file. If the database file is open, an error is returned.
 	@param name  The database name (without the ".cblite2" extension.)
 	@param inDirectory  The directory containing the database. If NULL, `name` must be an
@@ -166,15 +205,11 @@ func CopyDatabase(fromPath, toName string, config *DatabaseConfiguration) bool {
 
 func DeleteDatabase(name, inDirectory string) bool {
 
-	c_name := C.CString(name)
-	c_inDirectory := C.CString(inDirectory)
-	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
-
+	var mem cArena
+	defer mem.Free()
+	err := (*C.CBLError)(mem.Calloc(C.sizeof_CBLError))
 
-	result := C.CBL_DeleteDatabase(c_name, c_inDirectory, err)
-	C.free(unsafe.Pointer(c_name))
-	C.free(unsafe.Pointer(c_inDirectory))
-	C.free(unsafe.Pointer(err))
+	result := C.CBL_DeleteDatabase(mem.CString(name), mem.OptionalCString(inDirectory), err)
 	return bool(result)
 }
 
@@ -208,13 +243,12 @@ func Open(name string, config *DatabaseConfiguration) (*Database, error) {
 	}
 	// Create C key
 	c_key := C.CBLEncryptionKey{C.uint32_t(config.EncryptionKey.Algorithm), key_data}
-	// Create C config
-	c_config := (*C.CBLDatabaseConfiguration)(C.malloc(C.sizeof_CBLDatabaseConfiguration))
-
-	c_dir := C.CString(config.Directory)
-	defer C.free(unsafe.Pointer(c_dir))
+	// Create C config. The database copies it, so it's freed on return.
+	var mem cArena
+	defer mem.Free()
+	c_config := (*C.CBLDatabaseConfiguration)(mem.Calloc(C.sizeof_CBLDatabaseConfiguration))
 
-	c_config.directory = c_dir
+	c_config.directory = mem.OptionalCString(config.Directory)
 	c_config.flags = C.uint32_t(config.Flags)
 	c_config.encryptionKey = c_key
 	
@@ -227,8 +261,8 @@ func Open(name string, config *DatabaseConfiguration) (*Database, error) {
 	if (*err).code == 0 {
 		database := Database{}
 		database.db = c_db
-		database.config = c_config
 		database.name = name
+		trackDatabase(&database)
 		return &database, nil
 	}
 
@@ -237,14 +271,43 @@ func Open(name string, config *DatabaseConfiguration) (*Database, error) {
 }
 
 
-/** Closes an open database. */
+/** Closes an open database and releases it. Calling it more than once is harmless. */
 // bool CBLDatabase_Close(CBLDatabase*, CBLError*) CBLAPI;
-func (db *Database) Close() bool {
+func (db *Database) Close() error {
+	if db.db == nil {
+		return nil
+	}
+	// Let operations abandoned by their context finish first.
+	db.inflight.Wait()
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
-	C.free(unsafe.Pointer(db.config))
-	result := C.CBLDatabase_Close(db.db, err)
-	return bool(result)
+	if !bool(C.CBLDatabase_Close(db.db, err)) {
+		ErrProblemClosingDatabase = fmt.Errorf("CBL: Problem Closing Database. Domain: %d Code: %d", (*err).domain, (*err).code)
+		return ErrProblemClosingDatabase
+	}
+	db.release()
+	return nil
+}
+
+// Releases the C database once it has been closed or deleted.
+func (db *Database) release() {
+	untrackObject(unsafe.Pointer(db.db))
+	C.CBLDatabase_Release(db.db)
+	db.db = nil
+	runtime.SetFinalizer(db, nil)
+}
+
+// Starts tracking a database opened for the caller.
+func trackDatabase(db *Database) {
+	trackObject(unsafe.Pointer(db.db), "Database", db.name)
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(db, (*Database).finalize)
+	}
+}
+
+func (db *Database) finalize() {
+	reportLeak(unsafe.Pointer(db.db))
+	db.Close()
 }
 
 
@@ -255,8 +318,9 @@ func (db *Database) Delete() bool {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	result := C.CBLDatabase_Delete(db.db, err)
-	if (*err).code == 0 {
-		return bool(result)
+	if (*err).code == 0 && bool(result) {
+		db.release()
+		return true
 	}
 	return false
 }
@@ -273,6 +337,20 @@ func (db *Database) Compact() bool {
 	return false
 }
 
+/** Same as \ref Database.Compact, but returns ctx.Err() as soon as ctx is done. Compaction
+    can't be interrupted, so it finishes in the background, and \ref Database.Close waits for it. */
+func (db *Database) CompactContext(ctx context.Context) error {
+	var result bool
+	if err := runWithContext(ctx, func() { result = db.Compact() }, &db.inflight); err != nil {
+		return err
+	}
+	if !result {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Compacting Database %s", db.name)
+		return ErrCBLInternalError
+	}
+	return nil
+}
+
 /** Begins a batch operation, similar to a transaction. You **must** later call \ref
 	CBLDatabase_EndBatch to end (commit) the batch.
 	@note  Multiple writes are much faster when grouped inside a single batch.
@@ -285,6 +363,10 @@ func (db *Database) BeginBatch() bool {
 	defer C.free(unsafe.Pointer(err))
 	result := C.CBLDatabase_BeginBatch(db.db, err)
 	if (*err).code == 0 {
+		if db.batchDepth == 0 {
+			db.batchStart = time.Now()
+		}
+		db.batchDepth++
 		return bool(result)
 	}
 	return false
@@ -297,6 +379,10 @@ func (db *Database) EndBatch() bool {
 	defer C.free(unsafe.Pointer(err))
 	result := C.CBLDatabase_EndBatch(db.db, err)
 	if (*err).code == 0 {
+		db.batchDepth--
+		if db.batchDepth == 0 {
+			CurrentMetrics().observeDuration("cbl_batch_duration_seconds", db.batchStart)
+		}
 		return bool(result)
 	}
 	return false
@@ -329,6 +415,20 @@ func (db *Database) PurgeExpiredDocuments() int64 {
 	}
 	return -1
 }
+
+/** Same as \ref Database.PurgeExpiredDocuments, but returns ctx.Err() as soon as ctx is done.
+    The purge finishes in the background, and \ref Database.Close waits for it. */
+func (db *Database) PurgeExpiredDocumentsContext(ctx context.Context) (int64, error) {
+	var purged int64
+	if err := runWithContext(ctx, func() { purged = db.PurgeExpiredDocuments() }, &db.inflight); err != nil {
+		return 0, err
+	}
+	if purged < 0 {
+		ErrCBLInternalError = fmt.Errorf("CBL: Problem Purging Expired Documents In %s", db.name)
+		return 0, ErrCBLInternalError
+	}
+	return purged, nil
+}
 /** @} */
 
 /** \name  Database accessors
@@ -423,7 +523,7 @@ func (db *Database) AddDatabaseChangeListener(listener DatabaseChangeListener, c
 			mutableDictContext := storeContextInMutableDict(ctx, ctxKeys)
 			token := C.CBLDatabase_AddChangeListener(db.db, (C.CBLDatabaseChangeListener)(C.gatewayDatabaseChangeGoCallback),
 													unsafe.Pointer(mutableDictContext))			
-			listener_token := ListenerToken{key,token,"DatabaseChangeListener"}
+			listener_token := ListenerToken{key,token,"DatabaseChangeListener",mutableDictContext}
 			return &listener_token, nil
 		}
 	}
@@ -507,6 +607,10 @@ func (db *Database) RemoveListener(token *ListenerToken) {
 		break;
 	}
 	C.CBLListener_Remove(token.token)
+	if token.context != nil {
+		C.FLMutableDict_Release(token.context)
+		token.context = nil
+	}
 	token.callbackType = ""
 	token.key = ""
 }
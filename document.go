@@ -37,8 +37,11 @@ import "C"
 import "unsafe"
 import "fmt"
 import "context"
+import "runtime"
 //import "reflect"
 
+import "github.com/svr4/couchbase-lite-cgo/fleece"
+
 /** \defgroup documents   Documents
     @{
     A \ref CBLDocument is essentially a JSON object with an ID string that's unique in its database.
@@ -49,6 +52,7 @@ type Document struct {
 	ReadOnly bool
 	Props map[string]interface{}
 	keys []string
+	fleeceEdited bool // MutableProperties was called, so the properties are newer than Props
 }
 
 /** \name  Document lifecycle
@@ -87,6 +91,22 @@ func (db *Database) GetReadOnlyDocument(docId string) (*Document, error){
 	doc.doc = document
 	doc.ReadOnly = true
 	documentProperties(&doc)
+	trackDocument(&doc)
+	return &doc, nil
+}
+
+/** Same as \ref Database.GetReadOnlyDocument, but doesn't decode the properties into Props,
+    which stays empty. Read them in place with \ref Document.Properties; for large documents
+    this is much faster when only a few properties are needed. */
+func (db *Database) GetLazyDocument(docId string) (*Document, error) {
+	c_docId := C.CString(docId)
+	document := C.CBLDatabase_GetDocument(db.db, c_docId)
+	C.free(unsafe.Pointer(c_docId))
+	if document == nil {
+		return nil, ErrProblemReadingDocument
+	}
+	doc := Document{doc: document, ReadOnly: true, Props: make(map[string]interface{})}
+	trackDocument(&doc)
 	return &doc, nil
 }
 
@@ -95,7 +115,9 @@ func (db *Database) GetReadOnlyDocument(docId string) (*Document, error){
     @param doc  The mutable document to save.
     @param concurrency  Conflict-handling strategy.
     @param error  On failure, the error will be written here.
-    @return  An updated document reflecting the saved changes, or NULL on failure. */
+    @return  An updated document reflecting the saved changes, or NULL on failure.
+    With \ref FailOnConflict, a save that conflicts with a newer revision returns
+    ErrDocumentConflict. */
 // _cbl_warn_unused
 // const CBLDocument* CBLDatabase_SaveDocument(CBLDatabase* db _cbl_nonnull,
 //                                             CBLDocument* doc _cbl_nonnull,
@@ -114,10 +136,19 @@ func (db *Database) Save(doc *Document, concurrency ConcurrencyControl) (*Docume
 	saved_doc := C.CBLDatabase_SaveDocument(db.db, doc.doc, C.CBLConcurrencyControl(concurrency), err)
 
 	if !bool(C.is_Null(unsafe.Pointer(saved_doc))) {
+		old_doc := doc.doc
 		doc.doc = C.CBLDocument_MutableCopy(saved_doc)
+		retrackObject(unsafe.Pointer(old_doc), unsafe.Pointer(doc.doc))
+		C.CBLDocument_Release(old_doc)
+		C.CBLDocument_Release(saved_doc)
+		doc.fleeceEdited = false
 		documentProperties(doc)
+		CurrentMetrics().add("cbl_documents_saved_total", 1)
 		return doc, nil
 	}
+	if (*err).domain == C.CBLDomain && (*err).code == C.CBLErrorConflict {
+		return nil, ErrDocumentConflict
+	}
 	c_err_msg := C.CBLError_Message(err)
 	ErrCBLInternalError = fmt.Errorf("CBL: %s. Domain: %d Code: %d", C.GoString(c_err_msg), (*err).domain, (*err).code)
 	C.free(unsafe.Pointer(c_err_msg))
@@ -137,9 +168,9 @@ func (db *Database) Save(doc *Document, concurrency ConcurrencyControl) (*Docume
 func (db *Database) DeleteDocument(doc *Document, concurrency ConcurrencyControl) error {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
-	result := bool(C.CBLDocument_Delete(C.CBLDocument_MutableCopy(doc.doc), C.CBLConcurrencyControl(concurrency), err))
+	result := bool(C.CBLDocument_Delete(doc.doc, C.CBLConcurrencyControl(concurrency), err))
 	if result /*&& (*err).code == 0*/ {
-		//C.free(unsafe.Pointer(doc.doc))
+		CurrentMetrics().add("cbl_documents_deleted_total", 1)
 		return nil
 	}
 	c_err_msg := C.CBLError_Message(err)
@@ -164,7 +195,7 @@ func (db *Database) Purge(doc *Document) error {
 	defer C.free(unsafe.Pointer(err))
 	result := bool(C.CBLDocument_Purge(doc.doc, err))
 	if result && (*err).code == 0 {
-		//C.free(unsafe.Pointer(doc.doc))
+		CurrentMetrics().add("cbl_documents_purged_total", 1)
 		return nil
 	}
 	ErrCBLInternalError = fmt.Errorf("CBL: Problem Purging Document. Domain: %d Code: %d", (*err).domain, (*err).code)
@@ -186,9 +217,10 @@ func (db *Database) PurgeById(docId string) error {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_docId := C.CString(docId)
+	defer C.free(unsafe.Pointer(c_docId))
 	result := bool(C.CBLDatabase_PurgeDocumentByID(db.db, c_docId, err))
 	if result && (*err).code == 0{
-		C.free(unsafe.Pointer(c_docId))
+		CurrentMetrics().add("cbl_documents_purged_total", 1)
 		return nil
 	}
 	ErrCBLInternalError = fmt.Errorf("CBL: Problem Purging Document. Domain: %d Code: %d", (*err).domain, (*err).code)
@@ -226,6 +258,7 @@ func (db *Database) GetMutableDocument(docId string) (*Document, error) {
 	document.doc = c_doc
 	document.ReadOnly = false
 	documentProperties(&document)
+	trackDocument(&document)
 	return &document, nil
 }
 
@@ -240,6 +273,7 @@ func NewDocument() *Document {
 	document.ReadOnly = false
 	document.keys = make([]string, 0)
 	document.Props = make(map[string]interface{})
+	trackDocument(&document)
 	return &document
 }
 
@@ -252,6 +286,7 @@ func NewDocumentWithId(docId string) *Document {
 	document.ReadOnly = false
 	document.keys = make([]string, 0)
 	document.Props = make(map[string]interface{})
+	trackDocument(&document)
 	return &document
 }
 
@@ -267,6 +302,7 @@ func DocumentMutableCopy(original *Document) *Document {
 	copy.doc = C.CBLDocument_MutableCopy(original.doc)
 	copy.keys = original.keys
 	copy.Props = original.Props
+	trackDocument(&copy)
 	return &copy
 }
 
@@ -283,10 +319,9 @@ func DocumentMutableCopy(original *Document) *Document {
 /** Returns a document's ID. */
 // const char* CBLDocument_ID(const CBLDocument* _cbl_nonnull) CBLAPI _cbl_returns_nonnull;
 func (doc *Document) Id() string {
+	// The ID is owned by the document.
 	c_id := C.CBLDocument_ID(doc.doc)
-	id := C.GoString(c_id)
-	C.free(unsafe.Pointer(c_id))
-	return id
+	return C.GoString(c_id)
 }
 
 /** Returns a document's current sequence in the local database.
@@ -326,35 +361,12 @@ func getDocumentKeys(doc *Document) []string {
 }
 
 func getKeyValuePropMap(fl_dict C.FLDict) (map[string]interface{}, error) {
-
-	// iter := C.FLDictIterator{}
-	iter := (*C.FLDictIterator)(C.malloc(C.sizeof_FLDictIterator))
-	C.FLDictIterator_Begin(fl_dict, iter)
-	var value C.FLValue
-
-	props := make(map[string]interface{})
-	
-	for value = C.FLDictIterator_GetValue(iter); value != nil; value = C.FLDictIterator_GetValue(iter) {
-		// FLString
-		key := C.FLDictIterator_GetKeyString(iter)
-		str_key := C.GoStringN((*C.char)(key.buf), C.int(key.size))
-		// str_key := C.GoString((*C.char)(key.buf))
-
-		i, e := getFLValueToGoValue(value)
-
-		if e == nil {
-			props[str_key] = i
-		}
-
-		C.FLDictIterator_Next(iter)
-	}
-	C.FLDictIterator_End(iter)
-	return props, nil
+	return propsDecoder().DecodeDict(fleece.DictFromC(unsafe.Pointer(fl_dict))), nil
 }
 
 func getDocumentKeysHelper(fl_dict C.FLDict) []string {
-	// iter := C.FLDictIterator{}
-	iter := (*C.FLDictIterator)(C.malloc(C.sizeof_FLDictIterator))
+	var fl_iter C.FLDictIterator
+	iter := &fl_iter
 	C.FLDictIterator_Begin(fl_dict, iter)
 	var value C.FLValue
 
@@ -372,20 +384,70 @@ func getDocumentKeysHelper(fl_dict C.FLDict) []string {
 }
 /**
 	Releases a documents underlying C CBLDocument pointer and zeros out the rest of the properties.
+	Calling it more than once is harmless.
 **/
-func (doc *Document) Release() bool {
-	C.CBLDocument_Release(doc.doc)	
+func (doc *Document) Close() error {
+	if doc.doc == nil {
+		return nil
+	}
+	untrackObject(unsafe.Pointer(doc.doc))
+	C.CBLDocument_Release(doc.doc)
+	doc.doc = nil
 	doc.Props = make(map[string]interface{})
 	doc.keys = make([]string, 0)
+	runtime.SetFinalizer(doc, nil)
+	return nil
+}
+
+/** Same as \ref Document.Close. */
+func (doc *Document) Release() bool {
+	doc.Close()
 	return true
 }
 
+// Starts tracking a document created for the caller.
+func trackDocument(doc *Document) {
+	trackObject(unsafe.Pointer(doc.doc), "Document", doc.Id())
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(doc, (*Document).finalize)
+	}
+}
+
+func (doc *Document) finalize() {
+	reportLeak(unsafe.Pointer(doc.doc))
+	doc.Close()
+}
+
+/** Returns the document's properties without converting them to Go values. The dictionary
+    belongs to the document and is only valid until the document is closed. For a mutable
+    document it reflects Props as of the last read or save, and edits made through \ref
+    Document.MutableProperties. */
+func (doc *Document) Properties() fleece.Dict {
+	return fleece.DictFromC(unsafe.Pointer(C.CBLDocument_Properties(doc.doc)))
+}
+
 /** Returns a mutable document's properties as a mutable dictionary.
     You may modify this dictionary and then call \ref CBLDatabase_SaveDocument to persist the changes.
     @note  The dictionary object is owned by the document; you do not need to release it.
     @note  Every call to this function returns the same mutable collection. This is the
            same collection returned by \ref CBLDocument_Properties. */
 // FLMutableDict CBLDocument_MutableProperties(CBLDocument* _cbl_nonnull) CBLAPI _cbl_returns_nonnull;
+/** The dictionary starts out holding Props. Once it has been returned, it replaces Props as the
+    document's contents: \ref Database.Save and \ref Document.ToJSONString reload Props from
+    it instead of the other way round, so don't modify Props until the document is saved.
+    The dictionary is only valid until the document is saved, closed, or given new properties
+    with \ref Document.SetProperties or \ref Document.SetPropertiesAsJSON. Read-only documents
+    return a null dictionary. */
+func (doc *Document) MutableProperties() fleece.MutableDict {
+	if doc.ReadOnly || doc.doc == nil {
+		return fleece.MutableDict{}
+	}
+	if !doc.fleeceEdited {
+		syncMapToUnderlyingDict(doc)
+		doc.fleeceEdited = true
+	}
+	return fleece.MutableDictFromC(unsafe.Pointer(C.CBLDocument_MutableProperties(doc.doc)))
+}
 
 /** Sets a mutable document's properties.
     Call \ref CBLDatabase_SaveDocument to persist the changes.
@@ -395,6 +457,7 @@ func (doc *Document) Release() bool {
 							//    FLMutableDict properties _cbl_nonnull) CBLAPI;
 func (doc *Document) SetProperties(props map[string]interface{}) bool {
 	doc.Props = props
+	doc.fleeceEdited = false
 	return syncMapToUnderlyingDict(doc)
 }
 							
@@ -416,27 +479,20 @@ func syncMapToUnderlyingDict(doc *Document) bool {
 	if doc.ReadOnly {
 		return false
 	}
+	if doc.fleeceEdited {
+		// Edited in place through MutableProperties; the dictionary must stay the same.
+		return documentProperties(doc) == nil
+	}
 
-	mutableDict := C.FLMutableDict_New()
-
-	for k, v := range doc.Props {
-		c_key := C.CString(k)
-
-		switch v.(type) {
-		case (*Blob):
-			v_blob := v.(*Blob)
-			C.FLMutableDict_SetBlob(mutableDict, C.FLStr(c_key), v_blob.blob)
-			C.free(unsafe.Pointer(c_key))
-			continue;
-		}
-
-		fl_slot := C.FLMutableDict_Set(mutableDict, C.FLStr(c_key))
-		storeGoValueInSlot(fl_slot, v)
-		//C.free(unsafe.Pointer(c_key))
+	// Blobs store themselves, being fleece.Storers.
+	mutableDict, err := fleece.NewMutableDictFromMap(doc.Props)
+	if err != nil {
+		return false
 	}
 	
-	C.CBLDocument_SetProperties(doc.doc, mutableDict)
-	// C.free(unsafe.Pointer(mutableDict))
+	// The document retains the dictionary.
+	C.CBLDocument_SetProperties(doc.doc, C.FLMutableDict(mutableDict.CPointer()))
+	mutableDict.Release()
 	return true
 }
 
@@ -448,9 +504,10 @@ func (doc *Document) SetPropertiesAsJSON(json string) bool {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_json := C.CString(json)
+	defer C.free(unsafe.Pointer(c_json))
 	result := bool(C.CBLDocument_SetPropertiesAsJSON(doc.doc, c_json, err))
 	if result {
-		C.free(unsafe.Pointer(c_json))
+		doc.fleeceEdited = false
 		documentProperties(doc)
 		return result
 	}
@@ -473,6 +530,7 @@ func (db *Database) GetDocumentExpiration(docId string) (int64, error) {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_docId := C.CString(docId)
+	defer C.free(unsafe.Pointer(c_docId))
 	timestamp := C.CBLDatabase_GetDocumentExpiration(db.db, c_docId, err)
 	if (*err).code == 0 {
 		return int64(timestamp), nil
@@ -499,12 +557,9 @@ func (db *Database) SetDocumentExpiration(docId string, timestamp int64) bool {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_docId := C.CString(docId)
+	defer C.free(unsafe.Pointer(c_docId))
 	result := bool(C.CBLDatabase_SetDocumentExpiration(db.db, c_docId, C.CBLTimestamp(timestamp), err))
-	if result && (*err).code == 0 {
-		C.free(unsafe.Pointer(c_docId))
-		return result
-	}
-	return result
+	return result && (*err).code == 0
 }
 
 
@@ -550,7 +605,7 @@ func (db *Database) AddDocumentChangeListener(listener DocumentChangeListener, d
 			token := C.CBLDatabase_AddDocumentChangeListener(db.db, c_docId,
 						(C.CBLDocumentChangeListener)(C.gatewayDocumentChangeGoCallback), unsafe.Pointer(mutableDictContext))
 			C.free(unsafe.Pointer(c_docId))
-			listener_token := ListenerToken{key,token,"DocumentChangeListener"}
+			listener_token := ListenerToken{key,token,"DocumentChangeListener",mutableDictContext}
 			return &listener_token, nil
 		}
 	}
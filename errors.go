@@ -22,4 +22,18 @@ var (
 	ErrProblemGettingBlobWithData error = fmt.Errorf("CBL: Error Getting Blob With Data.")
 	ErrProblemCreatingBlobWithData error = fmt.Errorf("CBL: Error Creating Blob With Data.")
 	ErrUnsupportedGoType error = fmt.Errorf("CBL: Unsupported Go type. Use a slice instead.")
+	ErrCertificateFormat error = fmt.Errorf("CBL: Invalid Certificate Format")
+	ErrCertificateExpired error = fmt.Errorf("CBL: Certificate Expired")
+	ErrCertificateNotYetValid error = fmt.Errorf("CBL: Certificate Not Yet Valid")
+	ErrBlobStreamClosed error = fmt.Errorf("CBL: Blob Stream Is Closed")
+	ErrBlobMissing error = fmt.Errorf("CBL: Blob Content Is Missing")
+	ErrBlobCorrupt error = fmt.Errorf("CBL: Blob Content Doesn't Match Its Digest")
+	ErrDocumentConflict error = fmt.Errorf("CBL: Document Update Conflict")
+	ErrInvalidPatch error = fmt.Errorf("CBL: Invalid Patch")
+	ErrProblemCreatingIndex error = fmt.Errorf("CBL: Error Creating Index")
+	ErrPatchTestFailed error = fmt.Errorf("CBL: Patch Test Failed")
+	ErrProblemSettingExpiration error = fmt.Errorf("CBL: Error Setting Document Expiration")
+	ErrResultSetNotMaterialized error = fmt.Errorf("CBL: Result Set Is Not Materialized")
+	ErrExpirySchedulerRunning error = fmt.Errorf("CBL: Expiry Scheduler Is Already Running")
+	ErrDocumentEditedInPlace error = fmt.Errorf("CBL: Document Is Being Edited In Place")
 )
\ No newline at end of file
@@ -0,0 +1,210 @@
+package cblcgo
+
+import "context"
+import "sync"
+import "time"
+
+/** \defgroup expiry   Document expiration
+    @{
+    `time.Time` and `time.Duration` variants of the document expiration functions, which deal in
+    milliseconds since the Unix epoch, and an \ref ExpiryScheduler that purges expired documents
+    as they expire, since Couchbase Lite doesn't do it by itself.
+ */
+
+// Converts a CBLTimestamp to a time; 0 (no expiration) gives the zero time.
+func timestampToTime(timestamp int64) time.Time {
+	if timestamp <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, timestamp * int64(time.Millisecond))
+}
+
+func timeToTimestamp(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+/** Same as \ref Database.GetDocumentExpiration, returning the zero time if the document
+    doesn't expire. */
+func (db *Database) GetDocumentExpirationTime(docId string) (time.Time, error) {
+	timestamp, err := db.GetDocumentExpiration(docId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return timestampToTime(timestamp), nil
+}
+
+/** Same as \ref Database.SetDocumentExpiration; the zero time clears the expiration. */
+func (db *Database) SetDocumentExpirationTime(docId string, expiration time.Time) error {
+	if !db.SetDocumentExpiration(docId, timeToTimestamp(expiration)) {
+		return ErrProblemSettingExpiration
+	}
+	return nil
+}
+
+/** Makes a document expire after ttl; a ttl of 0 or less clears its expiration. */
+func (db *Database) SetDocumentTTL(docId string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return db.SetDocumentExpirationTime(docId, time.Time{})
+	}
+	return db.SetDocumentExpirationTime(docId, time.Now().Add(ttl))
+}
+
+/** Same as \ref Database.NextDocExpiration, returning the zero time if no documents will
+    expire. */
+func (db *Database) NextDocExpirationTime() time.Time {
+	return timestampToTime(db.NextDocExpiration())
+}
+
+/** Saves a document with \ref LastWriteWins and makes it expire after ttl (or never, for a
+    ttl of 0 or less). Both happen in one batch, but a batch isn't rolled back: if setting the
+    expiration fails, the document stays saved without it, and is returned along with the
+    error so the caller can retry \ref Database.SetDocumentTTL or delete it. */
+func (db *Database) SaveWithTTL(doc *Document, ttl time.Duration) (*Document, error) {
+	db.BeginBatch()
+	defer db.EndBatch()
+	saved, err := db.Save(doc, LastWriteWins)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.SetDocumentTTL(saved.Id(), ttl); err != nil {
+		return saved, err
+	}
+	return saved, nil
+}
+
+/** The outcome of one purge by an \ref ExpiryScheduler. */
+type ExpiryEvent struct {
+	Time time.Time ///< When the purge ran
+	/** The documents that had expired by Time. Documents expiring while the purge runs may be
+	    purged without being listed. */
+	DocumentIDs []string
+	Purged int64 ///< Number of documents purged
+	Err error
+}
+
+/** Options for \ref NewExpiryScheduler. Zero values are replaced by the defaults noted on each
+    field. */
+type ExpiryOptions struct {
+	/** Longest sleep between checks of the next expiration, which expirations set by other
+	    database instances can bring forward (default 1m). */
+	MaxSleep time.Duration
+	OnPurge func(event ExpiryEvent) ///< Called after each purge that purged documents or failed
+}
+
+/** Purges a database's expired documents as they expire. */
+type ExpiryScheduler struct {
+	db *Database
+	options ExpiryOptions
+	wake chan struct{}
+	mu sync.Mutex
+	running bool
+}
+
+/** Creates a scheduler; call \ref ExpiryScheduler.Run to start it. */
+func NewExpiryScheduler(db *Database, options ExpiryOptions) *ExpiryScheduler {
+	if options.MaxSleep <= 0 {
+		options.MaxSleep = time.Minute
+	}
+	return &ExpiryScheduler{db: db, options: options, wake: make(chan struct{}, 1)}
+}
+
+/** Makes the scheduler check the next expiration again, after setting an expiration that may
+    be sooner than the one it is waiting for. */
+func (s *ExpiryScheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+/** Sleeps until the next document expires, purges it and any other expired documents, and
+    repeats until ctx is done. Returns ctx.Err(). */
+func (s *ExpiryScheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return ErrExpirySchedulerRunning
+	}
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	// After a purge that found nothing to purge, wait a little before trying again.
+	var min_sleep time.Duration
+	for {
+		sleep := s.options.MaxSleep
+		if next := s.db.NextDocExpirationTime(); !next.IsZero() {
+			if until := time.Until(next); until < sleep {
+				sleep = until
+			}
+		}
+		if sleep < min_sleep {
+			sleep = min_sleep
+		}
+
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-s.wake:
+			timer.Stop()
+			min_sleep = 0
+			continue
+		case <-timer.C:
+		}
+
+		event := s.purge(ctx)
+		if event.Purged > 0 || event.Err != nil {
+			min_sleep = 0
+			if s.options.OnPurge != nil {
+				s.options.OnPurge(event)
+			}
+		} else {
+			min_sleep = 100 * time.Millisecond
+		}
+		if event.Err == ctx.Err() && ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *ExpiryScheduler) purge(ctx context.Context) ExpiryEvent {
+	event := ExpiryEvent{Time: time.Now()}
+	event.DocumentIDs, _ = s.db.expiredDocumentIDs(event.Time)
+	event.Purged, event.Err = s.db.PurgeExpiredDocumentsContext(ctx)
+	return event
+}
+
+// Returns the IDs of the documents that have expired by t.
+func (db *Database) expiredDocumentIDs(t time.Time) ([]string, error) {
+	query, err := db.newQuery("", N1QLLanguage, "SELECT meta().id WHERE meta().expiration > 0 AND meta().expiration <= $now")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+	if err := query.SetParameters(map[string]interface{}{"now": timeToTimestamp(t)}); err != nil {
+		return nil, err
+	}
+	results, err := query.Execute()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Release()
+	var ids []string
+	for results.Next() {
+		if id, ok := results.ValueAtIndex(0).(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+/** @} */
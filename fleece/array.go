@@ -0,0 +1,117 @@
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "unsafe"
+
+/** A reference to a Fleece array. The zero Array is empty. */
+type Array struct {
+	a C.FLArray
+}
+
+/** Wraps a C `FLArray`. */
+func ArrayFromC(ptr unsafe.Pointer) Array {
+	return Array{C.FLArray(ptr)}
+}
+
+/** Returns the underlying C `FLArray`. */
+func (a Array) CPointer() unsafe.Pointer {
+	return unsafe.Pointer(a.a)
+}
+
+/** Returns the array as a Value. */
+func (a Array) AsValue() Value {
+	return Value{C.FLValue(unsafe.Pointer(a.a))}
+}
+
+/** Returns the number of items. */
+func (a Array) Count() int {
+	return int(C.FLArray_Count(a.a))
+}
+
+/** Returns true if the array has no items. */
+func (a Array) IsEmpty() bool {
+	return bool(C.FLArray_IsEmpty(a.a))
+}
+
+/** Returns the item at an index, or a missing Value if the index is out of range. */
+func (a Array) Get(index int) Value {
+	if index < 0 {
+		return Value{}
+	}
+	return Value{C.FLArray_Get(a.a, C.uint32_t(index))}
+}
+
+/** Returns an iterator over the items. */
+func (a Array) Iterator() *ArrayIterator {
+	return &ArrayIterator{a: a.a}
+}
+
+/** Converts the array, and everything it contains, to Go values. See \ref Value.Interface. */
+func (a Array) Interface() []interface{} {
+	return a.InterfaceWith(nil)
+}
+
+/** Same as \ref Array.Interface, but passes each nested dictionary to convert first. */
+func (a Array) InterfaceWith(convert DictConverter) []interface{} {
+	return Decoder{ConvertDict: convert}.decodeArray(a)
+}
+
+/** Encodes the array as JSON. */
+func (a Array) ToJSON() string {
+	return a.AsValue().ToJSON()
+}
+
+/** Returns a mutable copy, which you must release. Nested collections are copied when they are
+    first modified; pass deep to copy them all now. */
+func (a Array) MutableCopy(deep bool) MutableArray {
+	flags := C.FLCopyFlags(C.kFLDefaultCopy)
+	if deep {
+		flags = C.kFLDeepCopyImmutables
+	}
+	return MutableArray{C.FLArray_MutableCopy(a.a, flags)}
+}
+
+/** Iterates over an array's items. Like a result set, it starts before the first item, so
+    call Next first. */
+type ArrayIterator struct {
+	a C.FLArray
+	iter C.FLArrayIterator
+	index int
+	started bool
+	done bool
+}
+
+/** Moves to the next item. Returns false at the end. */
+func (it *ArrayIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		C.FLArrayIterator_Begin(it.a, &it.iter)
+	} else if !bool(C.FLArrayIterator_Next(&it.iter)) {
+		it.done = true
+		return false
+	} else {
+		it.index++
+	}
+	if C.FLArrayIterator_GetValue(&it.iter) == nil {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+/** Returns the current item's index. */
+func (it *ArrayIterator) Index() int {
+	return it.index
+}
+
+/** Returns the current item. */
+func (it *ArrayIterator) Value() Value {
+	return Value{C.FLArrayIterator_GetValue(&it.iter)}
+}
@@ -0,0 +1,231 @@
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "bytes"
+import "encoding/json"
+import "errors"
+import "math"
+import "reflect"
+import "sort"
+import "strconv"
+import "unsafe"
+
+var (
+	ErrUnsupportedType = errors.New("fleece: unsupported Go type")
+	ErrInvalidData = errors.New("fleece: invalid Fleece data")
+	ErrUnsupportedValue = errors.New("fleece: NaN and infinite numbers can't be stored")
+)
+
+/** Implemented by values that store themselves into collections by means other than a
+    \ref Slot, such as Couchbase Lite blobs, which must be registered with the collection. */
+type Storer interface {
+	StoreInDict(d MutableDict, key string)
+	StoreInArray(a MutableArray, index int)
+}
+
+/** Wraps a C `FLSlot`. */
+func SlotFromC(ptr unsafe.Pointer) Slot {
+	return Slot{C.FLSlot(ptr)}
+}
+
+/** Stores a Go value, converting it to Fleece:
+
+    Go                                  | Fleece
+    ------------------------------------|-------------------------------
+    nil, nil pointers                   | null
+    bool                                | boolean
+    signed and unsigned integers        | integer
+    float32, float64                    | 64-bit float; float32s are widened from their shortest decimal form, as encoding/json does, so float32(0.1) is stored as 0.1
+    json.Number                         | integer if it fits an int64 or uint64, otherwise 64-bit float
+    string                              | string
+    []byte                              | data
+    slices and arrays                   | array
+    maps with string keys               | dict
+    Value, Dict, Array and mutable ones | the same value, by reference
+    structs and json.Marshalers         | their JSON encoding, converted
+
+    NaN and infinities fail with \ref ErrUnsupportedValue, as they have no JSON form. See
+    \ref Decoder for how the numbers decode.
+
+    A \ref Storer can't be stored in a slot; use \ref MutableDict.SetInterface or
+    \ref MutableArray.AppendInterface, which also handle Storers nested in maps and slices. */
+func (s Slot) Set(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		s.SetNull()
+		return nil
+	case Value:
+		s.SetValue(val)
+		return nil
+	case Dict:
+		s.SetValue(val.AsValue())
+		return nil
+	case Array:
+		s.SetValue(val.AsValue())
+		return nil
+	case MutableDict:
+		s.SetValue(val.Dict().AsValue())
+		return nil
+	case MutableArray:
+		s.SetValue(val.Array().AsValue())
+		return nil
+	case []byte:
+		s.SetData(val)
+		return nil
+	case json.Number:
+		return s.setNumber(val)
+	case Storer:
+		return ErrUnsupportedType
+	case json.Marshaler:
+		return s.setJSON(val)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		s.SetBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		s.SetInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		s.SetUInt(rv.Uint())
+	case reflect.Float32:
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(rv.Float(), 'g', -1, 32), 64)
+		return s.setFloat(f)
+	case reflect.Float64:
+		return s.setFloat(rv.Float())
+	case reflect.String:
+		s.SetString(rv.String())
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			s.SetNull()
+			return nil
+		}
+		return s.Set(rv.Elem().Interface())
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return ErrUnsupportedType
+		}
+		if rv.IsNil() {
+			s.SetNull()
+			return nil
+		}
+		dict := NewMutableDict()
+		defer dict.Release()
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			if err := dict.SetInterface(key.String(), rv.MapIndex(key).Interface()); err != nil {
+				return err
+			}
+		}
+		s.SetValue(dict.Dict().AsValue())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			s.SetNull()
+			return nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(data), rv)
+			s.SetData(data)
+			return nil
+		}
+		array := NewMutableArray()
+		defer array.Release()
+		for i := 0; i < rv.Len(); i++ {
+			if err := array.AppendInterface(rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		s.SetValue(array.Array().AsValue())
+	case reflect.Struct:
+		return s.setJSON(v)
+	default:
+		return ErrUnsupportedType
+	}
+	return nil
+}
+
+// Stores a value through its JSON encoding, so that struct tags and json.Marshalers apply.
+func (s Slot) setJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return err
+	}
+	return s.Set(generic)
+}
+
+func (s Slot) setNumber(n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		s.SetInt(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		s.SetUInt(u)
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	return s.setFloat(f)
+}
+
+func (s Slot) setFloat(f float64) error {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return ErrUnsupportedValue
+	}
+	s.SetFloat64(f)
+	return nil
+}
+
+/** Stores a Go value under a key, converting it as \ref Slot.Set does. On error the key is
+    removed. */
+func (m MutableDict) SetInterface(key string, v interface{}) error {
+	if storer, ok := v.(Storer); ok {
+		storer.StoreInDict(m, key)
+		return nil
+	}
+	if err := m.Set(key).Set(v); err != nil {
+		m.Remove(key)
+		return err
+	}
+	return nil
+}
+
+/** Appends a Go value, converting it as \ref Slot.Set does. On error nothing is appended. */
+func (m MutableArray) AppendInterface(v interface{}) error {
+	index := m.Array().Count()
+	if storer, ok := v.(Storer); ok {
+		m.Append().SetNull()
+		storer.StoreInArray(m, index)
+		return nil
+	}
+	if err := m.Append().Set(v); err != nil {
+		m.Remove(index, 1)
+		return err
+	}
+	return nil
+}
+
+/** Creates a dictionary holding the converted entries of a map, which you must release. */
+func NewMutableDictFromMap(m map[string]interface{}) (MutableDict, error) {
+	dict := NewMutableDict()
+	for key, v := range m {
+		if err := dict.SetInterface(key, v); err != nil {
+			dict.Release()
+			return MutableDict{}, err
+		}
+	}
+	return dict, nil
+}
@@ -0,0 +1,118 @@
+package fleece
+
+import "bytes"
+import "encoding/json"
+import "math"
+import "strconv"
+
+/** Options for converting Fleece values to Go values. Like encoding/json, the zero Decoder
+    produces nil, bool, float64, string, []byte, []interface{} and map[string]interface{},
+    and UseNumber produces json.Numbers instead of float64s. Integers beyond 2^53 don't fit in
+    a float64 and are rounded; UseInt64 decodes them, and every other integer, without loss:
+
+    Stored number                          | Go value  | With UseInt64 | With UseNumber
+    ---------------------------------------|-----------|---------------|----------------------------
+    integer in the int64 range             | float64   | int64         | json.Number, e.g. "-42"
+    integer above math.MaxInt64            | float64   | uint64        | json.Number, e.g. "18446744073709551615"
+    float                                  | float64   | float64       | json.Number, shortest form
+
+    Fleece stores a float with an integral value, such as 2.0, as an integer, so with UseInt64
+    it decodes as int64, just as its JSON form "2" can't be told apart from an integer. Floats
+    that fit in 32 bits are stored in 32 bits, which widen back to the same float64. \ref
+    Slot.Set stores json.Numbers back exactly, so decoding with UseNumber and re-encoding
+    round-trips every number. */
+type Decoder struct {
+	UseNumber bool ///< Decode numbers as json.Number instead of float64; takes precedence over UseInt64
+	UseInt64 bool ///< Decode integers as int64, or uint64 above math.MaxInt64, instead of float64
+	ConvertDict DictConverter ///< If set, called for each dictionary first
+}
+
+/** Converts a value, and everything it contains, to Go values. A missing value converts to
+    nil. */
+func (d Decoder) Decode(v Value) interface{} {
+	switch v.Type() {
+	case Boolean:
+		return v.AsBool()
+	case Number:
+		return d.decodeNumber(v)
+	case String:
+		return v.AsString()
+	case Data:
+		return v.AsData()
+	case ArrayType:
+		return d.decodeArray(v.AsArray())
+	case DictType:
+		if d.ConvertDict != nil {
+			if converted, ok := d.ConvertDict(v.AsDict()); ok {
+				return converted
+			}
+		}
+		return d.decodeDict(v.AsDict())
+	}
+	return nil
+}
+
+func (d Decoder) decodeNumber(v Value) interface{} {
+	if v.IsInteger() && (d.UseNumber || d.UseInt64) {
+		if v.IsUnsigned() {
+			if u := v.AsUnsigned(); u > math.MaxInt64 {
+				if d.UseNumber {
+					return json.Number(strconv.FormatUint(u, 10))
+				}
+				return u
+			}
+		}
+		if d.UseNumber {
+			return json.Number(strconv.FormatInt(v.AsInt(), 10))
+		}
+		return v.AsInt()
+	}
+	f := v.AsFloat64()
+	if d.UseNumber {
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return f
+}
+
+/** Same as \ref Decoder.Decode, for a dictionary. Its own ConvertDict isn't called. */
+func (d Decoder) DecodeDict(dict Dict) map[string]interface{} {
+	return d.decodeDict(dict)
+}
+
+/** Same as \ref Decoder.Decode, for an array. */
+func (d Decoder) DecodeArray(a Array) []interface{} {
+	return d.decodeArray(a)
+}
+
+func (d Decoder) decodeDict(dict Dict) map[string]interface{} {
+	m := make(map[string]interface{}, dict.Count())
+	for it := dict.Iterator(); it.Next(); {
+		m[it.Key()] = d.Decode(it.Value())
+	}
+	return m
+}
+
+func (d Decoder) decodeArray(a Array) []interface{} {
+	items := make([]interface{}, 0, a.Count())
+	for it := a.Iterator(); it.Next(); {
+		items = append(items, d.Decode(it.Value()))
+	}
+	return items
+}
+
+/** Same as \ref Unmarshal, decoding with the Decoder's options. With UseNumber, numbers in
+    interface{} fields of structs and maps also become json.Numbers; UseInt64 only applies
+    when v is a pointer to an empty interface. */
+func (d Decoder) Unmarshal(data []byte, v interface{}) error {
+	return withRoot(data, func(root Value) error {
+		if target, ok := v.(*interface{}); ok {
+			*target = d.Decode(root)
+			return nil
+		}
+		decoder := json.NewDecoder(bytes.NewReader([]byte(root.ToJSON())))
+		if d.UseNumber {
+			decoder.UseNumber()
+		}
+		return decoder.Decode(v)
+	})
+}
@@ -0,0 +1,124 @@
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "unsafe"
+
+/** A reference to a Fleece dictionary. The zero Dict is empty. */
+type Dict struct {
+	d C.FLDict
+}
+
+/** Wraps a C `FLDict`. */
+func DictFromC(ptr unsafe.Pointer) Dict {
+	return Dict{C.FLDict(ptr)}
+}
+
+/** Returns the underlying C `FLDict`. */
+func (d Dict) CPointer() unsafe.Pointer {
+	return unsafe.Pointer(d.d)
+}
+
+/** Returns the dictionary as a Value. */
+func (d Dict) AsValue() Value {
+	return Value{C.FLValue(unsafe.Pointer(d.d))}
+}
+
+/** Returns the number of entries. */
+func (d Dict) Count() int {
+	return int(C.FLDict_Count(d.d))
+}
+
+/** Returns true if the dictionary has no entries. */
+func (d Dict) IsEmpty() bool {
+	return bool(C.FLDict_IsEmpty(d.d))
+}
+
+/** Looks up a key. Returns a missing Value (see \ref Value.Exists) if there's no such key. */
+func (d Dict) Get(key string) Value {
+	c_key := C.CString(key)
+	value := C.FLDict_Get(d.d, C.FLStr(c_key))
+	C.free(unsafe.Pointer(c_key))
+	return Value{value}
+}
+
+/** Returns the keys, in the dictionary's order. */
+func (d Dict) Keys() []string {
+	keys := make([]string, 0, d.Count())
+	for it := d.Iterator(); it.Next(); {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+/** Returns an iterator over the entries. */
+func (d Dict) Iterator() *DictIterator {
+	return &DictIterator{d: d.d}
+}
+
+/** Converts the dictionary, and everything it contains, to Go values. See \ref Value.Interface. */
+func (d Dict) Interface() map[string]interface{} {
+	return d.InterfaceWith(nil)
+}
+
+/** Same as \ref Dict.Interface, but passes each nested dictionary to convert first. */
+func (d Dict) InterfaceWith(convert DictConverter) map[string]interface{} {
+	return Decoder{ConvertDict: convert}.decodeDict(d)
+}
+
+/** Encodes the dictionary as JSON. */
+func (d Dict) ToJSON() string {
+	return d.AsValue().ToJSON()
+}
+
+/** Returns a mutable copy, which you must release. Nested collections are copied when they are
+    first modified; pass deep to copy them all now. */
+func (d Dict) MutableCopy(deep bool) MutableDict {
+	flags := C.FLCopyFlags(C.kFLDefaultCopy)
+	if deep {
+		flags = C.kFLDeepCopyImmutables
+	}
+	return MutableDict{C.FLDict_MutableCopy(d.d, flags)}
+}
+
+/** Iterates over a dictionary's entries. Like a result set, it starts before the first entry,
+    so call Next first. */
+type DictIterator struct {
+	d C.FLDict
+	iter C.FLDictIterator
+	started bool
+	done bool
+}
+
+/** Moves to the next entry. Returns false at the end. */
+func (it *DictIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		C.FLDictIterator_Begin(it.d, &it.iter)
+	} else if !bool(C.FLDictIterator_Next(&it.iter)) {
+		it.done = true
+		return false
+	}
+	if C.FLDictIterator_GetValue(&it.iter) == nil {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+/** Returns the current entry's key. */
+func (it *DictIterator) Key() string {
+	key := C.FLDictIterator_GetKeyString(&it.iter)
+	return C.GoStringN((*C.char)(key.buf), C.int(key.size))
+}
+
+/** Returns the current entry's value. */
+func (it *DictIterator) Value() Value {
+	return Value{C.FLDictIterator_GetValue(&it.iter)}
+}
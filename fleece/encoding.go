@@ -0,0 +1,79 @@
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "fmt"
+import "unsafe"
+
+func encodingError(code C.FLError) error {
+	return fmt.Errorf("fleece: encoding failed with error %d", int(code))
+}
+
+/** Encodes a Go value as Fleece data, converting it as \ref Slot.Set does. */
+func Marshal(v interface{}) ([]byte, error) {
+	holder := NewMutableArray()
+	defer holder.Release()
+	if err := holder.AppendInterface(v); err != nil {
+		return nil, err
+	}
+	enc := C.FLEncoder_New()
+	defer C.FLEncoder_Free(enc)
+	C.FLEncoder_WriteValue(enc, holder.Array().Get(0).v)
+	var fl_err C.FLError
+	result := C.FLEncoder_Finish(enc, &fl_err)
+	if result.buf == nil {
+		return nil, encodingError(fl_err)
+	}
+	data := C.GoBytes(result.buf, C.int(result.size))
+	C.FLSliceResult_Release(result)
+	return data, nil
+}
+
+// Calls fn with the root value of Fleece data, which is only valid during the call.
+func withRoot(data []byte, fn func(Value) error) error {
+	if len(data) == 0 {
+		return ErrInvalidData
+	}
+	c_data := C.CBytes(data)
+	defer C.free(c_data)
+	root := C.FLValue_FromData(C.FLSlice{c_data, C.size_t(len(data))}, C.kFLUntrusted)
+	if root == nil {
+		return ErrInvalidData
+	}
+	return fn(Value{root})
+}
+
+/** Decodes Fleece data into v, which must be a pointer. A pointer to an empty interface
+    receives the values described by \ref Decoder; other targets are filled in as
+    encoding/json would fill them from the data's JSON form, so struct tags apply and data
+    values can be decoded into []byte fields. */
+func Unmarshal(data []byte, v interface{}) error {
+	return Decoder{}.Unmarshal(data, v)
+}
+
+/** Converts Fleece data to JSON. Data values are written as base64 strings. */
+func ToJSON(data []byte) (string, error) {
+	var out string
+	err := withRoot(data, func(root Value) error {
+		out = root.ToJSON()
+		return nil
+	})
+	return out, err
+}
+
+/** Converts JSON to Fleece data. */
+func FromJSON(json string) ([]byte, error) {
+	c_json := C.CString(json)
+	defer C.free(unsafe.Pointer(c_json))
+	var fl_err C.FLError
+	result := C.FLData_ConvertJSON(C.FLSlice{unsafe.Pointer(c_json), C.size_t(len(json))}, &fl_err)
+	if result.buf == nil {
+		return nil, encodingError(fl_err)
+	}
+	data := C.GoBytes(result.buf, C.int(result.size))
+	C.FLSliceResult_Release(result)
+	return data, nil
+}
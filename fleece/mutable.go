@@ -0,0 +1,195 @@
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "unsafe"
+
+/** A place in a mutable collection to store a value into. A slot is only valid until the
+    collection is next modified, so store into it right away:
+
+        dict.Set("age").SetInt(30)
+ */
+type Slot struct {
+	s C.FLSlot
+}
+
+func (s Slot) SetNull() {
+	C.FLSlot_SetNull(s.s)
+}
+
+func (s Slot) SetBool(b bool) {
+	C.FLSlot_SetBool(s.s, C.bool(b))
+}
+
+func (s Slot) SetInt(i int64) {
+	C.FLSlot_SetInt(s.s, C.int64_t(i))
+}
+
+func (s Slot) SetUInt(u uint64) {
+	C.FLSlot_SetUInt(s.s, C.uint64_t(u))
+}
+
+func (s Slot) SetFloat64(f float64) {
+	C.FLSlot_SetDouble(s.s, C.double(f))
+}
+
+/** Stores a copy of str. */
+func (s Slot) SetString(str string) {
+	c_str := C.CString(str)
+	// Sized explicitly, so that strings containing NUL bytes survive.
+	C.FLSlot_SetString(s.s, C.FLString{unsafe.Pointer(c_str), C.size_t(len(str))})
+	C.free(unsafe.Pointer(c_str))
+}
+
+/** Stores a copy of data. */
+func (s Slot) SetData(data []byte) {
+	c_data := C.CBytes(data)
+	C.FLSlot_SetData(s.s, C.FLSlice{c_data, C.size_t(len(data))})
+	C.free(c_data)
+}
+
+/** Stores a value; collections are stored by reference, not copied. A missing value is
+    stored as null. */
+func (s Slot) SetValue(v Value) {
+	if v.v == nil {
+		s.SetNull()
+		return
+	}
+	C.FLSlot_SetValue(s.s, v.v)
+}
+
+/** A Fleece dictionary that can be modified. */
+type MutableDict struct {
+	d C.FLMutableDict
+}
+
+/** Creates an empty dictionary, which you must release. */
+func NewMutableDict() MutableDict {
+	return MutableDict{C.FLMutableDict_New()}
+}
+
+/** Wraps a C `FLMutableDict`. */
+func MutableDictFromC(ptr unsafe.Pointer) MutableDict {
+	return MutableDict{C.FLMutableDict(ptr)}
+}
+
+/** Returns the underlying C `FLMutableDict`. */
+func (m MutableDict) CPointer() unsafe.Pointer {
+	return unsafe.Pointer(m.d)
+}
+
+/** Releases a dictionary created by \ref NewMutableDict or \ref Dict.MutableCopy. */
+func (m MutableDict) Release() {
+	C.FLMutableDict_Release(m.d)
+}
+
+/** Returns a read-only view of the dictionary, which reflects later changes. */
+func (m MutableDict) Dict() Dict {
+	return Dict{C.FLDict(unsafe.Pointer(m.d))}
+}
+
+/** Returns true if the dictionary has been modified since it was created or copied. */
+func (m MutableDict) IsChanged() bool {
+	return bool(C.FLMutableDict_IsChanged(m.d))
+}
+
+/** Returns the slot for a key, adding the key if necessary. */
+func (m MutableDict) Set(key string) Slot {
+	c_key := C.CString(key)
+	slot := C.FLMutableDict_Set(m.d, C.FLStr(c_key))
+	C.free(unsafe.Pointer(c_key))
+	return Slot{slot}
+}
+
+/** Removes a key, if present. */
+func (m MutableDict) Remove(key string) {
+	c_key := C.CString(key)
+	C.FLMutableDict_Remove(m.d, C.FLStr(c_key))
+	C.free(unsafe.Pointer(c_key))
+}
+
+/** Removes all keys. */
+func (m MutableDict) RemoveAll() {
+	C.FLMutableDict_RemoveAll(m.d)
+}
+
+/** Returns a dictionary-valued property as a mutable dictionary owned by this one, converting
+    it in place if necessary. The result is empty (nil) if the key isn't a dictionary. */
+func (m MutableDict) GetMutableDict(key string) MutableDict {
+	c_key := C.CString(key)
+	d := C.FLMutableDict_GetMutableDict(m.d, C.FLStr(c_key))
+	C.free(unsafe.Pointer(c_key))
+	return MutableDict{d}
+}
+
+/** Same as \ref MutableDict.GetMutableDict, for an array-valued property. */
+func (m MutableDict) GetMutableArray(key string) MutableArray {
+	c_key := C.CString(key)
+	a := C.FLMutableDict_GetMutableArray(m.d, C.FLStr(c_key))
+	C.free(unsafe.Pointer(c_key))
+	return MutableArray{a}
+}
+
+/** A Fleece array that can be modified. */
+type MutableArray struct {
+	a C.FLMutableArray
+}
+
+/** Creates an empty array, which you must release. */
+func NewMutableArray() MutableArray {
+	return MutableArray{C.FLMutableArray_New()}
+}
+
+/** Wraps a C `FLMutableArray`. */
+func MutableArrayFromC(ptr unsafe.Pointer) MutableArray {
+	return MutableArray{C.FLMutableArray(ptr)}
+}
+
+/** Returns the underlying C `FLMutableArray`. */
+func (m MutableArray) CPointer() unsafe.Pointer {
+	return unsafe.Pointer(m.a)
+}
+
+/** Releases an array created by \ref NewMutableArray or \ref Array.MutableCopy. */
+func (m MutableArray) Release() {
+	C.FLMutableArray_Release(m.a)
+}
+
+/** Returns a read-only view of the array, which reflects later changes. */
+func (m MutableArray) Array() Array {
+	return Array{C.FLArray(unsafe.Pointer(m.a))}
+}
+
+/** Returns the slot for an existing index. */
+func (m MutableArray) Set(index int) Slot {
+	return Slot{C.FLMutableArray_Set(m.a, C.uint32_t(index))}
+}
+
+/** Appends a slot to the array. */
+func (m MutableArray) Append() Slot {
+	return Slot{C.FLMutableArray_Append(m.a)}
+}
+
+/** Removes count items starting at index. */
+func (m MutableArray) Remove(index, count int) {
+	C.FLMutableArray_Remove(m.a, C.uint32_t(index), C.uint32_t(count))
+}
+
+/** Changes the number of items, appending nulls or removing items from the end. */
+func (m MutableArray) Resize(size int) {
+	C.FLMutableArray_Resize(m.a, C.uint32_t(size))
+}
+
+/** Returns an array item as a mutable dictionary owned by this array, converting it in place
+    if necessary. */
+func (m MutableArray) GetMutableDict(index int) MutableDict {
+	return MutableDict{C.FLMutableArray_GetMutableDict(m.a, C.uint32_t(index))}
+}
+
+/** Same as \ref MutableArray.GetMutableDict, for an array item. */
+func (m MutableArray) GetMutableArray(index int) MutableArray {
+	return MutableArray{C.FLMutableArray_GetMutableArray(m.a, C.uint32_t(index))}
+}
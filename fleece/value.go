@@ -0,0 +1,172 @@
+/**
+    Package fleece reads and writes Fleece values in place, without converting them to Go
+    maps and slices.
+
+    A \ref Value, \ref Dict or \ref Array is a view of C memory owned by something else, such
+    as a document; it is valid only while its owner is. Reading a property of a large document
+    this way costs one lookup instead of decoding the whole document:
+
+        props := doc.Properties()
+        name := props.Get("name").AsString()
+
+    Call Interface on any value to convert it (and everything it contains) to Go values when
+    needed. \ref MutableDict and \ref MutableArray are the mutable counterparts; those created
+    with a New function or a MutableCopy method must be released.
+ */
+package fleece
+/*
+#cgo LDFLAGS: -L${SRCDIR}/.. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "../include/fleece/Fleece.h"
+*/
+import "C"
+import "unsafe"
+
+/** The types of Fleece values. */
+type Type int
+
+const (
+	Undefined Type = C.kFLUndefined ///< No value; the type of a missing property
+	Null Type = C.kFLNull
+	Boolean Type = C.kFLBoolean
+	Number Type = C.kFLNumber
+	String Type = C.kFLString
+	Data Type = C.kFLData
+	ArrayType Type = C.kFLArray
+	DictType Type = C.kFLDict
+)
+
+var typeNames = map[Type]string{
+	Undefined: "undefined",
+	Null: "null",
+	Boolean: "boolean",
+	Number: "number",
+	String: "string",
+	Data: "data",
+	ArrayType: "array",
+	DictType: "dict",
+}
+
+func (t Type) String() string {
+	return typeNames[t]
+}
+
+/** A reference to a Fleece value of any type. The zero Value is undefined (missing). */
+type Value struct {
+	v C.FLValue
+}
+
+/** Wraps a C `FLValue`. */
+func ValueFromC(ptr unsafe.Pointer) Value {
+	return Value{C.FLValue(ptr)}
+}
+
+/** Returns the underlying C `FLValue`. */
+func (v Value) CPointer() unsafe.Pointer {
+	return unsafe.Pointer(v.v)
+}
+
+/** Returns the value's type; Undefined if it's missing. */
+func (v Value) Type() Type {
+	return Type(C.FLValue_GetType(v.v))
+}
+
+/** Returns true unless the value is missing. A JSON null exists. */
+func (v Value) Exists() bool {
+	return v.v != nil
+}
+
+/** Returns true if the value is a number without a fractional part. */
+func (v Value) IsInteger() bool {
+	return bool(C.FLValue_IsInteger(v.v))
+}
+
+/** Returns true if the value is an integer too large for an int64. */
+func (v Value) IsUnsigned() bool {
+	return bool(C.FLValue_IsUnsigned(v.v))
+}
+
+/** Returns true if the value is a 64-bit floating-point number. */
+func (v Value) IsDouble() bool {
+	return bool(C.FLValue_IsDouble(v.v))
+}
+
+/** Returns the value as a boolean. Numbers are true if nonzero; null and missing values are
+    false, anything else is true. */
+func (v Value) AsBool() bool {
+	return bool(C.FLValue_AsBool(v.v))
+}
+
+/** Returns a number as an int64, truncating floats. Other types return 0. */
+func (v Value) AsInt() int64 {
+	return int64(C.FLValue_AsInt(v.v))
+}
+
+/** Returns a number as a uint64. Negative numbers and other types return 0. */
+func (v Value) AsUnsigned() uint64 {
+	return uint64(C.FLValue_AsUnsigned(v.v))
+}
+
+/** Returns a number as a float64. Other types return 0. */
+func (v Value) AsFloat64() float64 {
+	return float64(C.FLValue_AsDouble(v.v))
+}
+
+/** Returns a string, or "" if the value isn't one. */
+func (v Value) AsString() string {
+	fl_str := C.FLValue_AsString(v.v)
+	if fl_str.buf == nil {
+		return ""
+	}
+	return C.GoStringN((*C.char)(fl_str.buf), C.int(fl_str.size))
+}
+
+/** Returns a copy of a data value's bytes, or nil if the value isn't data. */
+func (v Value) AsData() []byte {
+	fl_data := C.FLValue_AsData(v.v)
+	if fl_data.buf == nil {
+		return nil
+	}
+	return C.GoBytes(fl_data.buf, C.int(fl_data.size))
+}
+
+/** Returns the value as a Dict; the Dict is empty if the value isn't one. */
+func (v Value) AsDict() Dict {
+	return Dict{C.FLValue_AsDict(v.v)}
+}
+
+/** Returns the value as an Array; the Array is empty if the value isn't one. */
+func (v Value) AsArray() Array {
+	return Array{C.FLValue_AsArray(v.v)}
+}
+
+/** Encodes the value as JSON. A missing value encodes as "". */
+func (v Value) ToJSON() string {
+	if v.v == nil {
+		return ""
+	}
+	fl_json := C.FLValue_ToJSON(v.v)
+	json := C.GoStringN((*C.char)(fl_json.buf), C.int(fl_json.size))
+	C.FLSliceResult_Release(C.FLSliceResult(fl_json))
+	return json
+}
+
+/** Same as \ref Value.ToJSON. */
+func (v Value) String() string {
+	return v.ToJSON()
+}
+
+/** Converts the value, and everything it contains, to Go values as a zero \ref Decoder
+    does. A missing value converts to nil. */
+func (v Value) Interface() interface{} {
+	return Decoder{}.Decode(v)
+}
+
+/** Converts a dictionary to a Go value of its own, such as a blob object, or returns false to
+    have it converted to a map. */
+type DictConverter func(d Dict) (interface{}, bool)
+
+/** Same as \ref Value.Interface, but passes each dictionary to convert first. */
+func (v Value) InterfaceWith(convert DictConverter) interface{} {
+	return Decoder{ConvertDict: convert}.Decode(v)
+}
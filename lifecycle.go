@@ -0,0 +1,157 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include "include/CouchbaseLite.h"
+
+*/
+import "C"
+import "unsafe"
+import "fmt"
+import "log"
+import "runtime"
+import "sort"
+import "strings"
+import "sync"
+
+/** \defgroup lifecycle   Object lifecycle
+    @{
+    Databases, documents, queries, blobs and replicators wrap reference-counted C objects that
+    must be released exactly once. Their `Close` methods are idempotent and implement io.Closer.
+
+    Every object the bindings create is recorded until it is closed, so tests can assert that
+    nothing leaked with \ref LiveObjects. Optionally, \ref SetLeakHandler installs finalizers
+    that report (and then release) objects which were garbage collected without being closed.
+ */
+
+/** An object created by the bindings that hasn't been closed yet. */
+type LiveObject struct {
+	Kind string ///< "Database", "Document", "Query", "ResultSet", "Blob", "BlobReader", "BlobWriter" or
+	              ///< "Replicator"
+	Description string ///< Database name, document ID, ...
+	CreatedAt string ///< File and line of the call that created the object
+	seq uint64
+}
+
+func (o LiveObject) String() string {
+	return fmt.Sprintf("%s %q created at %s", o.Kind, o.Description, o.CreatedAt)
+}
+
+const packagePath = "github.com/svr4/couchbase-lite-cgo"
+
+var liveObjects = struct {
+	sync.Mutex
+	objects map[unsafe.Pointer]LiveObject
+	seq uint64
+	leakHandler func(LiveObject)
+}{objects: make(map[unsafe.Pointer]LiveObject)}
+
+// Records a C object created on behalf of the caller of an exported function.
+func trackObject(ptr unsafe.Pointer, kind, description string) {
+	if ptr == nil {
+		return
+	}
+	createdAt := callSite()
+	liveObjects.Lock()
+	liveObjects.seq++
+	liveObjects.objects[ptr] = LiveObject{kind, description, createdAt, liveObjects.seq}
+	liveObjects.Unlock()
+}
+
+// Returns the file and line of the first caller outside the bindings (test files count as
+// outside), so objects created through wrappers such as OpenContext are attributed correctly.
+func callSite() string {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePath+".") || strings.HasSuffix(frame.File, "_test.go") {
+			return fmt.Sprintf("%s:%d", frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// Moves the record of an object whose wrapper now holds a different C pointer.
+func retrackObject(old, ptr unsafe.Pointer) {
+	liveObjects.Lock()
+	if obj, ok := liveObjects.objects[old]; ok {
+		delete(liveObjects.objects, old)
+		liveObjects.objects[ptr] = obj
+	}
+	liveObjects.Unlock()
+}
+
+// Returns the description an object was tracked with.
+func objectDescription(ptr unsafe.Pointer) string {
+	liveObjects.Lock()
+	defer liveObjects.Unlock()
+	return liveObjects.objects[ptr].Description
+}
+
+func untrackObject(ptr unsafe.Pointer) {
+	liveObjects.Lock()
+	delete(liveObjects.objects, ptr)
+	liveObjects.Unlock()
+}
+
+// Returns true if finalizers should be attached to new objects.
+func leakFinalizersEnabled() bool {
+	liveObjects.Lock()
+	defer liveObjects.Unlock()
+	return liveObjects.leakHandler != nil
+}
+
+// Called from finalizers: reports the object if it's still open.
+func reportLeak(ptr unsafe.Pointer) {
+	liveObjects.Lock()
+	obj, ok := liveObjects.objects[ptr]
+	handler := liveObjects.leakHandler
+	liveObjects.Unlock()
+	if ok && handler != nil {
+		handler(obj)
+	}
+}
+
+/** Returns the objects created by the bindings that haven't been closed, oldest first. */
+func LiveObjects() []LiveObject {
+	liveObjects.Lock()
+	objects := make([]LiveObject, 0, len(liveObjects.objects))
+	for _, obj := range liveObjects.objects {
+		objects = append(objects, obj)
+	}
+	liveObjects.Unlock()
+	sort.Slice(objects, func(i, j int) bool { return objects[i].seq < objects[j].seq })
+	return objects
+}
+
+/** Installs finalizers on objects created from now on. When such an object is garbage
+    collected without having been closed, `handler` is called with its description and the
+    object is then released. Pass \ref LogLeak to log leaks, or nil to stop installing
+    finalizers. */
+func SetLeakHandler(handler func(LiveObject)) {
+	liveObjects.Lock()
+	liveObjects.leakHandler = handler
+	liveObjects.Unlock()
+}
+
+/** A leak handler that logs the leaked object with the standard logger. */
+func LogLeak(obj LiveObject) {
+	log.Printf("CBL: Leaked %s", obj)
+}
+
+/** Returns the total number of Couchbase Lite objects. Useful for leak checking. */
+// unsigned CBL_InstanceCount(void) CBLAPI;
+func InstanceCount() uint {
+	return uint(C.CBL_InstanceCount())
+}
+
+/** Logs the class and address of each Couchbase Lite object. Useful for leak checking.
+    @note  May only be functional in debug builds of Couchbase Lite. */
+// void CBL_DumpInstances(void) CBLAPI;
+func DumpInstances() {
+	C.CBL_DumpInstances()
+}
+
+/** @} */
@@ -3,11 +3,34 @@ package cblcgo
 #cgo LDFLAGS: -L. -lCouchbaseLiteC
 #include <stdlib.h>
 #include <stdio.h>
-//#include "include/CBLLog.h"
 #include "include/CBLBase.h"
+#include "include/CBLLog.h"
+
+void logBridge(CBLLogLevel, CBLLogDomain, char *);
+
+void gatewayLogCallback(CBLLogLevel level, CBLLogDomain domain, const char* message) {
+	logBridge(level, domain, (char*)message);
+}
+
+// The struct's members are const, so it can only be initialized in C.
+void setLogFileConfig(const char *directory, uint32_t maxRotateCount, size_t maxSize, bool usePlaintext) {
+	CBLLogFileConfiguration config = {directory, maxRotateCount, maxSize, usePlaintext};
+	CBLLog_SetFileConfig(config);
+}
 
 */
 import "C"
+import "unsafe"
+import "fmt"
+import "sync"
+
+/** \defgroup logging   Logging
+    @{
+    Managing messages that Couchbase Lite logs at runtime. Messages go to the console, to
+    rotating log files configured with \ref SetLogFileConfig, and to the callback installed with
+    \ref SetLogCallback, each with its own level. The adapters at the end of this file forward
+    messages to structured loggers, with the domain as a field.
+ */
 
 type LogLevel uint8
 
@@ -20,6 +43,24 @@ const (
     LogNone
 )
 
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogVerbose:
+		return "verbose"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	case LogNone:
+		return "none"
+	}
+	return fmt.Sprintf("LogLevel(%d)", uint8(level))
+}
+
 type LogDomain uint8
 
 const (
@@ -30,78 +71,158 @@ const (
     LogDomainNetwork
 )
 
+func (domain LogDomain) String() string {
+	switch domain {
+	case LogDomainAll:
+		return "all"
+	case LogDomainDatabase:
+		return "database"
+	case LogDomainQuery:
+		return "query"
+	case LogDomainReplicator:
+		return "replicator"
+	case LogDomainNetwork:
+		return "network"
+	}
+	return fmt.Sprintf("LogDomain(%d)", uint8(domain))
+}
+
 // void CBL_SetLogLevel(CBLLogLevel, CBLLogDomain) CBLAPI;
 func SetLogLevel(level LogLevel, domain LogDomain) {
 	C.CBL_SetLogLevel(C.CBLLogLevel(level), C.CBLLogDomain(domain))
 }
 
-// /** An object containing properties for file logging configuration 
-//     @warning \ref usePlaintext results in significantly larger log files; we recommend turning
-// 	it off in production. */
-// 	// typedef struct {
-// 	// 	const char* directory;          ///< The directory to write logs to (UTF-8 encoded)
-// 	// 	const uint32_t maxRotateCount;  ///< The maximum number of *rotated* logs to keep (i.e. the total number of logs will be one more)
-// 	// 	const size_t maxSize;           ///< The max size to write to a log file before rotating (best-effort)
-// 	// 	const bool usePlaintext;        ///< Whether or not to log in plaintext (as opposed to binary)
-// 	// } CBLLogFileConfiguration;
-// type LogFileConfiguration struct {
-// 	Directory string ///< The directory to write logs to (UTF-8 encoded)
-// 	MaxRotateCount uint32 ///< The maximum number of *rotated* logs to keep (i.e. the total number of logs will be one more)
-// 	MaxSize uint64 ///< The max size to write to a log file before rotating (best-effort)
-// 	UsePlainText bool ///< Whether or not to log in plaintext (as opposed to binary)
-// }
-	
-// /** A callback function for handling log messages
-// 	@param  level The level of the message being received
-// 	@param  domain The domain of the message being received
-// 	@param  message The message being received (UTF-8 encoded) */
-// //typedef void(*CBLLogCallback)(CBLLogLevel level, CBLLogDomain domain, const char* message);
-// type LogCallback func (level LogLevel, domain LogDomain, message string)
-
-// /** Gets the current log level for debug console logging */
-// // CBLLogLevel CBLLog_ConsoleLevel();
-// // func GetLogLevel() LogLevel {
-// // 	lvl := C.CBLLog_ConsoleLevel()
-// // 	return LogLevel(lvl)
-// // }
-
-// /** Sets the debug console log level */
-// //void CBLLog_SetConsoleLevel(CBLLogLevel);
-// func SetLogLevel(level LogLevel) {
-// 	C.CBLLog_SetConsoleLevel(CBLLogLevel(level))
-// }
-
-// // /** Gets the current file logging config */
-// // // const CBLLogFileConfiguration* CBLLog_FileConfig();
-// // func LogFileConfig() *LogFileConfiguration {
-// // 	c_config := C.CBLLog_FileConfig()
-// // 	dir := C.GoString(c_config.directory)
-// // 	config := LogFileConfiguration{dir, uint32(c_config.maxRotateCount), uint64(c_config.maxSize), bool(c_config.usePlaintext)}
-// // 	return &config
-// // }
-
-// // /** Sets the file logging configuration */
-// // // void CBLLog_SetFileConfig(CBLLogFileConfiguration);
-// // func SetLogFileConfig(config LogFileConfiguration) {
-// // 	c_config := C.CBLLogFileConfiguration{}
-// // 	c_config.directory = C.CString(config.Directory)
-// // 	c_config.maxRotateCount = C.uint32_t(config.MaxRotateCount)
-// // 	c_config.maxSize = C.size_t(config.MaxSize)
-// // 	c_config.usePlaintext = C.bool(config.UsePlainText)
-// // 	C.CBLLog_SetFileConfig(c_config)
-// // }
-
-// // /** Gets the current log callback */
-// // // CBLLogCallback CBLLog_Callback();
-// // func GetLogCallback() LogCallback {
-// // 	callback := C.CBLLog_Callback()
-// // 	return LogCallback(callback)
-// // }
-
-// // /** Sets the callback for receiving log messages */
-// // // void CBLLog_SetCallback(CBLLogCallback);
-// // func SetLogCallback(callback LogCallback) {
-// // 	C.CBLLog_SetCallback(C.CBLLogCallback(callback))
-// // }
-	
-// /** @} */
\ No newline at end of file
+/** An object containing properties for file logging configuration
+    @warning \ref UsePlainText results in significantly larger log files; we recommend turning
+	it off in production. */
+// typedef struct {
+// 	const char* directory;          ///< The directory to write logs to (UTF-8 encoded)
+// 	const uint32_t maxRotateCount;  ///< The maximum number of *rotated* logs to keep (i.e. the total number of logs will be one more)
+// 	const size_t maxSize;           ///< The max size to write to a log file before rotating (best-effort)
+// 	const bool usePlaintext;        ///< Whether or not to log in plaintext (as opposed to binary)
+// } CBLLogFileConfiguration;
+type LogFileConfiguration struct {
+	Directory string ///< The directory to write logs to (UTF-8 encoded)
+	MaxRotateCount uint32 ///< The maximum number of *rotated* logs to keep (i.e. the total number of logs will be one more)
+	MaxSize uint64 ///< The max size to write to a log file before rotating (best-effort)
+	UsePlainText bool ///< Whether or not to log in plaintext (as opposed to binary)
+}
+
+/** A callback function for handling log messages
+	@param  level The level of the message being received
+	@param  domain The domain of the message being received
+	@param  message The message being received (UTF-8 encoded) */
+// typedef void(*CBLLogCallback)(CBLLogLevel level, CBLLogDomain domain, const char* message);
+type LogCallback func(level LogLevel, domain LogDomain, message string)
+
+var logState struct {
+	sync.RWMutex
+	callback LogCallback
+	directory *C.char // kept alive while it is the configured log directory
+}
+
+/** Gets the current log level for debug console logging */
+// CBLLogLevel CBLLog_ConsoleLevel();
+func ConsoleLevel() LogLevel {
+	return LogLevel(C.CBLLog_ConsoleLevel())
+}
+
+/** Sets the debug console log level */
+// void CBLLog_SetConsoleLevel(CBLLogLevel);
+func SetConsoleLevel(level LogLevel) {
+	C.CBLLog_SetConsoleLevel(C.CBLLogLevel(level))
+}
+
+/** Gets the current file logging config, or nil if file logging isn't configured. */
+// const CBLLogFileConfiguration* CBLLog_FileConfig();
+func LogFileConfig() *LogFileConfiguration {
+	c_config := C.CBLLog_FileConfig()
+	if c_config == nil {
+		return nil
+	}
+	config := LogFileConfiguration{
+		C.GoString(c_config.directory),
+		uint32(c_config.maxRotateCount),
+		uint64(c_config.maxSize),
+		bool(c_config.usePlaintext),
+	}
+	return &config
+}
+
+/** Sets the file logging configuration. Log files are rotated once they reach `MaxSize`
+    bytes, keeping `MaxRotateCount` old files. */
+// void CBLLog_SetFileConfig(CBLLogFileConfiguration);
+func SetLogFileConfig(config LogFileConfiguration) {
+	logState.Lock()
+	defer logState.Unlock()
+	c_dir := C.CString(config.Directory)
+	C.setLogFileConfig(c_dir, C.uint32_t(config.MaxRotateCount), C.size_t(config.MaxSize), C.bool(config.UsePlainText))
+	if logState.directory != nil {
+		C.free(unsafe.Pointer(logState.directory))
+	}
+	logState.directory = c_dir
+}
+
+/** Gets the current log callback, or nil if none is set. */
+// CBLLogCallback CBLLog_Callback();
+func GetLogCallback() LogCallback {
+	logState.RLock()
+	defer logState.RUnlock()
+	return logState.callback
+}
+
+/** Sets the callback for receiving log messages. Pass nil to remove it.
+    @warning  The callback may be called on arbitrary threads, and must not call back into
+              Couchbase Lite. */
+// void CBLLog_SetCallback(CBLLogCallback);
+func SetLogCallback(callback LogCallback) {
+	logState.Lock()
+	logState.callback = callback
+	logState.Unlock()
+	if callback != nil {
+		C.CBLLog_SetCallback((C.CBLLogCallback)(C.gatewayLogCallback))
+	} else {
+		C.CBLLog_SetCallback(nil)
+	}
+}
+
+/** The subset of zap's SugaredLogger used by \ref NewSugaredLogCallback. */
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+/** Returns a log callback that forwards messages to a zap SugaredLogger (or anything with the
+    same methods), with the domain in a "domain" field. Debug and verbose messages are logged
+    at debug level. */
+func NewSugaredLogCallback(logger SugaredLogger) LogCallback {
+	return func(level LogLevel, domain LogDomain, message string) {
+		switch level {
+		case LogDebug, LogVerbose:
+			logger.Debugw(message, "domain", domain.String())
+		case LogInfo:
+			logger.Infow(message, "domain", domain.String())
+		case LogWarning:
+			logger.Warnw(message, "domain", domain.String())
+		case LogError:
+			logger.Errorw(message, "domain", domain.String())
+		}
+	}
+}
+
+/** Returns a log callback that passes each message to `log` with its fields ("domain"), for
+    loggers built around field maps. With logrus:
+
+        SetLogCallback(NewFieldsLogCallback(func(level LogLevel, fields map[string]interface{}, message string) {
+            logger.WithFields(logrus.Fields(fields)).Log(logrusLevels[level], message)
+        }))
+ */
+func NewFieldsLogCallback(log func(level LogLevel, fields map[string]interface{}, message string)) LogCallback {
+	return func(level LogLevel, domain LogDomain, message string) {
+		log(level, map[string]interface{}{"domain": domain.String()}, message)
+	}
+}
+
+/** @} */
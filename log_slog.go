@@ -0,0 +1,30 @@
+//go:build go1.21
+// +build go1.21
+
+package cblcgo
+
+import "context"
+import "log/slog"
+
+/** Returns a log callback that forwards messages to an slog.Logger, with the domain in a
+    "domain" attribute. Verbose messages are logged at slog.LevelDebug, and debug messages
+    below it. */
+func NewSlogLogCallback(logger *slog.Logger) LogCallback {
+	return func(level LogLevel, domain LogDomain, message string) {
+		logger.LogAttrs(context.Background(), slogLevel(level), message, slog.String("domain", domain.String()))
+	}
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogDebug:
+		return slog.LevelDebug - 4
+	case LogVerbose:
+		return slog.LevelDebug
+	case LogInfo:
+		return slog.LevelInfo
+	case LogWarning:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
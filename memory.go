@@ -0,0 +1,81 @@
+package cblcgo
+/*
+#cgo LDFLAGS: -L. -lCouchbaseLiteC
+#include <stdlib.h>
+#include "include/CouchbaseLite.h"
+
+*/
+import "C"
+import "unsafe"
+
+/** \defgroup memory   C memory ownership
+    @{
+    Strings, buffers and structs passed to the C library are allocated with the C allocator and
+    must be freed by the bindings. The rules are:
+
+    - Memory that is only read during a call (names, paths, JSON, config structs of calls that
+      copy them) is allocated from a \ref cArena and freed when the call returns.
+    - Memory the C library keeps pointing to (a replicator's configuration and callback context)
+      is allocated from an arena owned by the Go object, and freed when that object is closed.
+    - Values returned by the C library are released with the matching `_Release`/`_Free`
+      function, except those documented as owned by their parent (a document's properties, a
+      blob's digest and content type, ...), which are never freed.
+ */
+
+// Collects C allocations so they can be freed together. The zero value is ready to use, and
+// Free may be called more than once.
+type cArena struct {
+	cleanups []func()
+}
+
+// Returns a C copy of s.
+func (a *cArena) CString(s string) *C.char {
+	c_str := C.CString(s)
+	a.Defer(func() { C.free(unsafe.Pointer(c_str)) })
+	return c_str
+}
+
+// Like CString, but returns NULL for an empty string, for optional C parameters.
+func (a *cArena) OptionalCString(s string) *C.char {
+	if len(s) == 0 {
+		return nil
+	}
+	return a.CString(s)
+}
+
+// Returns a C copy of b.
+func (a *cArena) CBytes(b []byte) unsafe.Pointer {
+	c_bytes := C.CBytes(b)
+	a.Defer(func() { C.free(c_bytes) })
+	return c_bytes
+}
+
+// Returns an FLSlice pointing to a C copy of b, or a null slice if b is empty.
+func (a *cArena) Slice(b []byte) C.FLSlice {
+	if len(b) == 0 {
+		return C.kFLSliceNull
+	}
+	return C.FLSlice{a.CBytes(b), C.size_t(len(b))}
+}
+
+// Returns size bytes of zeroed C memory.
+func (a *cArena) Calloc(size C.size_t) unsafe.Pointer {
+	ptr := C.calloc(1, size)
+	a.Defer(func() { C.free(ptr) })
+	return ptr
+}
+
+// Registers a function to be called by Free, such as the release of a Fleece collection.
+func (a *cArena) Defer(cleanup func()) {
+	a.cleanups = append(a.cleanups, cleanup)
+}
+
+// Frees everything allocated from the arena, most recent first.
+func (a *cArena) Free() {
+	for i := len(a.cleanups) - 1; i >= 0; i-- {
+		a.cleanups[i]()
+	}
+	a.cleanups = nil
+}
+
+/** @} */
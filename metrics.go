@@ -0,0 +1,383 @@
+package cblcgo
+
+import "expvar"
+import "fmt"
+import "io"
+import "math"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+/** \defgroup metrics   Metrics
+    @{
+    Counters and histograms describing database, query, blob and replication activity. Metrics
+    are off by default; create a collector with \ref NewMetrics and install it with
+    \ref EnableMetrics. The collector writes the Prometheus text format (it is an http.Handler
+    that can be mounted at `/metrics`) and can be published as an expvar, so neither requires a
+    dependency on a metrics library.
+
+    Metric                                    | Type      | Labels
+    ------------------------------------------|-----------|---------------------
+    cbl_documents_saved_total                 | counter   |
+    cbl_documents_deleted_total               | counter   |
+    cbl_documents_purged_total                | counter   |
+    cbl_batch_duration_seconds                | histogram |
+    cbl_query_compile_seconds                 | histogram | query
+    cbl_query_execute_seconds                 | histogram | query
+    cbl_query_rows_total                      | counter   | query
+    cbl_blob_read_bytes_total                 | counter   |
+    cbl_blob_written_bytes_total              | counter   |
+    cbl_replicator_documents_total            | counter   | replicator
+    cbl_replicator_errors_total               | counter   | replicator
+    cbl_replicator_activity_seconds_total     | counter   | replicator, activity
+    cbl_audit_entries_total                   | counter   |
+    cbl_audit_errors_total                    | counter   |
+
+    Queries are labelled with the name given to \ref Database.NewNamedQuery, and replicators
+    with `ReplicatorConfiguration.Name` (or their supervised name).
+ */
+
+/** Default histogram buckets, in seconds. */
+var DefaultMetricsBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricInfo struct {
+	help string
+	histogram bool
+}
+
+var metricInfos = map[string]metricInfo{
+	"cbl_documents_saved_total": {"Documents saved.", false},
+	"cbl_documents_deleted_total": {"Documents deleted.", false},
+	"cbl_documents_purged_total": {"Documents purged.", false},
+	"cbl_batch_duration_seconds": {"Duration of batch operations.", true},
+	"cbl_query_compile_seconds": {"Time spent compiling queries.", true},
+	"cbl_query_execute_seconds": {"Time spent executing queries.", true},
+	"cbl_query_rows_total": {"Query result rows read.", false},
+	"cbl_blob_read_bytes_total": {"Blob bytes read.", false},
+	"cbl_blob_written_bytes_total": {"Blob bytes written.", false},
+	"cbl_replicator_documents_total": {"Documents transferred by replicators.", false},
+	"cbl_replicator_errors_total": {"Errors replicators stopped or went offline with.", false},
+	"cbl_replicator_activity_seconds_total": {"Time replicators spent at each activity level.", false},
+	"cbl_audit_entries_total": {"Audit log entries written.", false},
+	"cbl_audit_errors_total": {"Changes the audit log failed to record.", false},
+}
+
+type histogram struct {
+	counts []uint64 // one per bucket, not cumulative
+	sum float64
+	count uint64
+}
+
+type replicatorMetricsState struct {
+	activity ReplicatorActivityLevel
+	since time.Time
+	documents uint64
+	err Error
+}
+
+/** Collects metrics. All methods are safe for concurrent use, and do nothing on a nil
+    collector. */
+type Metrics struct {
+	mu sync.Mutex
+	buckets []float64
+	counters map[string]map[string]float64 // name -> rendered labels -> value
+	histograms map[string]map[string]*histogram
+	replicators map[string]*replicatorMetricsState
+	now func() time.Time
+}
+
+/** Creates a collector. Histograms use `buckets` (upper bounds in seconds), or
+    \ref DefaultMetricsBuckets if none are given. */
+func NewMetrics(buckets ...float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultMetricsBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Metrics{
+		buckets: sorted,
+		counters: make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+		replicators: make(map[string]*replicatorMetricsState),
+		now: time.Now,
+	}
+}
+
+var metricsState struct {
+	sync.RWMutex
+	metrics *Metrics
+}
+
+/** Installs the collector that the bindings report to. Pass nil to turn metrics off. */
+func EnableMetrics(m *Metrics) {
+	metricsState.Lock()
+	metricsState.metrics = m
+	metricsState.Unlock()
+}
+
+/** Returns the installed collector, or nil if metrics are off. */
+func CurrentMetrics() *Metrics {
+	metricsState.RLock()
+	defer metricsState.RUnlock()
+	return metricsState.metrics
+}
+
+// Escapes a label value as the Prometheus text format requires: only backslashes, double
+// quotes and line feeds are escaped.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Renders label pairs ("name", "value", ...) in Prometheus syntax, without braces.
+func renderLabels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString("=")
+		b.WriteByte('"')
+		b.WriteString(labelValueEscaper.Replace(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func (m *Metrics) add(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.addLocked(name, value, renderLabels(labels...))
+	m.mu.Unlock()
+}
+
+func (m *Metrics) addLocked(name string, value float64, labels string) {
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]float64)
+		m.counters[name] = series
+	}
+	series[labels] += value
+}
+
+func (m *Metrics) observe(name string, value float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.histograms[name]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[name] = series
+	}
+	rendered := renderLabels(labels...)
+	h, ok := series[rendered]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		series[rendered] = h
+	}
+	for i, bound := range m.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (m *Metrics) observeDuration(name string, start time.Time, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.observe(name, time.Since(start).Seconds(), labels...)
+}
+
+/** Records a replicator status. Called by the bindings for replicators that have a change
+    listener or are supervised; call it from your own code to cover other replicators. The
+    document count, errors and time spent at each activity level are derived from successive
+    statuses of the same replicator. */
+func (m *Metrics) ObserveReplicatorStatus(name string, status ReplicatorStatus) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	labels := renderLabels("replicator", name)
+	state, ok := m.replicators[name]
+	if !ok {
+		state = &replicatorMetricsState{activity: status.Activity, since: now}
+		m.replicators[name] = state
+	}
+
+	elapsed := now.Sub(state.since).Seconds()
+	m.addLocked("cbl_replicator_activity_seconds_total", elapsed, renderLabels("replicator", name, "activity", state.activity.String()))
+	state.activity = status.Activity
+	state.since = now
+
+	// The document count restarts when the replicator is recreated.
+	count := status.Progress.DocumentCount
+	if count >= state.documents {
+		m.addLocked("cbl_replicator_documents_total", float64(count-state.documents), labels)
+	} else {
+		m.addLocked("cbl_replicator_documents_total", float64(count), labels)
+	}
+	state.documents = count
+
+	// The same error is reported by every status until it is cleared; count it once.
+	if status.Err.Code != 0 && status.Err != state.err {
+		m.addLocked("cbl_replicator_errors_total", 1, labels)
+	}
+	state.err = status.Err
+}
+
+/** A histogram's state in a \ref MetricsSnapshot. */
+type HistogramSnapshot struct {
+	Buckets map[string]uint64 ///< Cumulative counts keyed by upper bound ("+Inf" for all)
+	Sum float64
+	Count uint64
+}
+
+/** The values of all metrics, keyed by series (name and labels, e.g.
+    `cbl_query_rows_total{query="byName"}`). */
+type MetricsSnapshot struct {
+	Counters map[string]float64
+	Histograms map[string]HistogramSnapshot
+}
+
+func seriesName(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+/** Returns a copy of the current values. */
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{make(map[string]float64), make(map[string]HistogramSnapshot)}
+	if m == nil {
+		return snapshot
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, series := range m.counters {
+		for labels, value := range series {
+			snapshot.Counters[seriesName(name, labels)] = value
+		}
+	}
+	for name, series := range m.histograms {
+		for labels, h := range series {
+			buckets := make(map[string]uint64, len(m.buckets)+1)
+			var cumulative uint64
+			for i, bound := range m.buckets {
+				cumulative += h.counts[i]
+				buckets[formatBound(bound)] = cumulative
+			}
+			buckets["+Inf"] = h.count
+			snapshot.Histograms[seriesName(name, labels)] = HistogramSnapshot{buckets, h.sum, h.count}
+		}
+	}
+	return snapshot
+}
+
+/** Returns an expvar.Var whose value is the current \ref MetricsSnapshot. */
+func (m *Metrics) Var() expvar.Var {
+	return expvar.Func(func() interface{} { return m.Snapshot() })
+}
+
+/** Publishes the metrics with expvar under `name` (shown by /debug/vars). Like
+    expvar.Publish, it panics if the name is already in use. */
+func (m *Metrics) Publish(name string) {
+	expvar.Publish(name, m.Var())
+}
+
+func sortedKeys(series interface{}) []string {
+	var keys []string
+	switch s := series.(type) {
+	case map[string]float64:
+		for k := range s {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range s {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Adds a label to an already rendered label set.
+func withLabel(labels, name, value string) string {
+	label := renderLabels(name, value)
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+/** Writes all metrics in the Prometheus text exposition format. */
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		info := metricInfos[name]
+		if info.histogram {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, info.help, name)
+			series := m.histograms[name]
+			for _, labels := range sortedKeys(series) {
+				h := series[labels]
+				var cumulative uint64
+				for i, bound := range m.buckets {
+					cumulative += h.counts[i]
+					fmt.Fprintf(&b, "%s %d\n", seriesName(name+"_bucket", withLabel(labels, "le", formatBound(bound))), cumulative)
+				}
+				fmt.Fprintf(&b, "%s %d\n", seriesName(name+"_bucket", withLabel(labels, "le", "+Inf")), h.count)
+				fmt.Fprintf(&b, "%s %s\n", seriesName(name+"_sum", labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+				fmt.Fprintf(&b, "%s %d\n", seriesName(name+"_count", labels), h.count)
+			}
+		} else {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, info.help, name)
+			series := m.counters[name]
+			for _, labels := range sortedKeys(series) {
+				fmt.Fprintf(&b, "%s %s\n", seriesName(name, labels), strconv.FormatFloat(series[labels], 'g', -1, 64))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+/** Serves the metrics in the Prometheus text format. */
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WritePrometheus(w)
+}
+
+/** @} */
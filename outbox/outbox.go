@@ -0,0 +1,384 @@
+/**
+    Package outbox delivers a database's document changes to external systems.
+
+    An Outbox reads the database's changes feed (see cblcgo.ChangesConsumer) and records each
+    changed document as a pending delivery, stored in the database itself. Pending deliveries
+    are handed to a Publisher, retried with exponential backoff when it fails, and removed once
+    it succeeds. The changes feed checkpoint only moves after the deliveries are recorded, so a
+    change is delivered at least once even if the process stops at any point; receivers should
+    expect duplicates.
+
+    Several changes to a document that are still pending are delivered once, with the document's
+    body at the time of delivery.
+
+        box, err := outbox.New(db, outbox.NewWebhookPublisher("https://example.com/hook"), outbox.Options{})
+        go box.Run(ctx)
+ */
+package outbox
+
+import "context"
+import "errors"
+import "fmt"
+import "strings"
+import "sync"
+import "time"
+
+import cbl "github.com/svr4/couchbase-lite-cgo"
+
+/** Prefix of the IDs of the documents storing deliveries. */
+const EntryPrefix = "cblcgo:outbox:"
+
+var (
+	ErrNotFailed = errors.New("outbox: delivery is not failed")
+	ErrDeliveryNotFound = errors.New("outbox: delivery not found")
+)
+
+/** Delivery states. */
+const (
+	Pending = "pending"
+	Failed = "failed"
+)
+
+/** A document change handed to a Publisher. */
+type Message struct {
+	Outbox string `json:"outbox"`
+	DocumentID string `json:"docID"`
+	Sequence uint64 `json:"sequence"` ///< The sequence of Body, or of the deletion
+	Deleted bool `json:"deleted,omitempty"` ///< The document was deleted or purged; Body is nil
+	Body map[string]interface{} `json:"body,omitempty"`
+	Attempt int `json:"attempt"` ///< 1 for the first delivery attempt
+}
+
+/** Delivers messages. An error makes the outbox retry later, unless it is wrapped with
+    Permanent. */
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+/** Options for New. Zero values are replaced by the defaults noted on each field. */
+type Options struct {
+	Name string ///< Distinguishes outboxes of the same database (default "default")
+	BatchSize int ///< Changes read, and deliveries attempted, at a time (default 100)
+	PollInterval time.Duration ///< How often Run looks for changes (default 1s)
+	InitialBackoff time.Duration ///< Delay before the first retry (default 1s)
+	MaxBackoff time.Duration ///< Upper bound for the retry delay (default 5m)
+	MaxAttempts int ///< Attempts before a delivery is marked failed; 0 means unlimited
+	Filter func(docID string) bool ///< Documents to deliver; nil delivers all of them
+}
+
+/** The state of one document's delivery. */
+type Delivery struct {
+	DocumentID string
+	Sequence uint64
+	State string ///< Pending or Failed
+	Attempts int
+	NextAttempt time.Time
+	LastError string
+}
+
+/** Delivers the changes of a database to a Publisher. */
+type Outbox struct {
+	db *cbl.Database
+	publisher Publisher
+	options Options
+	consumer *cbl.ChangesConsumer
+	// Serializes Sync. Pending, Failed and Retry don't take it, so that they don't wait for a
+	// slow publisher.
+	syncing sync.Mutex
+}
+
+/** Creates an outbox, which resumes from where an outbox of the same name left off. Call Run,
+    or Sync periodically, to deliver changes. */
+func New(db *cbl.Database, publisher Publisher, options Options) (*Outbox, error) {
+	if options.Name == "" {
+		options.Name = "default"
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = time.Second
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = time.Second
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 5 * time.Minute
+	}
+	consumer, err := cbl.NewChangesConsumer(db, "outbox:"+options.Name)
+	if err != nil {
+		return nil, err
+	}
+	index := cbl.IndexSpec{Type: cbl.ValueIndex, KeyExpressionsJSON: `[[".type"],[".outbox"],[".state"],[".nextAttempt"]]`}
+	if !db.CreateIndex("cblcgo_outbox", index) {
+		return nil, cbl.ErrProblemCreatingIndex
+	}
+	return &Outbox{db: db, publisher: publisher, options: options, consumer: consumer}, nil
+}
+
+/** Calls Sync every poll interval until ctx is done, which is returned, or the database
+    fails. Publishing errors don't stop it. */
+func (o *Outbox) Run(ctx context.Context) error {
+	ticker := time.NewTicker(o.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := o.Sync(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+/** Records the changes made since the last call as pending deliveries, then attempts the
+    deliveries that are due. Returns the number of messages delivered. */
+func (o *Outbox) Sync(ctx context.Context) (int, error) {
+	o.syncing.Lock()
+	defer o.syncing.Unlock()
+	if _, err := o.consumer.ProcessChanges(o.options.BatchSize, o.enqueue); err != nil {
+		return 0, err
+	}
+	// Each delivery is attempted at most once per call, even if its retry falls due meanwhile.
+	attempted := make(map[string]bool)
+	delivered := 0
+	for ctx.Err() == nil {
+		ids, err := o.entryIDs(Pending, true)
+		if err != nil {
+			return delivered, err
+		}
+		fresh := 0
+		for _, id := range ids {
+			if ctx.Err() != nil || attempted[id] {
+				continue
+			}
+			attempted[id] = true
+			fresh++
+			ok, err := o.deliver(ctx, id)
+			if err != nil {
+				return delivered, err
+			}
+			if ok {
+				delivered++
+			}
+		}
+		if fresh == 0 {
+			return delivered, nil
+		}
+	}
+	return delivered, ctx.Err()
+}
+
+// Records a batch of changes as pending deliveries.
+func (o *Outbox) enqueue(changes []cbl.DocumentChange) error {
+	o.db.BeginBatch()
+	defer o.db.EndBatch()
+	for _, change := range changes {
+		if strings.HasPrefix(change.ID, EntryPrefix) {
+			continue
+		}
+		if o.options.Filter != nil && !o.options.Filter(change.ID) {
+			continue
+		}
+		entry, err := o.db.GetMutableDocument(o.entryID(change.ID))
+		if err != nil {
+			entry = cbl.NewDocumentWithId(o.entryID(change.ID))
+		}
+		entry.Props["type"] = "outbox"
+		entry.Props["outbox"] = o.options.Name
+		entry.Props["docID"] = change.ID
+		entry.Props["sequence"] = change.Sequence
+		entry.Props["deleted"] = change.Deleted
+		entry.Props["state"] = Pending
+		entry.Props["attempts"] = 0
+		entry.Props["nextAttempt"] = int64(0)
+		entry.Props["lastError"] = ""
+		_, err = o.db.Save(entry, cbl.LastWriteWins)
+		entry.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) entryID(docID string) string {
+	return EntryPrefix + o.options.Name + ":" + docID
+}
+
+// Returns the IDs of the entries in a state, oldest change first. With `due`, only one batch
+// of the entries due to be attempted now.
+func (o *Outbox) entryIDs(state string, due bool) ([]string, error) {
+	query_string := "SELECT meta().id WHERE type = 'outbox' AND outbox = $name AND state = $state"
+	parameters := map[string]interface{}{"name": o.options.Name, "state": state}
+	if due {
+		query_string += " AND nextAttempt <= $now ORDER BY sequence LIMIT $limit"
+		parameters["now"] = time.Now().UnixNano()
+		parameters["limit"] = o.options.BatchSize
+	} else {
+		query_string += " ORDER BY sequence"
+	}
+	query, err := o.db.NewQuery(cbl.N1QLLanguage, query_string)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+	if err := query.SetParameters(parameters); err != nil {
+		return nil, err
+	}
+	results, err := query.Execute()
+	if err != nil {
+		return nil, err
+	}
+	defer results.Release()
+	var ids []string
+	for results.Next() {
+		if id, ok := results.ValueAtIndex(0).(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Attempts one delivery. Returns true if the message was published.
+func (o *Outbox) deliver(ctx context.Context, entryID string) (bool, error) {
+	entry, err := o.db.GetMutableDocument(entryID)
+	if err != nil {
+		return false, nil // delivered or retried meanwhile
+	}
+	defer entry.Close()
+	delivery := deliveryFromProps(entry.Props)
+
+	msg := Message{
+		Outbox: o.options.Name,
+		DocumentID: delivery.DocumentID,
+		Sequence: delivery.Sequence,
+		Attempt: delivery.Attempts + 1,
+	}
+	if doc, err := o.db.GetReadOnlyDocument(delivery.DocumentID); err == nil {
+		msg.Sequence = doc.DocumentSequence()
+		msg.Body = doc.Props
+		defer doc.Close()
+	} else if gone, gone_err := o.isGone(delivery.DocumentID); gone_err != nil {
+		return false, gone_err
+	} else if !gone {
+		// Not a deletion; retry it like a failed delivery.
+		return false, o.attemptFailed(entry, delivery, fmt.Errorf("outbox: reading %s: %w", delivery.DocumentID, err))
+	} else {
+		msg.Deleted = true
+	}
+
+	if err := o.publisher.Publish(ctx, msg); err != nil {
+		return false, o.attemptFailed(entry, delivery, err)
+	}
+	return true, o.db.PurgeById(entryID)
+}
+
+// Records a failed attempt, scheduling a retry or marking the delivery failed.
+func (o *Outbox) attemptFailed(entry *cbl.Document, delivery Delivery, err error) error {
+	delivery.Attempts++
+	entry.Props["attempts"] = delivery.Attempts
+	entry.Props["lastError"] = err.Error()
+	if IsPermanent(err) || (o.options.MaxAttempts > 0 && delivery.Attempts >= o.options.MaxAttempts) {
+		entry.Props["state"] = Failed
+	} else {
+		entry.Props["nextAttempt"] = time.Now().Add(o.backoff(delivery.Attempts)).UnixNano()
+	}
+	_, err = o.db.Save(entry, cbl.LastWriteWins)
+	return err
+}
+
+// Returns true if a document that can't be read is deleted or purged, rather than failing to
+// be read; Couchbase Lite reports both as a missing document.
+func (o *Outbox) isGone(docID string) (bool, error) {
+	it, err := o.db.AllDocuments(cbl.AllDocumentsOptions{StartKey: docID, EndKey: docID, IncludeDeleted: true})
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	if it.Next() {
+		return it.Handle().Deleted, nil
+	}
+	return true, it.Err()
+}
+
+// Returns the delay before the next attempt, after `attempts` failed ones.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.options.InitialBackoff
+	for i := 1; i < attempts && delay < o.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.options.MaxBackoff {
+		delay = o.options.MaxBackoff
+	}
+	return delay
+}
+
+/** Returns the deliveries waiting to be attempted or retried. */
+func (o *Outbox) Pending() ([]Delivery, error) {
+	return o.deliveries(Pending)
+}
+
+/** Returns the deliveries that failed permanently or ran out of attempts. */
+func (o *Outbox) Failed() ([]Delivery, error) {
+	return o.deliveries(Failed)
+}
+
+func (o *Outbox) deliveries(state string) ([]Delivery, error) {
+	ids, err := o.entryIDs(state, false)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []Delivery
+	for _, id := range ids {
+		if entry, err := o.db.GetReadOnlyDocument(id); err == nil {
+			deliveries = append(deliveries, deliveryFromProps(entry.Props))
+			entry.Close()
+		}
+	}
+	return deliveries, nil
+}
+
+/** Makes a failed delivery pending again, to be attempted by the next Sync. */
+func (o *Outbox) Retry(docID string) error {
+	entry, err := o.db.GetMutableDocument(o.entryID(docID))
+	if err != nil {
+		return ErrDeliveryNotFound
+	}
+	defer entry.Close()
+	if entry.Props["state"] != Failed {
+		return ErrNotFailed
+	}
+	entry.Props["state"] = Pending
+	entry.Props["attempts"] = 0
+	entry.Props["nextAttempt"] = int64(0)
+	_, err = o.db.Save(entry, cbl.LastWriteWins)
+	return err
+}
+
+func deliveryFromProps(props map[string]interface{}) Delivery {
+	delivery := Delivery{}
+	delivery.DocumentID, _ = props["docID"].(string)
+	delivery.Sequence = uint64(intProp(props["sequence"]))
+	delivery.State, _ = props["state"].(string)
+	delivery.Attempts = int(intProp(props["attempts"]))
+	if next := intProp(props["nextAttempt"]); next > 0 {
+		delivery.NextAttempt = time.Unix(0, next)
+	}
+	delivery.LastError, _ = props["lastError"].(string)
+	return delivery
+}
+
+func intProp(value interface{}) int64 {
+	switch value := value.(type) {
+	case int64:
+		return value
+	case uint64:
+		return int64(value)
+	case int:
+		return int64(value)
+	}
+	return 0
+}
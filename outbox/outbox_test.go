@@ -0,0 +1,189 @@
+package outbox
+
+import "context"
+import "encoding/json"
+import "errors"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "sync"
+import "testing"
+import "time"
+
+import cbl "github.com/svr4/couchbase-lite-cgo"
+
+func openTestDatabase(t *testing.T) (*cbl.Database, func()) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config cbl.DatabaseConfiguration
+	config.Directory = dir
+	config.Flags = cbl.Database_Create
+	db, err := cbl.Open("outbox", &config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func saveTestDocument(t *testing.T, db *cbl.Database, id string, value interface{}) {
+	doc, err := db.GetMutableDocument(id)
+	if err != nil {
+		doc = cbl.NewDocumentWithId(id)
+	}
+	defer doc.Close()
+	doc.Props["value"] = value
+	if _, err := db.Save(doc, cbl.LastWriteWins); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	db, done := openTestDatabase(t)
+	defer done()
+	ctx := context.Background()
+	options := Options{BatchSize: 2, InitialBackoff: 10 * time.Millisecond, MaxAttempts: 3}
+
+	publisher := NewMemoryPublisher()
+	flaky := errors.New("unavailable")
+	publisher.Fail = func(msg Message) error {
+		if msg.DocumentID == "b" && msg.Attempt == 1 {
+			return flaky
+		}
+		if msg.DocumentID == "c" {
+			return Permanent(errors.New("rejected"))
+		}
+		return nil
+	}
+	box, err := New(db, publisher, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		saveTestDocument(t, db, id, id)
+	}
+
+	if delivered, err := box.Sync(ctx); err != nil || delivered != 1 {
+		t.Fatalf("Expected 1 delivery, got %d, error %v", delivered, err)
+	}
+	pending, _ := box.Pending()
+	if len(pending) != 1 || pending[0].DocumentID != "b" || pending[0].Attempts != 1 || pending[0].LastError != "unavailable" {
+		t.Errorf("Unexpected pending deliveries %+v", pending)
+	}
+	failed, _ := box.Failed()
+	if len(failed) != 1 || failed[0].DocumentID != "c" {
+		t.Errorf("Unexpected failed deliveries %+v", failed)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if delivered, err := box.Sync(ctx); err != nil || delivered != 1 {
+		t.Fatalf("Expected the retry to be delivered, got %d, error %v", delivered, err)
+	}
+	messages := publisher.Messages()
+	if len(messages) != 2 || messages[0].DocumentID != "a" || messages[1].DocumentID != "b" ||
+		messages[1].Attempt != 2 || messages[1].Body["value"] != "b" {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+
+	// A new outbox with the same name resumes after the delivered changes.
+	publisher.Fail = nil
+	box, err = New(db, publisher, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivered, err := box.Sync(ctx); err != nil || delivered != 0 {
+		t.Errorf("Expected no deliveries after resuming, got %d, error %v", delivered, err)
+	}
+	if err := box.Retry("a"); err != ErrDeliveryNotFound {
+		t.Errorf("Expected ErrDeliveryNotFound, got %v", err)
+	}
+	if err := box.Retry("c"); err != nil {
+		t.Fatal(err)
+	}
+	saveTestDocument(t, db, "a", "changed")
+	doc, _ := db.GetMutableDocument("b")
+	db.DeleteDocument(doc, cbl.LastWriteWins)
+	doc.Close()
+	if delivered, err := box.Sync(ctx); err != nil || delivered != 3 {
+		t.Errorf("Expected 3 deliveries, got %d, error %v", delivered, err)
+	}
+	messages = publisher.Messages()[2:]
+	seen := make(map[string]Message)
+	for _, msg := range messages {
+		seen[msg.DocumentID] = msg
+	}
+	if seen["a"].Body["value"] != "changed" || !seen["b"].Deleted || seen["c"].Body["value"] != "c" {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+	if pending, _ := box.Pending(); len(pending) != 0 {
+		t.Errorf("Expected no pending deliveries, got %+v", pending)
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var mu sync.Mutex
+	var received []Message
+	var keys []string
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var msg Message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			received = append(received, msg)
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+		}
+	}))
+	defer server.Close()
+
+	publisher := NewWebhookPublisher(server.URL)
+	publisher.Header = http.Header{"Authorization": {"Bearer token"}}
+	msg := Message{Outbox: "default", DocumentID: "doc", Sequence: 7, Body: map[string]interface{}{"value": 1}}
+	err := publisher.Publish(context.Background(), msg)
+	if status_err, ok := err.(*StatusError); !ok || status_err.StatusCode != http.StatusServiceUnavailable || IsPermanent(err) {
+		t.Errorf("Expected a retryable StatusError, got %v", err)
+	}
+
+	mu.Lock()
+	status = http.StatusForbidden
+	mu.Unlock()
+	if err := publisher.Publish(context.Background(), msg); !IsPermanent(err) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	if err := publisher.Publish(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(received) != 1 || received[0].DocumentID != "doc" || received[0].Body["value"] != 1.0 || keys[0] != "doc@7" {
+		t.Errorf("Unexpected requests %+v %v", received, keys)
+	}
+
+	// Delivered through an outbox.
+	db, done := openTestDatabase(t)
+	defer done()
+	box, err := New(db, publisher, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTestDocument(t, db, "hooked", "yes")
+	if delivered, err := box.Sync(context.Background()); err != nil || delivered != 1 {
+		t.Errorf("Expected 1 delivery, got %d, error %v", delivered, err)
+	}
+	if len(received) != 2 || received[1].DocumentID != "hooked" || received[1].Body["value"] != "yes" {
+		t.Errorf("Unexpected requests %+v", received)
+	}
+}
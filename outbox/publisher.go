@@ -0,0 +1,141 @@
+package outbox
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "strconv"
+import "sync"
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+/** Wraps a Publisher error to mark the delivery failed instead of retrying it. */
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+/** Returns true if err, or an error it wraps, was wrapped with Permanent. */
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+/** Keeps published messages in memory, for tests and for handing changes to other goroutines. */
+type MemoryPublisher struct {
+	/** If set, called before a message is kept; an error fails the delivery. */
+	Fail func(msg Message) error
+	mu sync.Mutex
+	messages []Message
+}
+
+/** Returns an empty publisher that accepts every message. */
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Fail != nil {
+		if err := p.Fail(msg); err != nil {
+			return err
+		}
+	}
+	// Detach the body from the document, which is released after publishing.
+	if msg.Body != nil {
+		text, err := json.Marshal(msg.Body)
+		if err != nil {
+			return Permanent(err)
+		}
+		msg.Body = nil
+		if err := json.Unmarshal(text, &msg.Body); err != nil {
+			return Permanent(err)
+		}
+	}
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+/** Returns the messages published so far. */
+func (p *MemoryPublisher) Messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Message(nil), p.messages...)
+}
+
+/** Returned by WebhookPublisher for responses other than 2xx. */
+type StatusError struct {
+	StatusCode int
+	Body string ///< The start of the response body
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("outbox: webhook returned %d %s", e.StatusCode, e.Body)
+}
+
+/** Posts each message as JSON to a URL. The request carries an `Idempotency-Key` header,
+    DOCID@SEQUENCE, so that receivers can discard duplicates. Responses 2xx are successes;
+    other 4xx responses, except 408 and 429, fail the delivery permanently, and everything else
+    is retried. */
+type WebhookPublisher struct {
+	URL string
+	Client *http.Client ///< http.DefaultClient if nil
+	Header http.Header ///< Added to every request, for instance for authorization
+}
+
+/** Returns a publisher posting to url with http.DefaultClient. */
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{URL: url}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return Permanent(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req = req.WithContext(ctx)
+	for key, values := range p.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.DocumentID+"@"+strconv.FormatUint(msg.Sequence, 10))
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	status_err := &StatusError{resp.StatusCode, string(text)}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(status_err)
+	}
+	return status_err
+}
@@ -0,0 +1,495 @@
+package cblcgo
+
+import "encoding/json"
+import "fmt"
+import "math"
+import "reflect"
+import "sort"
+import "strconv"
+import "strings"
+
+/** \defgroup patches   Patches
+    @{
+    Document diffs as RFC 6902 JSON Patch operations. \ref DiffDocuments computes the operations
+    turning one document's properties into another's, \ref Document.ApplyPatch applies them to a
+    mutable document, and \ref Database.PatchDocument applies them to a saved document, retrying
+    when another writer gets there first.
+
+    A \ref Patch marshals to and from standard JSON Patch, so it can come straight from a
+    request body or go into a log:
+
+        var patch cblcgo.Patch
+        if err := json.NewDecoder(r.Body).Decode(&patch); err != nil { ... }
+        doc, err := db.PatchDocument(id, patch, cblcgo.FailOnConflict)
+ */
+
+/** Patch operation names. */
+const (
+	PatchAdd = "add"
+	PatchRemove = "remove"
+	PatchReplace = "replace"
+	PatchMove = "move"
+	PatchCopy = "copy"
+	PatchTest = "test"
+)
+
+/** One JSON Patch operation. Path and From are JSON pointers into the document's properties;
+    From is only used by "move" and "copy", and Value only by "add", "replace" and "test". */
+type PatchOperation struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	From string `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+/** A sequence of operations, applied in order. */
+type Patch []PatchOperation
+
+/** Marshals the operation, writing "value" (even when null) only for operations that use it. */
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	type operation struct {
+		Op string `json:"op"`
+		Path string `json:"path"`
+		From string `json:"from,omitempty"`
+	}
+	if op.Op != PatchAdd && op.Op != PatchReplace && op.Op != PatchTest {
+		return json.Marshal(operation{op.Op, op.Path, op.From})
+	}
+	return json.Marshal(struct {
+		operation
+		Value interface{} `json:"value"`
+	}{operation{op.Op, op.Path, op.From}, op.Value})
+}
+
+/** Returns the operations that turn a's properties into b's. Nested dictionaries are diffed key
+    by key; arrays and other values that differ are replaced whole. Keys are visited in sorted
+    order, so equal inputs always give the same patch. Blobs are equal when their digests are. */
+func DiffDocuments(a, b *Document) Patch {
+	return diffProperties(a.Props, b.Props)
+}
+
+func diffProperties(a, b map[string]interface{}) Patch {
+	patch := Patch{}
+	diffDicts(&patch, "", normalizePatchValue(a).(map[string]interface{}),
+		normalizePatchValue(b).(map[string]interface{}))
+	return patch
+}
+
+func diffDicts(patch *Patch, path string, a, b map[string]interface{}) {
+	keys := make([]string, 0, len(a) + len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		key_path := path + "/" + escapePointerToken(key)
+		old_value, in_a := a[key]
+		new_value, in_b := b[key]
+		switch {
+		case !in_b:
+			*patch = append(*patch, PatchOperation{Op: PatchRemove, Path: key_path})
+		case !in_a:
+			*patch = append(*patch, PatchOperation{Op: PatchAdd, Path: key_path, Value: new_value})
+		default:
+			old_dict, old_is_dict := old_value.(map[string]interface{})
+			new_dict, new_is_dict := new_value.(map[string]interface{})
+			if old_is_dict && new_is_dict {
+				diffDicts(patch, key_path, old_dict, new_dict)
+			} else if !patchValuesEqual(old_value, new_value) {
+				*patch = append(*patch, PatchOperation{Op: PatchReplace, Path: key_path, Value: new_value})
+			}
+		}
+	}
+}
+
+/** Applies a patch to a mutable document's Props. The operations are applied to a copy, so if
+    one fails (ErrInvalidPatch for a bad operation or path, ErrPatchTestFailed for a failed
+    "test") Props is left unchanged. As with any change to Props, the document must then be
+    saved. Returns ErrDocumentEditedInPlace if \ref Document.MutableProperties was called
+    since the document was last saved, since Props would then be overwritten. */
+func (doc *Document) ApplyPatch(patch Patch) error {
+	if doc.ReadOnly {
+		return ErrDocumentIsReadOnly
+	}
+	if doc.fleeceEdited {
+		return ErrDocumentEditedInPlace
+	}
+	props, err := applyPatch(doc.Props, patch)
+	if err != nil {
+		return err
+	}
+	doc.Props = props
+	return nil
+}
+
+// Returns a patched copy of props.
+func applyPatch(props map[string]interface{}, patch Patch) (map[string]interface{}, error) {
+	var root interface{} = normalizePatchValue(props)
+	for i, op := range patch {
+		var err error
+		if root, err = applyPatchOperation(root, op); err != nil {
+			return nil, fmt.Errorf("%w (operation %d, %s %s)", err, i, op.Op, op.Path)
+		}
+	}
+	patched, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: document properties must be a dictionary", ErrInvalidPatch)
+	}
+	return patched, nil
+}
+
+// How many times PatchDocument re-reads and re-applies a patch after a conflict.
+const patchDocumentRetries = 10
+
+// Called by PatchDocument between reading and saving the document; tests use it to simulate a
+// concurrent writer.
+var patchDocumentBeforeSave func(docId string)
+
+/** Applies a patch to the saved document with the given ID and saves it, returning the saved
+    document. With \ref FailOnConflict, a save that conflicts with another writer is retried on
+    the newer revision, up to a limit after which ErrDocumentConflict is returned; a patch whose
+    "test" operations no longer hold fails with ErrPatchTestFailed instead. With
+    \ref LastWriteWins the patch is applied to the current revision and saved once. */
+func (db *Database) PatchDocument(docId string, patch Patch, concurrency ConcurrencyControl) (*Document, error) {
+	for attempt := 0; ; attempt++ {
+		doc, err := db.GetMutableDocument(docId)
+		if err != nil {
+			return nil, err
+		}
+		if err := doc.ApplyPatch(patch); err != nil {
+			doc.Release()
+			return nil, err
+		}
+		if patchDocumentBeforeSave != nil {
+			patchDocumentBeforeSave(docId)
+		}
+		saved, err := db.Save(doc, concurrency)
+		if err == nil {
+			return saved, nil
+		}
+		doc.Release()
+		if err != ErrDocumentConflict || attempt == patchDocumentRetries {
+			return nil, err
+		}
+	}
+}
+
+func applyPatchOperation(root interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case PatchAdd:
+		return patchAdd(root, path, normalizePatchValue(op.Value))
+	case PatchRemove:
+		root, _, err = patchRemove(root, path)
+		return root, err
+	case PatchReplace:
+		if _, err := patchGet(root, path); err != nil {
+			return nil, err
+		}
+		return patchSet(root, path, normalizePatchValue(op.Value))
+	case PatchMove:
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) > len(from) && pointerHasPrefix(path, from) {
+			return nil, fmt.Errorf("%w: can't move %q into itself", ErrInvalidPatch, op.From)
+		}
+		root, value, err := patchRemove(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(root, path, value)
+	case PatchCopy:
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := patchGet(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return patchAdd(root, path, normalizePatchValue(value))
+	case PatchTest:
+		value, err := patchGet(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !patchValuesEqual(value, normalizePatchValue(op.Value)) {
+			return nil, ErrPatchTestFailed
+		}
+		return root, nil
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, op.Op)
+}
+
+// Splits a JSON pointer into its unescaped reference tokens. "" refers to the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: pointer %q doesn't start with /", ErrInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func escapePointerToken(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+func pointerHasPrefix(path, prefix []string) bool {
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses an array index token. "-" (past the end) is only allowed when adding.
+func parseArrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') || token[0] == '+' {
+		return 0, fmt.Errorf("%w: invalid array index %q", ErrInvalidPatch, token)
+	}
+	if index > length || (index == length && !adding) {
+		return 0, fmt.Errorf("%w: array index %d out of range", ErrInvalidPatch, index)
+	}
+	return index, nil
+}
+
+func patchGet(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := node.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: no such key %q", ErrInvalidPatch, token)
+			}
+			node = value
+		case []interface{}:
+			index, err := parseArrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			node = container[index]
+		default:
+			return nil, fmt.Errorf("%w: %q is not in a dictionary or array", ErrInvalidPatch, token)
+		}
+	}
+	return node, nil
+}
+
+// Calls fn with the container holding the last token of path and that token, replacing the
+// container with the one fn returns. Returns the new root.
+func patchUpdate(node interface{}, path []string,
+	fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(node, path[0])
+	}
+	child, err := patchGet(node, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = patchUpdate(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	if array, ok := node.([]interface{}); ok {
+		index, _ := strconv.Atoi(path[0])
+		array[index] = child
+		return array, nil
+	}
+	node.(map[string]interface{})[path[0]] = child
+	return node, nil
+}
+
+func patchAdd(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := parseArrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("%w: %q is not in a dictionary or array", ErrInvalidPatch, token)
+	})
+}
+
+func patchSet(root interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		if array, ok := container.([]interface{}); ok {
+			index, _ := parseArrayIndex(token, len(array), false)
+			array[index] = value
+			return array, nil
+		}
+		container.(map[string]interface{})[token] = value
+		return container, nil
+	})
+}
+
+// Removes the value at path, returning the new root and the removed value.
+func patchRemove(root interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+	removed, err := patchGet(root, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err = patchUpdate(root, path, func(container interface{}, token string) (interface{}, error) {
+		if array, ok := container.([]interface{}); ok {
+			index, _ := parseArrayIndex(token, len(array), false)
+			return append(array[:index], array[index+1:]...), nil
+		}
+		delete(container.(map[string]interface{}), token)
+		return container, nil
+	})
+	return root, removed, err
+}
+
+// Deep-copies a property value into the shapes a patch works on: map[string]interface{} for
+// dictionaries and []interface{} for arrays. Other values, including blobs and []byte, are
+// kept as they are.
+func normalizePatchValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		dict := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			dict[key] = normalizePatchValue(item)
+		}
+		return dict
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			array[i] = normalizePatchValue(item)
+		}
+		return array
+	case []byte, *Blob:
+		return value
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return value
+		}
+		dict := make(map[string]interface{}, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			dict[iter.Key().String()] = normalizePatchValue(iter.Value().Interface())
+		}
+		return dict
+	case reflect.Slice, reflect.Array:
+		array := make([]interface{}, rv.Len())
+		for i := range array {
+			array[i] = normalizePatchValue(rv.Index(i).Interface())
+		}
+		return array
+	}
+	return value
+}
+
+// Compares two normalized values. Numbers compare by value whatever their Go type, so that
+// an int set by the caller equals the int64 read back from the database.
+func patchValuesEqual(a, b interface{}) bool {
+	if a_num, ok := patchNumber(a); ok {
+		b_num, ok := patchNumber(b)
+		return ok && a_num == b_num
+	}
+	switch a := a.(type) {
+	case *Blob:
+		b, ok := b.(*Blob)
+		return ok && a.Digest() == b.Digest()
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, item := range a {
+			other, ok := b[key]
+			if !ok || !patchValuesEqual(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !patchValuesEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Returns a canonical string for a number: the decimal integer if it has an exact integral
+// value, and otherwise the shortest float representation.
+func patchNumber(value interface{}) (string, bool) {
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(rv.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f == math.Trunc(f) && math.Abs(f) < 1 << 63 {
+			return strconv.FormatInt(int64(f), 10), true
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	if number, ok := value.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), true
+		}
+		if u, err := strconv.ParseUint(string(number), 10, 64); err == nil {
+			return strconv.FormatUint(u, 10), true
+		}
+		if f, err := number.Float64(); err == nil {
+			return patchNumber(f)
+		}
+	}
+	return "", false
+}
+
+/** @} */
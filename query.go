@@ -16,6 +16,12 @@ import "C"
 import "unsafe"
 import "fmt"
 import "context"
+import "encoding/json"
+import "runtime"
+import "sync"
+import "time"
+
+import "github.com/svr4/couchbase-lite-cgo/fleece"
 
 /** \defgroup queries   Queries
     @{
@@ -43,10 +49,28 @@ const (
 
 type Query struct {
 	q *C.CBLQuery
+	name string // labels the query's metrics
+	db *Database // nil for queries handed to listeners
+	inflight sync.WaitGroup // executions abandoned by ExecuteContext
 }
 
 type ResultSet struct {
 	rs *C.CBLResultSet
+	query string // name of the query, for metrics
+	columns []string
+	rows int
+	span Span // set by ExecuteContext; ended when the results are exhausted or released
+	ctx context.Context // set by ExecuteContext; iteration stops when it is done
+	err error
+	materialized []Result // set by Materialize
+	pos int // index of the current materialized result
+}
+
+/** One result of a query, with its values decoded into Go values (as in \ref Document.Props).
+    Blobs in a result belong to its result set, and are only valid until it is closed. */
+type Result struct {
+	columns []string
+	values []interface{}
 }
 
 
@@ -75,6 +99,25 @@ type ResultSet struct {
 //                        int *outErrorPos,
 //                        CBLError* error) CBLAPI;
 func (db *Database) NewQuery(language QueryLanguage, queryString string) (*Query, error) {
+	query, err := db.newQuery("", language, queryString)
+	if err == nil {
+		trackQuery(query, queryString)
+	}
+	return query, err
+}
+
+/** Same as \ref Database.NewQuery, but the query's compile and execute times and row counts
+    are recorded in metrics under `name`. */
+func (db *Database) NewNamedQuery(name string, language QueryLanguage, queryString string) (*Query, error) {
+	query, err := db.newQuery(name, language, queryString)
+	if err == nil {
+		trackQuery(query, queryString)
+	}
+	return query, err
+}
+
+func (db *Database) newQuery(name string, language QueryLanguage, queryString string) (*Query, error) {
+	start := time.Now()
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
   outErrorPos := (*C.int)(C.malloc(C.sizeof_int))
@@ -83,16 +126,45 @@ func (db *Database) NewQuery(language QueryLanguage, queryString string) (*Query
 	c_query := C.CBLQuery_New(db.db, C.CBLQueryLanguage(language), c_query_str, outErrorPos, err)
 	C.free(unsafe.Pointer(c_query_str))
 	if (*err).code == 0 {
-		query := Query{c_query}
+		CurrentMetrics().observeDuration("cbl_query_compile_seconds", start, "query", name)
+		query := Query{q: c_query, name: name, db: db}
 		return &query, nil
 	}
 	ErrProblemPreparingQuery = fmt.Errorf("CBL: Problem Preparing Query. Domain: %d Code: %d", (*err).domain, (*err).code)
 	return nil, ErrProblemPreparingQuery
 }
 
+/** Releases the query. Calling it more than once is harmless. */
+func (q *Query) Close() error {
+	if q.q == nil {
+		return nil
+	}
+	// Let executions abandoned by their context finish first.
+	q.inflight.Wait()
+	untrackObject(unsafe.Pointer(q.q))
+	C.CBLQuery_Release(q.q)
+	q.q = nil
+	runtime.SetFinalizer(q, nil)
+	return nil
+}
+
+/** Same as \ref Query.Close. */
 func (q *Query) Release() bool {
-  C.CBLQuery_Release(q.q)
-  return true
+	q.Close()
+	return true
+}
+
+// Starts tracking a query created for the caller.
+func trackQuery(q *Query, queryString string) {
+	trackObject(unsafe.Pointer(q.q), "Query", queryString)
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(q, (*Query).finalize)
+	}
+}
+
+func (q *Query) finalize() {
+	reportLeak(unsafe.Pointer(q.q))
+	q.Close()
 }
 //CBL_REFCOUNTED(CBLQuery*, Query);
 
@@ -110,14 +182,13 @@ func (q *Query) Release() bool {
 //void CBLQuery_SetParameters(CBLQuery* _cbl_nonnull query,
 							//FLDict _cbl_nonnull parameters) CBLAPI;
 func (q *Query) SetParameters(parameters map[string]interface{}) error {
-	mutable_dict := C.FLMutableDict_New()
-
-	for key, val := range parameters {
-		c_key := C.CString(key)
-		v_slot := C.FLMutableDict_Set(mutable_dict, C.FLStr(c_key))
-		storeGoValueInSlot(v_slot, val)
+	mutable_dict, err := fleece.NewMutableDictFromMap(parameters)
+	if err != nil {
+		return err
 	}
-  C.CBLQuery_SetParameters(q.q, mutable_dict)  
+	// The query keeps its own copy of the parameters.
+	C.CBLQuery_SetParameters(q.q, C.FLDict(mutable_dict.CPointer()))
+	mutable_dict.Release()
 	return nil
 }
 
@@ -153,11 +224,14 @@ func (q *Query) SetParametersASJSON(json string) bool {
 // _cbl_warn_unused
 // CBLResultSet* CBLQuery_Execute(CBLQuery* _cbl_nonnull, CBLError*) CBLAPI;
 func (q *Query) Execute() (*ResultSet, error) {
+	start := time.Now()
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_result_set := C.CBLQuery_Execute(q.q, err)
 	if (*err).code == 0 {
-		results := ResultSet{c_result_set}
+		CurrentMetrics().observeDuration("cbl_query_execute_seconds", start, "query", q.name)
+		results := ResultSet{rs: c_result_set, query: q.name, columns: q.columnNames()}
+		trackResultSet(&results)
 		return &results, nil
   }
   c_err_msg := C.CBLError_Message(err)
@@ -197,6 +271,14 @@ func (q *Query) ColumnNameAt(columnIndex uint) string {
 	return col
 }
 
+func (q *Query) columnNames() []string {
+	columns := make([]string, q.ColumnCount())
+	for i := range columns {
+		columns[i] = q.ColumnNameAt(uint(i))
+	}
+	return columns
+}
+
 /** @} */
 
 
@@ -209,23 +291,127 @@ func (q *Query) ColumnNameAt(columnIndex uint) string {
 
     It's important to note that the initial position of the iterator is _before_ the first
     result, so \ref CBLResultSet_Next must be called _first_.
+
+    Result sets are read like `database/sql` rows. Close them when done; blobs in their results
+    stay valid until then:
+
+        results, err := query.Execute()
+        if err != nil { ... }
+        defer results.Close()
+        for results.Next() {
+            row := results.Row()
+            fmt.Println(row.ValueForKey("name"))
+        }
+        if err := results.Err(); err != nil { ... }
  */
 
 /** Moves the result-set iterator to the next result.
-    Returns false if there are no more results.
+    Returns false if there are no more results, or if the context given to \ref
+    Query.ExecuteContext is done (see \ref ResultSet.Err). The result set stays allocated until
+    it is closed.
     @warning This must be called _before_ examining the first result. */
 // bool CBLResultSet_Next(CBLResultSet* _cbl_nonnull) CBLAPI;
 func (res *ResultSet) Next() bool {
+	if res.materialized != nil {
+		if res.pos + 1 < len(res.materialized) {
+			res.pos++
+			return true
+		}
+		res.pos = len(res.materialized)
+		return false
+	}
+	return res.step()
+}
+
+// Moves the C result set to the next result, ending the span at the end.
+func (res *ResultSet) step() bool {
+	if res.rs == nil {
+		return false
+	}
+	if res.ctx != nil && res.ctx.Err() != nil {
+		res.err = res.ctx.Err()
+		if res.span != nil {
+			res.span.RecordError(res.err)
+		}
+		return false
+	}
 	result := bool(C.CBLResultSet_Next(res.rs))
+	if result {
+		res.rows++
+		CurrentMetrics().add("cbl_query_rows_total", 1, "query", res.query)
+	} else {
+		res.endSpan()
+	}
 	return result
 }
 
+// Decodes the current result of the C result set.
+func (res *ResultSet) currentResult() Result {
+	values := make([]interface{}, len(res.columns))
+	for i := range values {
+		fl_val := C.CBLResultSet_ValueAtIndex(res.rs, C.unsigned(i))
+		values[i], _ = getFLValueToGoValue(fl_val)
+	}
+	return Result{columns: res.columns, values: values}
+}
+
+/** Returns the current result. Its values stay valid after moving to the next one, except for
+    blobs, which belong to the result set and are only valid until it is closed. */
+func (res *ResultSet) Row() Result {
+	if res.materialized != nil {
+		if res.pos >= 0 && res.pos < len(res.materialized) {
+			return res.materialized[res.pos]
+		}
+		return Result{columns: res.columns}
+	}
+	if res.rs == nil {
+		return Result{columns: res.columns}
+	}
+	return res.currentResult()
+}
+
+/** Reads the remaining results into memory, so that \ref ResultSet.Count is known. Iteration
+    then starts over at the first of them. The result set stays allocated, keeping the blobs in
+    its results valid, until it is closed. Returns \ref ResultSet.Err. */
+func (res *ResultSet) Materialize() error {
+	if res.materialized != nil {
+		res.pos = -1
+		return nil
+	}
+	results := []Result{}
+	for res.step() {
+		results = append(results, res.currentResult())
+	}
+	res.materialized = results
+	res.pos = -1
+	return res.err
+}
+
+/** Returns the number of results of a materialized result set, or ErrResultSetNotMaterialized. */
+func (res *ResultSet) Count() (int, error) {
+	if res.materialized == nil {
+		return 0, ErrResultSetNotMaterialized
+	}
+	return len(res.materialized), nil
+}
+
+/** Returns the names of the columns. */
+func (res *ResultSet) Columns() []string {
+	return res.columns
+}
+
 /** Returns the value of a column of the current result, given its (zero-based) numeric index.
     This may return a NULL pointer, indicating `MISSING`, if the value doesn't exist, e.g. if
     the column is a property that doesn't exist in the document. */
 // FLValue CBLResultSet_ValueAtIndex(CBLResultSet* _cbl_nonnull,
 								//   unsigned index) CBLAPI;
 func (res *ResultSet) ValueAtIndex(index uint) interface{} {
+	if res.materialized != nil {
+		return res.Row().ValueAtIndex(index)
+	}
+	if res.rs == nil {
+		return nil
+	}
 	fl_val := C.CBLResultSet_ValueAtIndex(res.rs, C.unsigned(index))
 	if value, err := getFLValueToGoValue(fl_val); err == nil {
 		return value
@@ -241,16 +427,101 @@ func (res *ResultSet) ValueAtIndex(index uint) interface{} {
 // FLValue CBLResultSet_ValueForKey(CBLResultSet* _cbl_nonnull,
 								//  const char* key _cbl_nonnull) CBLAPI;
 func (res *ResultSet) ValueForKey(key string) interface{} {
+	if res.materialized != nil {
+		return res.Row().ValueForKey(key)
+	}
+	if res.rs == nil {
+		return nil
+	}
 	c_key := C.CString(key)
 	fl_val := C.CBLResultSet_ValueForKey(res.rs, c_key)
 	C.free(unsafe.Pointer(c_key))
-	if value, err := getFLValueToGoValue(fl_val); err != nil {
+	if value, err := getFLValueToGoValue(fl_val); err == nil {
 		return value
 	}
 	return nil
 }
 
 // CBL_REFCOUNTED(CBLResultSet*, ResultSet);
+/** Returns the error that stopped the iteration, such as the context of
+    \ref Query.ExecuteContext being canceled, or nil. */
+func (res *ResultSet) Err() error {
+	return res.err
+}
+
+/** Releases the result set. Calling it more than once is harmless. */
+func (res *ResultSet) Release() {
+	res.endSpan()
+	if res.rs != nil {
+		untrackObject(unsafe.Pointer(res.rs))
+		C.CBLResultSet_Release(res.rs)
+		res.rs = nil
+		runtime.SetFinalizer(res, nil)
+	}
+}
+
+/** Same as \ref ResultSet.Release. */
+func (res *ResultSet) Close() error {
+	res.Release()
+	return nil
+}
+
+func trackResultSet(res *ResultSet) {
+	trackObject(unsafe.Pointer(res.rs), "ResultSet", res.query)
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(res, (*ResultSet).finalize)
+	}
+}
+
+func (res *ResultSet) finalize() {
+	reportLeak(unsafe.Pointer(res.rs))
+	res.Release()
+}
+
+/** Returns the value of a column, given its (zero-based) index, or nil if it is `MISSING`. */
+func (r Result) ValueAtIndex(index uint) interface{} {
+	if index >= uint(len(r.values)) {
+		return nil
+	}
+	return r.values[index]
+}
+
+/** Returns the value of a column, given its name, or nil if it is `MISSING` or there is no
+    such column. */
+func (r Result) ValueForKey(key string) interface{} {
+	for i, column := range r.columns {
+		if column == key && i < len(r.values) {
+			return r.values[i]
+		}
+	}
+	return nil
+}
+
+/** Returns the names of the columns. */
+func (r Result) Columns() []string {
+	return r.columns
+}
+
+/** Returns the result as a map from column names to values, leaving out `MISSING` values. */
+func (r Result) ToMap() map[string]interface{} {
+	m := make(map[string]interface{}, len(r.values))
+	for i, value := range r.values {
+		if value != nil && i < len(r.columns) {
+			m[r.columns[i]] = value
+		}
+	}
+	return m
+}
+
+/** Returns the result as a JSON object (see \ref Result.ToMap). Blobs are written as their
+    metadata. */
+func (r Result) ToJSON() string {
+	text, err := json.Marshal(r.ToMap())
+	if err != nil {
+		return ""
+	}
+	return string(text)
+}
 
 /** @} */
 
@@ -301,7 +572,7 @@ func (q *Query) AddChangeListener(listener QueryChangeListener, ctx context.Cont
 			mutableDictContext := storeContextInMutableDict(ctx, ctxKeys)
       token := C.CBLQuery_AddChangeListener(q.q, (C.CBLQueryChangeListener)(C.gatewayQueryChangeGoCallback),
                                             unsafe.Pointer(mutableDictContext))
-      listener_token := ListenerToken{key,token,"QueryChangeListener"}
+      listener_token := ListenerToken{key,token,"QueryChangeListener",mutableDictContext}
 			return &listener_token, nil
 		}
 	}
@@ -406,9 +677,10 @@ type IndexSpec struct {
 	Language string
 }
 
-func goIndexSpecToCBLIndexSpec(index IndexSpec) C.CBLIndexSpec {	
-	c_key_ex_json := C.CString(index.KeyExpressionsJSON)
-	c_lang := C.CString(index.Language)
+// Converts an index spec; its strings are allocated from mem.
+func goIndexSpecToCBLIndexSpec(index IndexSpec, mem *cArena) C.CBLIndexSpec {
+	c_key_ex_json := mem.CString(index.KeyExpressionsJSON)
+	c_lang := mem.OptionalCString(index.Language)
 	c_index := C.CBLIndexSpec{C.CBLIndexType(index.Type), c_key_ex_json, C.bool(index.IgnoreAccents), c_lang}
 	return c_index
 }
@@ -424,9 +696,10 @@ func goIndexSpecToCBLIndexSpec(index IndexSpec) C.CBLIndexSpec {
 func (db *Database) CreateIndex(name string, indexSpec IndexSpec) bool {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
-	c_name := C.CString(name)
-	c_index_spec := goIndexSpecToCBLIndexSpec(indexSpec)
-	result := bool(C.CBLDatabase_CreateIndex(db.db, c_name, c_index_spec, err))
+	var mem cArena
+	defer mem.Free()
+	c_index_spec := goIndexSpecToCBLIndexSpec(indexSpec, &mem)
+	result := bool(C.CBLDatabase_CreateIndex(db.db, mem.CString(name), c_index_spec, err))
 	return result
 }
 
@@ -439,6 +712,7 @@ func (db *Database) DeleteIndex(name string) bool {
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
 	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
 	result := bool(C.CBLDatabase_DeleteIndex(db.db, c_name, err))
 	return result
 }
@@ -448,6 +722,7 @@ func (db *Database) DeleteIndex(name string) bool {
 // FLMutableArray CBLDatabase_IndexNames(CBLDatabase *db _cbl_nonnull) CBLAPI;
 func (db *Database) IndexNames() []string {
 	fl_mutable_arr := C.CBLDatabase_IndexNames(db.db)
+	defer C.FLMutableArray_Release(fl_mutable_arr)
 	var iter C.FLArrayIterator
 	C.FLArrayIterator_Begin(fl_mutable_arr, &iter);
 
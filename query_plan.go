@@ -0,0 +1,164 @@
+package cblcgo
+
+import "regexp"
+import "strconv"
+import "strings"
+
+/** \defgroup queryplan   Query plans
+    @{
+    \ref Query.Explain returns the SQL a query was compiled to, SQLite's query plan for it, and
+    the query's JSON form, as text. \ref Query.Plan parses it, so that tests can check that
+    queries use the indexes made for them:
+
+        if !query.UsesIndex("byName") || query.HasFullScan() {
+            t.Errorf("Query isn't covered by byName:\n%s", query.Explain())
+        }
+ */
+
+/** One line of a query plan, such as `SEARCH TABLE kv_default AS _doc USING INDEX byName (<expr>=?)`. */
+type QueryPlanStep struct {
+	ID int ///< The step's number
+	Parent int ///< The number of the step it belongs to, or 0
+	Detail string ///< The line as printed by SQLite
+	Operation string ///< "SCAN", "SEARCH", "USE TEMP B-TREE", ... (the start of Detail)
+	Table string ///< The table scanned or searched, if any
+	Alias string ///< The table's alias in the SQL, if any
+	Index string ///< The index used, if any; for a full-text index, its name without the table's
+	Covering bool ///< The index holds every column needed, so the table isn't read
+	FullScan bool ///< Every row of Table is read, without an index
+	TempBTree string ///< For "USE TEMP B-TREE", what it's for: "ORDER BY", "DISTINCT", ...
+}
+
+/** A parsed query plan. */
+type QueryPlan struct {
+	SQL string ///< The SQL the query was compiled to
+	Steps []QueryPlanStep
+	Tables []string ///< The tables scanned or searched, without duplicates
+	Indexes []string ///< The indexes used, without duplicates
+	FullScans []string ///< The tables read without an index
+	TempBTrees []string ///< What temporary B-trees are built for, e.g. "ORDER BY" when no index gives the order
+	Query string ///< The query's JSON form
+}
+
+var (
+	// "ID|PARENT|NOTUSED|DETAIL"
+	planLineRegexp = regexp.MustCompile(`^(\d+)\|(\d+)\|\d+\|\s*(.*)$`)
+	// "SCAN TABLE kv_default AS _doc ...", or "SCAN _doc ..." in recent versions of SQLite.
+	planTableRegexp = regexp.MustCompile(`^(SCAN|SEARCH)(?: TABLE)? ("[^"]*"|\S+)(?: AS (\S+))?(.*)$`)
+	planIndexRegexp = regexp.MustCompile(`USING (?:AUTOMATIC )?(?:PARTIAL )?(COVERING )?INDEX ("[^"]*"|\S+)`)
+)
+
+/** Parses the text returned by \ref Query.Explain. Lines it doesn't recognize are kept as steps
+    with only Detail and Operation set. */
+func ParseQueryPlan(explain string) QueryPlan {
+	plan := QueryPlan{}
+	var sql, query []string
+	for _, line := range strings.Split(explain, "\n") {
+		if match := planLineRegexp.FindStringSubmatch(line); match != nil {
+			id, _ := strconv.Atoi(match[1])
+			parent, _ := strconv.Atoi(match[2])
+			plan.addStep(parseQueryPlanStep(id, parent, match[3]))
+		} else if len(plan.Steps) == 0 {
+			sql = append(sql, line)
+		} else {
+			query = append(query, line)
+		}
+	}
+	plan.SQL = strings.TrimSpace(strings.Join(sql, "\n"))
+	plan.Query = strings.TrimSpace(strings.Join(query, "\n"))
+	return plan
+}
+
+func parseQueryPlanStep(id, parent int, detail string) QueryPlanStep {
+	step := QueryPlanStep{ID: id, Parent: parent, Detail: detail}
+	if strings.HasPrefix(detail, "USE TEMP B-TREE FOR ") {
+		step.Operation = "USE TEMP B-TREE"
+		step.TempBTree = strings.TrimPrefix(detail, "USE TEMP B-TREE FOR ")
+		return step
+	}
+	match := planTableRegexp.FindStringSubmatch(detail)
+	if match == nil {
+		step.Operation = detail
+		if i := strings.IndexAny(detail, " ("); i > 0 {
+			step.Operation = detail[:i]
+		}
+		return step
+	}
+	step.Operation = match[1]
+	table, rest := strings.Trim(match[2], `"`), match[4]
+	// Not tables: "SCAN CONSTANT ROW", "SCAN SUBQUERY 1", "SCAN (subquery-1)", ...
+	if table == "CONSTANT" || table == "SUBQUERY" || strings.HasPrefix(table, "(") {
+		return step
+	}
+	step.Table = table
+	step.Alias = match[3]
+	if index := planIndexRegexp.FindStringSubmatch(rest); index != nil {
+		step.Index = strings.Trim(index[2], `"`)
+		step.Covering = index[1] != ""
+	} else if i := strings.Index(table, "::"); i >= 0 {
+		// Full-text indexes are virtual tables named TABLE::INDEX.
+		step.Index = table[i+2:]
+	} else if step.Operation == "SCAN" && !strings.Contains(rest, "VIRTUAL TABLE") {
+		step.FullScan = true
+	}
+	return step
+}
+
+func (plan *QueryPlan) addStep(step QueryPlanStep) {
+	plan.Steps = append(plan.Steps, step)
+	if step.Table != "" {
+		plan.Tables = appendUnique(plan.Tables, step.Table)
+	}
+	if step.Index != "" {
+		plan.Indexes = appendUnique(plan.Indexes, step.Index)
+	}
+	if step.FullScan {
+		plan.FullScans = appendUnique(plan.FullScans, step.Table)
+	}
+	if step.TempBTree != "" {
+		plan.TempBTrees = append(plan.TempBTrees, step.TempBTree)
+	}
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+/** Returns true if the plan uses the index with the given name. */
+func (plan QueryPlan) UsesIndex(name string) bool {
+	for _, index := range plan.Indexes {
+		if index == name {
+			return true
+		}
+	}
+	return false
+}
+
+/** Returns true if the plan reads every row of a table. Scans of a whole index, for instance to
+    sort by it, don't count. */
+func (plan QueryPlan) HasFullScan() bool {
+	return len(plan.FullScans) > 0
+}
+
+/** Returns the parsed query plan (see \ref Query.Explain). */
+func (q *Query) Plan() QueryPlan {
+	return ParseQueryPlan(q.Explain())
+}
+
+/** Returns true if the query uses the index with the given name, as created by
+    \ref Database.CreateIndex. */
+func (q *Query) UsesIndex(name string) bool {
+	return q.Plan().UsesIndex(name)
+}
+
+/** Returns true if the query reads every document instead of using an index. */
+func (q *Query) HasFullScan() bool {
+	return q.Plan().HasFullScan()
+}
+
+/** @} */
@@ -10,7 +10,6 @@ bool pullFilterBridge(void *, CBLDocument*, bool);
 void replicatorChangeBridge(void *, CBLReplicator*, CBLReplicatorStatus*);
 void replicatedDocumentBridge(void *, CBLReplicator*, bool, unsigned, CBLReplicatedDocument*);
 const CBLDocument * conflictResolverBridge(void *, const char *, const CBLDocument *, const CBLDocument *);
-void Set_Null(void *);
 
 bool gatewayPushFilterCallback(void *context, CBLDocument* doc, bool isDeleted) {
 	return pushFilterBridge(context, doc, isDeleted);
@@ -42,7 +41,14 @@ void SetProxyType(CBLProxySettings * proxy, CBLProxyType type) {
 import "C"
 import "unsafe"
 import "context"
+import "crypto/x509"
 import "fmt"
+import "runtime"
+import "sync"
+import "syscall"
+import "time"
+
+import "github.com/svr4/couchbase-lite-cgo/fleece"
 
 /** \defgroup replication   Replication
     A replicator is a background task that synchronizes changes between a local database and
@@ -54,7 +60,7 @@ import "fmt"
 
 /** The name of the HTTP cookie used by Sync Gateway to store session keys. */
 //CBL_CORE_API extern const char* kCBLAuthDefaultCookieName;
-var AuthDefaultCookieName string
+var AuthDefaultCookieName string = C.GoString(C.kCBLAuthDefaultCookieName)
 
 /** An opaque object representing the location of a database to replicate with. */
 //typedef struct CBLEndpoint CBLEndpoint;
@@ -70,6 +76,7 @@ type Endpoint struct {
 //CBLEndpoint* CBLEndpoint_NewWithURL(const char *url _cbl_nonnull) CBLAPI;
 func NewEndpointWithURL(url string) *Endpoint {
 	c_url := C.CString(url)
+	defer C.free(unsafe.Pointer(c_url))
 	c_endpoint := C.CBLEndpoint_NewWithURL(c_url)
 	endpoint := Endpoint{}
 	endpoint.endpoint = c_endpoint
@@ -82,14 +89,28 @@ func NewEndpointWithURL(url string) *Endpoint {
 // CBLEndpoint* CBLEndpoint_NewWithLocalDB(CBLDatabase* _cbl_nonnull) CBLAPI;
 // #endif
 
-/** Frees a CBLEndpoint object. */
+/** Frees a CBLEndpoint object. Replicators keep their own copy, so this may be called once
+    no more replicators will be created with the endpoint. Calling it more than once is harmless. */
 //void CBLEndpoint_Free(CBLEndpoint*) CBLAPI;
+func (endpoint *Endpoint) Free() {
+	if endpoint.endpoint != nil {
+		C.CBLEndpoint_Free(endpoint.endpoint)
+		endpoint.endpoint = nil
+	}
+}
 
 
 /** An opaque object representing authentication credentials for a remote server. */
 //typedef struct CBLAuthenticator CBLAuthenticator;
 type Authenticator struct {
 	auth *C.CBLAuthenticator
+	// Set for authenticators whose credentials rotate; see auth.go.
+	source credentialSource
+	headers map[string]interface{}
+	expires time.Time
+	generation uint64 // incremented each time Refresh replaces auth
+	retired []retiredAuth // replaced by Refresh, but maybe still used by replicators
+	mu sync.Mutex
 }
 
 /** Creates an authenticator for HTTP Basic (username/password) auth. */
@@ -97,9 +118,11 @@ type Authenticator struct {
 //                                    const char *password _cbl_nonnull) CBLAPI;
 func NewBasicAuthentication(username, password string) *Authenticator {
 	c_usr := C.CString(username)
+	defer C.free(unsafe.Pointer(c_usr))
 	c_pass := C.CString(password)
+	defer C.free(unsafe.Pointer(c_pass))
 	c_auth := C.CBLAuth_NewBasic(c_usr, c_pass)
-	auth := Authenticator{c_auth}
+	auth := Authenticator{auth: c_auth}
 	return &auth
 }
 
@@ -108,12 +131,10 @@ func NewBasicAuthentication(username, password string) *Authenticator {
 // CBLAuthenticator* CBLAuth_NewSession(const char *sessionID _cbl_nonnull,
 //                                      const char *cookieName) CBLAPI;
 func NewAuthSession(sessionId, cookieName string) (*Authenticator, error) {
-	c_sess := C.CString(sessionId)
-	defer C.free(unsafe.Pointer(c_sess))
-	c_cookie := C.CString(cookieName)
-	defer C.free(unsafe.Pointer(c_cookie))
-	c_auth := C.CBLAuth_NewSession(c_sess, c_cookie)
-	auth := Authenticator{c_auth}
+	var mem cArena
+	defer mem.Free()
+	c_auth := C.CBLAuth_NewSession(mem.CString(sessionId), mem.OptionalCString(cookieName))
+	auth := Authenticator{auth: c_auth}
 	return &auth, nil
 }
 
@@ -122,8 +143,24 @@ func NewProxySettings(proxyType ProxyType, hostname string, port uint16, usernam
 	return &p
 }
 
-/** Frees a CBLAuthenticator object. */
+/** Frees a CBLAuthenticator object, along with any credentials \ref Authenticator.Refresh
+    replaced. Replicators use the credentials they were created with until they are freed, so
+    call this only once every replicator created with the authenticator has been freed (for
+    supervised replicators, once the \ref ReplicatorSupervisor is closed). Calling it more than
+    once is harmless. */
 //void CBLAuth_Free(CBLAuthenticator*) CBLAPI;
+func (auth *Authenticator) Free() {
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if auth.auth != nil {
+		C.CBLAuth_Free(auth.auth)
+		auth.auth = nil
+	}
+	for _, r := range auth.retired {
+		C.CBLAuth_Free(r.auth)
+	}
+	auth.retired = nil
+}
 
 
 /** Direction of replication: push, pull, or both. */
@@ -239,6 +276,7 @@ type ProxySettings struct {
 // } CBLReplicatorConfiguration;
 
 type ReplicatorConfiguration struct {
+	Name string ///< Identifies the replicator in metrics; defaults to the database name
 	Db *Database
 	Endpt *Endpoint
 	Replicator ReplicatorType
@@ -247,6 +285,8 @@ type ReplicatorConfiguration struct {
 	Proxy *ProxySettings
 	PinnedServerCertificate []byte
 	TrustedRootCertificates []byte
+	PinnedCertificate *x509.Certificate	///< Alternative to PinnedServerCertificate
+	TrustedRoots []*x509.Certificate	///< Alternative to TrustedRootCertificates
 	Headers map[string]interface{}
 	Channels []string
 	DocumentIds []string
@@ -261,6 +301,9 @@ type ReplicatorConfiguration struct {
 
 type Replicator struct {
 	rep *C.CBLReplicator
+	name string // see replicatorName
+	// The configuration and callback context, freed when the replicator is closed.
+	mem *cArena
 }
 
 /** \name  Lifecycle
@@ -272,88 +315,93 @@ type Replicator struct {
 // CBLReplicator* CBLReplicator_New(const CBLReplicatorConfiguration* _cbl_nonnull,
 //                                  CBLError*) CBLAPI;
 func NewReplicator(config ReplicatorConfiguration) (*Replicator, error) {
+	pinnedCert, trustedCerts, cert_err := replicatorCertificates(&config)
+	if cert_err != nil {
+		return nil, cert_err
+	}
+
 	err := (*C.CBLError)(C.malloc(C.sizeof_CBLError))
 	defer C.free(unsafe.Pointer(err))
-	c_config := (*C.CBLReplicatorConfiguration)(C.malloc(C.sizeof_CBLReplicatorConfiguration))
+	// Everything the configuration points to lives as long as the replicator.
+	mem := &cArena{}
+	c_config := (*C.CBLReplicatorConfiguration)(mem.Calloc(C.sizeof_CBLReplicatorConfiguration))
 
 	c_config.database = config.Db.db
 	c_config.endpoint = config.Endpt.endpoint
 	c_config.replicatorType = C.CBLReplicatorType(config.Replicator)
 	c_config.continuous = C.bool(config.Continious)
-	c_config.authenticator = config.Auth.auth
+	headers := config.Headers
+	if config.Auth != nil {
+		config.Auth.mu.Lock()
+		c_config.authenticator = config.Auth.auth
+		if len(config.Auth.headers) > 0 {
+			// Credential headers take precedence over the configured ones.
+			headers = make(map[string]interface{}, len(config.Headers) + len(config.Auth.headers))
+			for k, v := range config.Headers {
+				headers[k] = v
+			}
+			for k, v := range config.Auth.headers {
+				headers[k] = v
+			}
+		}
+		config.Auth.mu.Unlock()
+	} else {
+		c_config.authenticator = nil
+	}
 
 	// Proxy Settings
 	if config.Proxy != nil {
-		proxy := (*C.CBLProxySettings)(C.malloc(C.sizeof_CBLProxySettings))
+		proxy := (*C.CBLProxySettings)(mem.Calloc(C.sizeof_CBLProxySettings))
 		// I use this function because Go thinks proxy.type is a type assertion.
 		C.SetProxyType(proxy, C.CBLProxyType(config.Proxy.Type))
-		proxy.hostname = C.CString(config.Proxy.Hostname)
+		proxy.hostname = mem.CString(config.Proxy.Hostname)
 		proxy.port = C.uint16_t(config.Proxy.Port)
-		proxy.username = C.CString(config.Proxy.Username)
-		proxy.password = C.CString(config.Proxy.Password)
+		proxy.username = mem.OptionalCString(config.Proxy.Username)
+		proxy.password = mem.OptionalCString(config.Proxy.Password)
 
 		c_config.proxy = proxy
 	} else {
-		C.Set_Null(unsafe.Pointer(c_config.proxy))
-	}
-
-	if len(config.PinnedServerCertificate) > 0 {
-		certSize := len(config.PinnedServerCertificate)
-		certBytes := C.CBytes(config.PinnedServerCertificate)
-		c_config.pinnedServerCertificate = C.FLSlice{unsafe.Pointer(certBytes), C.size_t(certSize)}
-	} else {
-		c_config.pinnedServerCertificate = C.kFLSliceNull
+		c_config.proxy = nil
 	}
 
-
-	if len(config.TrustedRootCertificates) > 0 {
-		// Trusted Certificates
-		trustedCertSize := len(config.TrustedRootCertificates)
-		trustedCertBytes := C.CBytes(config.TrustedRootCertificates)
-		c_config.trustedRootCertificates = C.FLSlice{unsafe.Pointer(trustedCertBytes), C.size_t(trustedCertSize)}
-	} else {
-		c_config.trustedRootCertificates = C.kFLSliceNull
-	}
+	c_config.pinnedServerCertificate = mem.Slice(pinnedCert)
+	c_config.trustedRootCertificates = mem.Slice(trustedCerts)
 
 	// Process Headers
-	if len(config.Headers) > 0 {
-		mutableDict := C.FLMutableDict_New()
-
-		for k, v := range config.Headers {
-			c_key := C.CString(k)
-			fl_slot := C.FLMutableDict_Set(mutableDict, C.FLStr(c_key))
-			storeGoValueInSlot(fl_slot, v)
-			C.free(unsafe.Pointer(c_key))
+	if len(headers) > 0 {
+		mutableDict, headers_err := fleece.NewMutableDictFromMap(headers)
+		if headers_err != nil {
+			mem.Free()
+			return nil, headers_err
 		}
-		fl_dict := C.FLDict(mutableDict)
-		c_config.headers = fl_dict
+		mem.Defer(mutableDict.Release)
+		c_config.headers = C.FLDict(mutableDict.CPointer())
 	} else {
-		c_config.headers = C.FLDict(C.FLMutableDict_New())
+		c_config.headers = nil
 	}
 
 	// Process channels
 	if len(config.Channels) > 0 {
-		chan_array := C.FLMutableArray_New()
+		chan_array := fleece.NewMutableArray()
+		mem.Defer(chan_array.Release)
 		for i:=0; i < len(config.Channels); i++ {
-			chan_slot := C.FLMutableArray_Append(chan_array)
-			storeGoValueInSlot(chan_slot, config.Channels[i]);
+			chan_array.Append().SetString(config.Channels[i])
 		}
-		c_config.channels = C.FLArray(chan_array)
+		c_config.channels = C.FLArray(chan_array.CPointer())
 	} else {
-		// c_config.channels = C.kFLEmptyArray
-		c_config.documentIDs = C.FLArray(C.FLMutableArray_New())
+		c_config.channels = nil
 	}
 
 	// Process documentIds
 	if len(config.DocumentIds) > 0 {
-		docIds_array := C.FLMutableArray_New()
+		docIds_array := fleece.NewMutableArray()
+		mem.Defer(docIds_array.Release)
 		for ii:=0; ii < len(config.DocumentIds); ii++ {
-			doc_slot := C.FLMutableArray_Append(docIds_array)
-			storeGoValueInSlot(doc_slot, config.DocumentIds[ii]);
+			docIds_array.Append().SetString(config.DocumentIds[ii])
 		}
-		c_config.documentIDs = C.FLArray(docIds_array)
+		c_config.documentIDs = C.FLArray(docIds_array.CPointer())
 	} else {
-		c_config.documentIDs = C.FLArray(C.FLMutableArray_New())
+		c_config.documentIDs = nil
 	}
 
 	// The pullCallback and pushCallback keys should already be in the context.
@@ -363,7 +411,7 @@ func NewReplicator(config ReplicatorConfiguration) (*Replicator, error) {
 		pushKey := config.FilterContext.Value(pushCallback).(string)
 		pushFilterCallbacks[pushKey] = config.PushFilter
 	} else {
-		C.Set_Null(unsafe.Pointer(c_config.pushFilter))
+		c_config.pushFilter = nil
 	}
 
 	if config.PullFilter != nil {
@@ -372,15 +420,16 @@ func NewReplicator(config ReplicatorConfiguration) (*Replicator, error) {
 		pullKey := config.FilterContext.Value(pullCallback).(string)
 		pullFilterCallbacks[pullKey] = config.PullFilter
 	} else {
-		C.Set_Null(unsafe.Pointer(c_config.pullFilter))
+		c_config.pullFilter = nil
 	}
 
 	// Place the context into a mutable dict.
 	if config.FilterContext != nil && len(config.FilterKeys) > 0 {
 		dict := storeContextInMutableDict(config.FilterContext, config.FilterKeys)
+		mem.Defer(func() { C.FLMutableDict_Release(dict) })
 		c_config.context = unsafe.Pointer(dict)
 	} else {
-		C.Set_Null(unsafe.Pointer(c_config.context))
+		c_config.context = nil
 	}
 
 	// Conflict Resolver callback
@@ -389,14 +438,16 @@ func NewReplicator(config ReplicatorConfiguration) (*Replicator, error) {
 		conflictKey := config.FilterContext.Value(conflictResolver).(string)
 		conflictResolverCallbacks[conflictKey] = config.Resolver
 	} else {
-		C.Set_Null(unsafe.Pointer(c_config.conflictResolver))
+		c_config.conflictResolver = nil
 	}
 
 	c_replicator := C.CBLReplicator_New(c_config, err)
 	if (*err).code == 0 {
-		replicator := Replicator{c_replicator}
+		replicator := Replicator{rep: c_replicator, mem: mem, name: replicatorName(&config)}
+		trackReplicator(&replicator, &config)
 		return &replicator, nil
 	}
+	mem.Free()
 	c_err_msg := C.CBLError_Message(err)
 	ErrCBLInternalError = fmt.Errorf("CBL: %s. Domain: %d Code: %d", C.GoString(c_err_msg), (*err).domain, (*err).code)
 	C.free(unsafe.Pointer(c_err_msg))
@@ -441,8 +492,50 @@ func RemovePullFilterListener(key string) {
 	delete(pullFilterCallbacks, key)
 }
 
-func (rep *Replicator) Release() {
+/** Releases the replicator. It should be stopped first. Calling it more than once is
+    harmless. */
+func (rep *Replicator) Close() error {
+	if rep.rep == nil {
+		return nil
+	}
+	untrackObject(unsafe.Pointer(rep.rep))
 	C.CBLReplicator_Release(rep.rep)
+	rep.rep = nil
+	if rep.mem != nil {
+		rep.mem.Free()
+		rep.mem = nil
+	}
+	runtime.SetFinalizer(rep, nil)
+	return nil
+}
+
+// The name a replicator is known by in metrics and \ref LiveObjects.
+func replicatorName(config *ReplicatorConfiguration) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	if config.Db != nil {
+		return config.Db.name
+	}
+	return ""
+}
+
+/** Same as \ref Replicator.Close. */
+func (rep *Replicator) Release() {
+	rep.Close()
+}
+
+// Starts tracking a replicator created for the caller.
+func trackReplicator(rep *Replicator, config *ReplicatorConfiguration) {
+	trackObject(unsafe.Pointer(rep.rep), "Replicator", replicatorName(config))
+	if leakFinalizersEnabled() {
+		runtime.SetFinalizer(rep, (*Replicator).finalize)
+	}
+}
+
+func (rep *Replicator) finalize() {
+	reportLeak(unsafe.Pointer(rep.rep))
+	rep.Close()
 }
 /** @} */
 
@@ -470,6 +563,22 @@ const (
     Busy			///< The replicator is actively transferring data.
 )
 
+func (a ReplicatorActivityLevel) String() string {
+	switch a {
+	case Stopped:
+		return "stopped"
+	case Offline:
+		return "offline"
+	case Connecting:
+		return "connecting"
+	case Idle:
+		return "idle"
+	case Busy:
+		return "busy"
+	}
+	return fmt.Sprintf("ReplicatorActivityLevel(%d)", uint8(a))
+}
+
 /** A fractional progress value. The units are undefined; the only meaningful number is the
     (fractional) result of `completed` ÷ `total`, which will range from 0.0 to 1.0.
     Before anything happens, both `completed` and `total` will be 0. */
@@ -486,7 +595,92 @@ type Error struct {
 	InternalInfo uint32
 	Code uint32
 	Domain uint32
-} 
+}
+
+/** Error domains, serving as namespaces for numeric error codes. */
+// typedef CBL_ENUM(uint32_t, CBLErrorDomain) {
+//     CBLDomain = 1,         ///< code is a Couchbase Lite error code; see \ref CBLErrorCode
+//     CBLPOSIXDomain,        ///< code is a POSIX `errno`; see "errno.h"
+//     CBLSQLiteDomain,       ///< code is a SQLite error; see "sqlite3.h"
+//     CBLFleeceDomain,       ///< code is a Fleece error; see "FleeceException.h"
+//     CBLNetworkDomain,      ///< code is a network error; see \ref CBLNetworkErrorCode
+//     CBLWebSocketDomain,    ///< code is a WebSocket close code (1000...1015) or HTTP error (300..599)
+// };
+const (
+	ErrorDomainCBL uint32 = iota + 1 ///< code is a Couchbase Lite error code
+	ErrorDomainPOSIX ///< code is a POSIX `errno`
+	ErrorDomainSQLite ///< code is a SQLite error
+	ErrorDomainFleece ///< code is a Fleece error
+	ErrorDomainNetwork ///< code is a network error; see the NetErr constants
+	ErrorDomainWebSocket ///< code is a WebSocket close code (1000...1015) or HTTP error (300..599)
+)
+
+/** Couchbase Lite error codes used by the bindings, in the CBL domain. */
+const (
+	ErrorCodeBusy uint32 = 16 ///< Database is busy/locked
+	ErrorCodeRemoteError uint32 = 26 ///< Unknown error from remote server
+)
+
+/** Network error codes, in the network domain. */
+// typedef CBL_ENUM(int32_t,  CBLNetworkErrorCode) { ... };
+const (
+	NetErrDNSFailure uint32 = iota + 1 ///< DNS lookup failed
+	NetErrUnknownHost ///< DNS server doesn't know the hostname
+	NetErrTimeout ///< No response received before timeout
+	NetErrInvalidURL ///< Invalid URL
+	NetErrTooManyRedirects ///< HTTP redirect loop
+	NetErrTLSHandshakeFailed ///< Low-level error establishing TLS
+	NetErrTLSCertExpired ///< Server's TLS certificate has expired
+	NetErrTLSCertUntrusted ///< Cert isn't trusted for other reason
+	NetErrTLSClientCertRequired ///< Server requires client to have a TLS certificate
+	NetErrTLSClientCertRejected ///< Server rejected my TLS client certificate
+	NetErrTLSCertUnknownRoot ///< Self-signed cert, or unknown anchor cert
+	NetErrInvalidRedirect ///< Attempted redirect to invalid URL
+)
+
+/** Error makes Error usable as a Go error. */
+func (e Error) Error() string {
+	return fmt.Sprintf("CBL: Error. Domain: %d Code: %d", e.Domain, e.Code)
+}
+
+/** Returns true if the error is an authentication or authorization failure reported by
+    the remote server (HTTP 401 or 403). */
+func (e Error) IsAuthFailure() bool {
+	return e.Domain == ErrorDomainWebSocket && (e.Code == 401 || e.Code == 403)
+}
+
+/** Returns true if the error is likely to go away on its own, so the operation that
+    produced it is worth retrying: network failures, timeouts, HTTP 408, 429 and 5xx
+    responses, and abnormal WebSocket closes. Authentication failures are never transient. */
+func (e Error) IsTransient() bool {
+	switch e.Domain {
+	case ErrorDomainCBL:
+		return e.Code == ErrorCodeBusy || e.Code == ErrorCodeRemoteError
+	case ErrorDomainPOSIX:
+		switch syscall.Errno(e.Code) {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ETIMEDOUT,
+			syscall.ENETDOWN, syscall.ENETUNREACH, syscall.ENETRESET, syscall.EHOSTDOWN,
+			syscall.EHOSTUNREACH, syscall.EPIPE, syscall.EAGAIN:
+			return true
+		}
+	case ErrorDomainNetwork:
+		switch e.Code {
+		case NetErrDNSFailure, NetErrUnknownHost, NetErrTimeout, NetErrTLSHandshakeFailed:
+			return true
+		}
+	case ErrorDomainWebSocket:
+		switch {
+		case e.Code == 408 || e.Code == 429:
+			return true
+		case e.Code >= 500 && e.Code < 600:
+			return true
+		case e.Code == 1001 || e.Code == 1006 || (e.Code >= 1011 && e.Code <= 1014):
+			// Going away, abnormal close, server error, service restart, try again later, bad gateway.
+			return true
+		}
+	}
+	return false
+}
 
 /** A replicator's current status. */
 // typedef struct {
@@ -535,10 +729,13 @@ func (rep *Replicator) AddChangeListener(listener ReplicatorChangeListener, ctx
 		key, ok := v.(string)
 		if ok {
 			replicatorCallbacks[key] = listener
+			// The bridge only gets the C replicator, so it is told the name for metrics.
+			ctx = context.WithValue(ctx, replicatorNameKey, rep.name)
+			ctxKeys = append(ctxKeys[:len(ctxKeys):len(ctxKeys)], replicatorNameKey)
 			mutableDictContext := storeContextInMutableDict(ctx, ctxKeys)
 			token := C.CBLReplicator_AddChangeListener(rep.rep,
 				(C.CBLReplicatorChangeListener)(C.gatewayReplicatorChangeCallback), unsafe.Pointer(mutableDictContext))			
-			listener_token := ListenerToken{key,token,"ReplicatorChangeListener"}
+			listener_token := ListenerToken{key,token,"ReplicatorChangeListener",mutableDictContext}
 			return &listener_token, nil
 		}
 	}
@@ -602,7 +799,7 @@ func (rep *Replicator) AddDocumentListener(listener ReplicatedDocumentListener,
 			mutableDictContext := storeContextInMutableDict(ctx, ctxKeys)
 			token := C.CBLReplicator_AddDocumentListener(rep.rep,
 				(C.CBLReplicatedDocumentListener)(C.gatewayReplicatedDocumentCallback), unsafe.Pointer(mutableDictContext))			
-			listener_token := ListenerToken{key,token,"ReplicatedDocumentListener"}
+			listener_token := ListenerToken{key,token,"ReplicatedDocumentListener",mutableDictContext}
 			return &listener_token, nil
 		}
 	}
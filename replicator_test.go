@@ -6,6 +6,7 @@ import "testing"
 import "fmt"
 import "context"
 import "os"
+import "time"
 
 /*
 Notes on testing replication:
@@ -125,7 +126,7 @@ func TestReplicationHTTP(t *testing.T) {
 			t.Error(rerr)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
@@ -243,11 +244,74 @@ func TestReplicationHTTPS(t *testing.T) {
 			t.Error(rerr)
 		}
 
-		if !db.Close() {
+		if err := db.Close(); err != nil {
 			t.Error("Couldn't close the database.")
 		}
 
 	} else {
 		t.Error(db_err)
 	}
-}
\ No newline at end of file
+}
+
+func TestReplicatorSupervisor(t *testing.T) {
+	var config DatabaseConfiguration
+	config.Directory = "./db"
+	config.Flags = Database_Create
+
+	if db, db_err := Open("my_db13", &config); db_err == nil {
+
+		var replicator_config ReplicatorConfiguration
+		replicator_config.Db = db
+		// Nothing listens on this port, so the replicator stops with a transient error.
+		replicator_config.Endpt = NewEndpointWithURL("ws://localhost:1/my_db13")
+		replicator_config.Replicator = Pull
+		replicator_config.Continious = false
+		replicator_config.Auth = NewBasicAuthentication("test", "testtest")
+
+		supervisor := NewReplicatorSupervisor(SupervisorOptions{
+			InitialBackoff: 100 * time.Millisecond,
+			PollInterval: 50 * time.Millisecond,
+		})
+		if err := supervisor.Add("unreachable", replicator_config); err != nil {
+			t.Error(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			supervisor.Run(ctx)
+			close(done)
+		}()
+
+		restarted := false
+		for !restarted && ctx.Err() == nil {
+			time.Sleep(100 * time.Millisecond)
+			if report, ok := supervisor.Report("unreachable"); ok && report.Restarts > 0 {
+				restarted = true
+				if report.Health == Healthy {
+					t.Error("Restarting replicator reported as healthy.")
+				}
+				if report.LastError == nil {
+					t.Error("Restarted replicator has no last error.")
+				}
+			}
+		}
+		if !restarted {
+			t.Error("Replicator wasn't restarted after a transient error.")
+		}
+		cancel()
+		<-done
+
+		if supervisor.Health() == Healthy {
+			t.Error("Supervisor reported as healthy.")
+		}
+
+		if err := db.Close(); err != nil {
+			t.Error("Couldn't close the database.")
+		}
+
+	} else {
+		t.Error(db_err)
+	}
+}
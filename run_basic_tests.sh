@@ -1,4 +1,4 @@
-tests=(TestConnection TestSaveAndDeleteDocuments TestSaveAndRetrieveDocuments TestProperties TestDocumentListener TestQuery TestBlob TestListeners TestNotificationCallback)
+tests=(TestConnection TestSaveAndDeleteDocuments TestSaveAndRetrieveDocuments TestProperties TestDocumentListener TestQuery TestBlob TestListeners TestNotificationCallback TestLiveObjects TestMemoryGrowth TestLogCallback TestMetrics TestTracing TestContextCancellation TestBlobStreams TestServeBlob TestBlobInventory TestVerifyBlobs TestFleeceProperties TestFleeceEncoding TestNumericRoundTrip TestDocumentPatch TestAuditLog TestChangesFeed TestExpiryScheduler TestAllDocuments TestResultSet TestQueryPlan TestDocumentBlobAfterSave TestOpenIDConnectSession TestCertificateValidation)
 for i in ${tests[@]}; do
     ./cblcgo.test -test.v -test.run $i
     echo $i
@@ -0,0 +1,389 @@
+package cblcgo
+
+import "context"
+import "fmt"
+import "sync"
+import "time"
+
+/** \defgroup supervisor   Replicator supervision
+    @{
+    A \ref ReplicatorSupervisor owns one or more replicators and keeps them running. When a
+    replicator stops with a transient error (network failures, timeouts, HTTP 5xx) it is released
+    and recreated from its configuration after an exponential backoff. Permanent errors, such as
+    authentication failures, mark the replicator as failed and it is left stopped.
+
+    Replicators whose \ref Authenticator rotates are also stopped and recreated with fresh
+    credentials shortly before the current ones expire, and once after the server rejects them.
+    The credentials they were created with are freed once none of the supervisor's replicators
+    uses them; the \ref Authenticator itself is freed by its owner, after the supervisor is
+    closed.
+ */
+
+/** The health of a supervised replicator, or of the supervisor as a whole. */
+type ReplicatorHealth uint8
+
+const (
+	Healthy ReplicatorHealth = iota ///< Running (or finished) without errors.
+	Degraded ///< Offline, or waiting to be restarted after a transient error.
+	Failed ///< Stopped by a permanent error, or out of restarts.
+)
+
+func (h ReplicatorHealth) String() string {
+	switch h {
+	case Healthy:
+		return "Healthy"
+	case Degraded:
+		return "Degraded"
+	case Failed:
+		return "Failed"
+	}
+	return fmt.Sprintf("ReplicatorHealth(%d)", uint8(h))
+}
+
+/** Options controlling how a \ref ReplicatorSupervisor restarts its replicators.
+    Zero values are replaced by the defaults noted on each field. */
+type SupervisorOptions struct {
+	InitialBackoff time.Duration ///< Delay before the first restart (default 1s)
+	MaxBackoff time.Duration ///< Upper bound for the restart delay (default 5m)
+	Multiplier float64 ///< Factor applied to the delay after every restart (default 2)
+	MaxRestarts int ///< Consecutive restarts before giving up; 0 means unlimited
+	PollInterval time.Duration ///< How often replicator status is checked (default 1s)
+	StopTimeout time.Duration ///< How long to wait for replicators to stop on shutdown (default 10s)
+}
+
+/** A snapshot of a supervised replicator's state. */
+type ReplicatorReport struct {
+	Name string
+	Health ReplicatorHealth
+	Status ReplicatorStatus ///< Last status read from the replicator
+	LastError error ///< Last error the replicator stopped with, or nil
+	Restarts int ///< Restarts since the replicator was last healthy
+	NextRestart time.Time ///< When a pending restart is due; zero if none is pending
+}
+
+type supervisedReplicator struct {
+	name string
+	config ReplicatorConfiguration
+	rep *Replicator
+	health ReplicatorHealth
+	status ReplicatorStatus
+	lastError error
+	restarts int
+	backoff time.Duration
+	nextRestart time.Time
+	rotating bool
+	refreshing bool // its credentials are being refreshed, without holding the supervisor's lock
+	authRetried bool
+	authGeneration uint64 // generation of config.Auth that rep was created with
+}
+
+/** Owns a set of replicators and restarts them with exponential backoff. */
+type ReplicatorSupervisor struct {
+	mu sync.Mutex
+	options SupervisorOptions
+	entries []*supervisedReplicator
+	running bool
+	ctx context.Context
+}
+
+/** Creates a supervisor. Add replicators with \ref ReplicatorSupervisor.Add, then call
+    \ref ReplicatorSupervisor.Run to start them. */
+func NewReplicatorSupervisor(options SupervisorOptions) *ReplicatorSupervisor {
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = time.Second
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 5 * time.Minute
+	}
+	if options.Multiplier < 1 {
+		options.Multiplier = 2
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = time.Second
+	}
+	if options.StopTimeout <= 0 {
+		options.StopTimeout = 10 * time.Second
+	}
+	return &ReplicatorSupervisor{options: options}
+}
+
+/** Creates a replicator from the configuration and places it under supervision. The
+    configuration is kept so the replicator can be recreated after an error. If the supervisor
+    is already running the replicator is started immediately. */
+func (s *ReplicatorSupervisor) Add(name string, config ReplicatorConfiguration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.name == name {
+			return fmt.Errorf("CBL: Replicator %q Is Already Supervised", name)
+		}
+	}
+	if config.Name == "" {
+		config.Name = name
+	}
+	rep, err := NewReplicator(config)
+	if err != nil {
+		return err
+	}
+	entry := &supervisedReplicator{name: name, config: config, rep: rep, backoff: s.options.InitialBackoff}
+	if config.Auth != nil {
+		entry.authGeneration = config.Auth.currentGeneration()
+	}
+	s.entries = append(s.entries, entry)
+	if s.running {
+		rep.Start()
+	}
+	return nil
+}
+
+/** Starts every supervised replicator and watches them until the context is done. On
+    shutdown the replicators are stopped and released. Returns the context's error. Run can be
+    called again afterwards; the replicators are then recreated from their configurations. */
+func (s *ReplicatorSupervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	if s.running {
+		s.mu.Unlock()
+		return fmt.Errorf("CBL: Supervisor Is Already Running")
+	}
+	s.running = true
+	s.ctx = ctx
+	for _, e := range s.entries {
+		if e.refreshing {
+			continue // restarted once its credentials are refreshed
+		}
+		if e.rep == nil {
+			// Released by an earlier shutdown or error.
+			s.restart(e)
+		} else {
+			e.rep.Start()
+		}
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(s.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.shutdown()
+			return ctx.Err()
+		case now := <-ticker.C:
+			s.poll(now)
+		}
+	}
+}
+
+func (s *ReplicatorSupervisor) poll(now time.Time) {
+	s.mu.Lock()
+	// Credentials are refreshed after unlocking, since it takes a network call.
+	var refresh []*supervisedReplicator
+	rotate := func(e *supervisedReplicator) {
+		e.refreshing = true
+		refresh = append(refresh, e)
+	}
+	for _, e := range s.entries {
+		if e.refreshing {
+			continue
+		}
+		if e.rep == nil {
+			// Waiting to be recreated.
+			if !e.nextRestart.IsZero() && !now.Before(e.nextRestart) {
+				e.restarts++
+				if e.config.Auth != nil && e.config.Auth.NeedsRefresh(now) {
+					e.nextRestart = time.Time{}
+					rotate(e)
+				} else {
+					s.restart(e)
+				}
+			}
+			continue
+		}
+		e.status = e.rep.Status()
+		CurrentMetrics().ObserveReplicatorStatus(e.config.Name, e.status)
+		if e.status.Activity != Stopped && !e.rotating && e.config.Auth != nil && e.config.Auth.NeedsRefresh(now) {
+			// Stop now; the replicator is recreated with new credentials once it has stopped.
+			e.rotating = true
+			e.rep.Stop()
+			continue
+		}
+		switch e.status.Activity {
+		case Idle, Busy:
+			e.health = Healthy
+			e.restarts = 0
+			e.backoff = s.options.InitialBackoff
+			e.authRetried = false
+		case Offline:
+			// The replicator retries by itself while offline.
+			e.health = Degraded
+		case Stopped:
+			if e.rotating {
+				e.rotating = false
+				e.rep.Release()
+				e.rep = nil
+				rotate(e)
+				continue
+			}
+			if e.status.Err.Code == 0 {
+				e.health = Healthy
+				continue
+			}
+			e.lastError = e.status.Err
+			e.rep.Release()
+			e.rep = nil
+			if e.status.Err.IsAuthFailure() && e.config.Auth != nil && e.config.Auth.Rotates() && !e.authRetried {
+				// The credentials may have been revoked early; try once more with new ones.
+				e.authRetried = true
+				rotate(e)
+				continue
+			}
+			if !e.status.Err.IsTransient() {
+				e.health = Failed
+				e.nextRestart = time.Time{}
+				continue
+			}
+			s.retryLater(e, now)
+		}
+	}
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	for _, e := range refresh {
+		s.rotate(ctx, e)
+	}
+}
+
+// Schedules the next restart after the backoff, or fails the replicator if it is out of
+// restarts.
+func (s *ReplicatorSupervisor) retryLater(e *supervisedReplicator, now time.Time) {
+	if s.options.MaxRestarts > 0 && e.restarts >= s.options.MaxRestarts {
+		e.health = Failed
+		e.nextRestart = time.Time{}
+		return
+	}
+	e.health = Degraded
+	e.nextRestart = now.Add(e.backoff)
+	e.backoff = time.Duration(float64(e.backoff) * s.options.Multiplier)
+	if e.backoff > s.options.MaxBackoff {
+		e.backoff = s.options.MaxBackoff
+	}
+}
+
+func (s *ReplicatorSupervisor) restart(e *supervisedReplicator) {
+	e.nextRestart = time.Time{}
+	if e.config.Auth != nil {
+		// Read first: a concurrent refresh can only make the replicator newer than recorded.
+		e.authGeneration = e.config.Auth.currentGeneration()
+	}
+	rep, err := NewReplicator(e.config)
+	if err != nil {
+		e.lastError = err
+		e.health = Failed
+		return
+	}
+	e.rep = rep
+	rep.Start()
+}
+
+// Refreshes the credentials of a stopped replicator, then recreates it. Called without
+// holding the lock.
+func (s *ReplicatorSupervisor) rotate(ctx context.Context, e *supervisedReplicator) {
+	auth := e.config.Auth
+	_, err := auth.Refresh(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.refreshing = false
+	if !s.running {
+		return // shut down meanwhile; the next Run recreates it
+	}
+	if err != nil {
+		// Treat a failed refresh like a transient error, so it is retried with backoff.
+		e.lastError = err
+		s.retryLater(e, time.Now())
+		return
+	}
+	s.restart(e)
+
+	// Free the credentials no running replicator was created with anymore.
+	generation := auth.currentGeneration()
+	for _, other := range s.entries {
+		if other.config.Auth == auth && other.rep != nil && other.authGeneration < generation {
+			generation = other.authGeneration
+		}
+	}
+	auth.releaseRetired(generation)
+}
+
+func (s *ReplicatorSupervisor) shutdown() {
+	type stopping struct {
+		e *supervisedReplicator
+		rep *Replicator
+	}
+	s.mu.Lock()
+	var reps []stopping
+	for _, e := range s.entries {
+		e.nextRestart = time.Time{}
+		if e.rep != nil {
+			e.rep.Stop()
+			reps = append(reps, stopping{e, e.rep})
+			e.rep = nil
+		}
+	}
+	s.running = false
+	s.mu.Unlock()
+
+	// Wait without holding the lock, so that reports can be read meanwhile.
+	deadline := time.Now().Add(s.options.StopTimeout)
+	for _, r := range reps {
+		for r.rep.Status().Activity != Stopped && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		status := r.rep.Status()
+		r.rep.Release()
+		s.mu.Lock()
+		r.e.status = status
+		s.mu.Unlock()
+	}
+}
+
+func (e *supervisedReplicator) report() ReplicatorReport {
+	return ReplicatorReport{e.name, e.health, e.status, e.lastError, e.restarts, e.nextRestart}
+}
+
+/** Returns the aggregated health of all supervised replicators: \ref Failed if any replicator
+    has failed, \ref Degraded if any is degraded, and \ref Healthy otherwise. */
+func (s *ReplicatorSupervisor) Health() ReplicatorHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	health := Healthy
+	for _, e := range s.entries {
+		if e.health > health {
+			health = e.health
+		}
+	}
+	return health
+}
+
+/** Returns the report for the named replicator. */
+func (s *ReplicatorSupervisor) Report(name string) (ReplicatorReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.name == name {
+			return e.report(), true
+		}
+	}
+	return ReplicatorReport{}, false
+}
+
+/** Returns a report for every supervised replicator, in the order they were added. */
+func (s *ReplicatorSupervisor) Reports() []ReplicatorReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]ReplicatorReport, len(s.entries))
+	for i, e := range s.entries {
+		reports[i] = e.report()
+	}
+	return reports
+}
+
+/** @} */
@@ -0,0 +1,184 @@
+package cblcgo
+
+import "bytes"
+import "crypto/x509"
+import "encoding/pem"
+import "fmt"
+import "io/ioutil"
+import "time"
+
+/** \name  TLS configuration helpers
+    @{
+    The C library takes certificates as raw bytes: the pinned server certificate may be PEM or
+    DER, the trusted roots must be PEM. These helpers let a \ref ReplicatorConfiguration be
+    filled in from crypto/x509 values or certificate files instead, and \ref NewReplicator
+    validates whatever it is given before handing it to the C library.
+
+    @note  An x509.CertPool can't be enumerated, so trusted roots are given as a slice of
+           certificates; use \ref NewCertPool to build a pool from the same slice for Go code.
+ */
+
+/** Describes a certificate that was rejected while validating a replicator configuration. */
+type CertificateError struct {
+	Field string ///< The configuration field holding the certificate
+	Reason string ///< What is wrong with it
+	Err error ///< One of the ErrCertificate errors, or a parse error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("CBL: Invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+/** Reads the certificates in a PEM or DER file. */
+func LoadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("CBL: Problem Reading Certificates From %s: %v", path, err)
+	}
+	return certs, nil
+}
+
+/** Reads a single certificate from a PEM or DER file. If a PEM file holds a chain, the first
+    (leaf) certificate is returned. */
+func LoadCertificate(path string) (*x509.Certificate, error) {
+	certs, err := LoadCertificates(path)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+/** PEM-encodes certificates, in the form expected by `TrustedRootCertificates`. */
+func EncodeCertificatesPEM(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+/** Builds an x509.CertPool holding the given certificates. */
+func NewCertPool(certs []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+func isPEM(data []byte) bool {
+	return bytes.Contains(data, []byte("-----BEGIN"))
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if !isPEM(data) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("PEM block of type %q is not a certificate", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+func checkValidity(field string, certs []*x509.Certificate, now time.Time) error {
+	for _, cert := range certs {
+		if now.After(cert.NotAfter) {
+			reason := fmt.Sprintf("certificate %q expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+			return &CertificateError{field, reason, ErrCertificateExpired}
+		}
+		if now.Before(cert.NotBefore) {
+			reason := fmt.Sprintf("certificate %q is not valid before %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+			return &CertificateError{field, reason, ErrCertificateNotYetValid}
+		}
+	}
+	return nil
+}
+
+/** Resolves and validates the TLS settings of a replicator configuration, returning the
+    pinned certificate and trusted roots as the bytes the C library expects. */
+func replicatorCertificates(config *ReplicatorConfiguration) (pinned []byte, trusted []byte, err error) {
+	now := time.Now()
+
+	if config.PinnedCertificate != nil && len(config.PinnedServerCertificate) > 0 {
+		return nil, nil, &CertificateError{"PinnedServerCertificate", "both PinnedCertificate and PinnedServerCertificate are set", ErrCertificateFormat}
+	}
+	if config.PinnedCertificate != nil {
+		if err := checkValidity("PinnedCertificate", []*x509.Certificate{config.PinnedCertificate}, now); err != nil {
+			return nil, nil, err
+		}
+		pinned = config.PinnedCertificate.Raw
+	} else if len(config.PinnedServerCertificate) > 0 {
+		certs, perr := parseCertificates(config.PinnedServerCertificate)
+		if perr != nil {
+			format := "DER"
+			if isPEM(config.PinnedServerCertificate) {
+				format = "PEM"
+			}
+			return nil, nil, &CertificateError{"PinnedServerCertificate", fmt.Sprintf("not a valid %s certificate: %v", format, perr), ErrCertificateFormat}
+		}
+		if len(certs) > 1 {
+			return nil, nil, &CertificateError{"PinnedServerCertificate", "holds more than one certificate", ErrCertificateFormat}
+		}
+		if err := checkValidity("PinnedServerCertificate", certs, now); err != nil {
+			return nil, nil, err
+		}
+		pinned = config.PinnedServerCertificate
+	}
+
+	if len(config.TrustedRoots) > 0 && len(config.TrustedRootCertificates) > 0 {
+		return nil, nil, &CertificateError{"TrustedRootCertificates", "both TrustedRoots and TrustedRootCertificates are set", ErrCertificateFormat}
+	}
+	if len(config.TrustedRoots) > 0 {
+		if err := checkValidity("TrustedRoots", config.TrustedRoots, now); err != nil {
+			return nil, nil, err
+		}
+		trusted = EncodeCertificatesPEM(config.TrustedRoots)
+	} else if len(config.TrustedRootCertificates) > 0 {
+		if !isPEM(config.TrustedRootCertificates) {
+			reason := "must be PEM-encoded"
+			if _, derr := x509.ParseCertificate(config.TrustedRootCertificates); derr == nil {
+				reason = "must be PEM-encoded but holds a DER certificate; use TrustedRoots or EncodeCertificatesPEM"
+			}
+			return nil, nil, &CertificateError{"TrustedRootCertificates", reason, ErrCertificateFormat}
+		}
+		certs, perr := parseCertificates(config.TrustedRootCertificates)
+		if perr != nil {
+			return nil, nil, &CertificateError{"TrustedRootCertificates", perr.Error(), ErrCertificateFormat}
+		}
+		if err := checkValidity("TrustedRootCertificates", certs, now); err != nil {
+			return nil, nil, err
+		}
+		trusted = config.TrustedRootCertificates
+	}
+	return pinned, trusted, nil
+}
+
+/** @} */
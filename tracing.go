@@ -0,0 +1,259 @@
+package cblcgo
+
+import "context"
+import "sync"
+import "time"
+
+/** \defgroup tracing   Tracing
+    @{
+    The `...Context` variants of database, query and replicator methods create a span for each
+    operation when their context carries a \ref Tracer (see \ref ContextWithTracer). Whether or
+    not there is a tracer, they behave like the plain methods, except for the waiting and
+    cancellation described on each of them.
+
+    The interfaces are small enough to wrap any tracing library. For OpenTelemetry:
+
+        type otelTracer struct{ trace.Tracer }
+
+        func (t otelTracer) Start(ctx context.Context, name string, attrs ...cblcgo.Attribute) (context.Context, cblcgo.Span) {
+            ctx, span := t.Tracer.Start(ctx, name)
+            s := otelSpan{span}
+            s.SetAttributes(attrs...)
+            return ctx, s
+        }
+
+    where otelSpan converts each \ref Attribute with attribute.String, attribute.Int64, ...
+ */
+
+/** A key-value pair describing a span. Values are strings, integers, floats or bools. */
+type Attribute struct {
+	Key string
+	Value interface{}
+}
+
+/** Span attribute keys used by the bindings. */
+const (
+	AttrDBSystem = "db.system" ///< Always "couchbase-lite"
+	AttrDBName = "db.name"
+	AttrDocumentID = "cbl.document.id"
+	AttrConcurrency = "cbl.concurrency" ///< "last_write_wins" or "fail_on_conflict"
+	AttrQueryLanguage = "cbl.query.language" ///< "json" or "n1ql"
+	AttrQueryName = "cbl.query.name"
+	AttrQueryRows = "cbl.query.rows"
+	AttrReplicatorName = "cbl.replicator.name"
+	AttrReplicatorActivity = "cbl.replicator.activity"
+)
+
+/** An operation being traced. */
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+/** Creates spans. The returned context carries the new span, so that spans started with it
+    become its children. */
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+type tracerKey struct{}
+
+/** Returns a copy of ctx that makes the `...Context` methods create spans with `tracer`. */
+func ContextWithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+/** Returns the tracer carried by ctx, or nil. */
+func TracerFromContext(ctx context.Context) Tracer {
+	if ctx == nil {
+		return nil
+	}
+	tracer, _ := ctx.Value(tracerKey{}).(Tracer)
+	return tracer
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error) {}
+func (noopSpan) End() {}
+
+// Starts a span if ctx carries a tracer, and otherwise returns a span that does nothing.
+func startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	tracer := TracerFromContext(ctx)
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	attrs = append([]Attribute{{AttrDBSystem, "couchbase-lite"}}, attrs...)
+	return tracer.Start(ctx, name, attrs...)
+}
+
+// Records err, if any, and ends the span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+func (c ConcurrencyControl) spanValue() string {
+	if c == FailOnConflict {
+		return "fail_on_conflict"
+	}
+	return "last_write_wins"
+}
+
+func (l QueryLanguage) spanValue() string {
+	if l == N1QLLanguage {
+		return "n1ql"
+	}
+	return "json"
+}
+
+/** Same as \ref Open, traced as "cbl.Open". */
+func OpenContext(ctx context.Context, name string, config *DatabaseConfiguration) (*Database, error) {
+	_, span := startSpan(ctx, "cbl.Open", Attribute{AttrDBName, name})
+	db, err := Open(name, config)
+	endSpan(span, err)
+	return db, err
+}
+
+/** Same as \ref Database.Save, traced as "cbl.Save". */
+func (db *Database) SaveContext(ctx context.Context, doc *Document, concurrency ConcurrencyControl) (*Document, error) {
+	_, span := startSpan(ctx, "cbl.Save", Attribute{AttrDBName, db.name},
+		Attribute{AttrDocumentID, doc.Id()}, Attribute{AttrConcurrency, concurrency.spanValue()})
+	saved, err := db.Save(doc, concurrency)
+	endSpan(span, err)
+	return saved, err
+}
+
+/** Same as \ref Database.DeleteDocument, traced as "cbl.DeleteDocument". */
+func (db *Database) DeleteDocumentContext(ctx context.Context, doc *Document, concurrency ConcurrencyControl) error {
+	_, span := startSpan(ctx, "cbl.DeleteDocument", Attribute{AttrDBName, db.name},
+		Attribute{AttrDocumentID, doc.Id()}, Attribute{AttrConcurrency, concurrency.spanValue()})
+	err := db.DeleteDocument(doc, concurrency)
+	endSpan(span, err)
+	return err
+}
+
+/** Same as \ref Database.NewQuery, traced as "cbl.NewQuery". */
+func (db *Database) NewQueryContext(ctx context.Context, language QueryLanguage, queryString string) (*Query, error) {
+	return db.NewNamedQueryContext(ctx, "", language, queryString)
+}
+
+/** Same as \ref Database.NewNamedQuery, traced as "cbl.NewQuery". */
+func (db *Database) NewNamedQueryContext(ctx context.Context, name string, language QueryLanguage, queryString string) (*Query, error) {
+	_, span := startSpan(ctx, "cbl.NewQuery", Attribute{AttrDBName, db.name},
+		Attribute{AttrQueryLanguage, language.spanValue()}, Attribute{AttrQueryName, name})
+	query, err := db.NewNamedQuery(name, language, queryString)
+	endSpan(span, err)
+	return query, err
+}
+
+/** Same as \ref Query.Execute, but returns ctx.Err() as soon as ctx is done, and stops the
+    iteration once it is: \ref ResultSet.Next then returns false, releases the result set, and
+    \ref ResultSet.Err returns ctx.Err(). A query abandoned while executing finishes in the
+    background and its results are released; \ref Query.Close and \ref Database.Close wait for
+    it.
+
+    Traced as "cbl.Execute". The span stays open while the results are read, and ends with the
+    number of rows read when \ref ResultSet.Next returns false or the result set is released. */
+func (q *Query) ExecuteContext(ctx context.Context) (*ResultSet, error) {
+	_, span := startSpan(ctx, "cbl.Execute", Attribute{AttrQueryName, q.name})
+	if err := ctx.Err(); err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	var db_inflight *sync.WaitGroup
+	if q.db != nil {
+		db_inflight = &q.db.inflight
+	}
+	var mu sync.Mutex
+	var results *ResultSet
+	var err error
+	abandoned := false
+	run_err := runWithContext(ctx, func() {
+		r, e := q.Execute()
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			if r != nil {
+				r.Release()
+			}
+			return
+		}
+		results, err = r, e
+	}, db_inflight, &q.inflight)
+
+	if run_err != nil {
+		mu.Lock()
+		abandoned = true
+		// The query may have finished just as ctx was done.
+		if results != nil {
+			results.Release()
+		}
+		mu.Unlock()
+		endSpan(span, run_err)
+		return nil, run_err
+	}
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	results.span = span
+	results.ctx = ctx
+	return results, nil
+}
+
+// Ends the span of a result set created by ExecuteContext.
+func (res *ResultSet) endSpan() {
+	if res.span != nil {
+		res.span.SetAttributes(Attribute{AttrQueryRows, res.rows})
+		res.span.End()
+		res.span = nil
+	}
+}
+
+/** Same as \ref NewReplicator, traced as "cbl.NewReplicator". */
+func NewReplicatorContext(ctx context.Context, config ReplicatorConfiguration) (*Replicator, error) {
+	_, span := startSpan(ctx, "cbl.NewReplicator", Attribute{AttrReplicatorName, replicatorName(&config)})
+	rep, err := NewReplicator(config)
+	endSpan(span, err)
+	return rep, err
+}
+
+/** Same as \ref Replicator.Start, traced as "cbl.Replicator.Start". Starting is asynchronous,
+    so the span only covers the request. */
+func (rep *Replicator) StartContext(ctx context.Context) {
+	_, span := startSpan(ctx, "cbl.Replicator.Start", Attribute{AttrReplicatorName, rep.name})
+	rep.Start()
+	span.End()
+}
+
+/** Same as \ref Replicator.Stop, but waits until the replicator has stopped or ctx is done, with
+    or without a tracer; pass a context with a deadline to bound the wait. Traced as
+    "cbl.Replicator.Stop"; the span ends with the replicator's activity level. */
+func (rep *Replicator) StopContext(ctx context.Context) {
+	_, span := startSpan(ctx, "cbl.Replicator.Stop", Attribute{AttrReplicatorName, rep.name})
+	rep.Stop()
+	status := rep.Status()
+	for status.Activity != Stopped {
+		select {
+		case <-ctx.Done():
+			span.SetAttributes(Attribute{AttrReplicatorActivity, status.Activity.String()})
+			endSpan(span, ctx.Err())
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		status = rep.Status()
+	}
+	span.SetAttributes(Attribute{AttrReplicatorActivity, status.Activity.String()})
+	if status.Err.Code != 0 {
+		span.RecordError(status.Err)
+	}
+	span.End()
+}
+
+/** @} */